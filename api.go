@@ -1,25 +1,75 @@
 package telegramapi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/PROger4ever/telegramapi/mtproto"
 	"github.com/PROger4ever/telegramapi/tl"
 )
 
 type Options struct {
-	SeedAddr  Addr
+	SeedAddr Addr
+	Verbose  int
+
+	// PEM encoded server keys to accept in addition to the built-in keys of
+	// the production and test servers (mtproto.DefaultPublicKeyRing)
 	PublicKey string
-	Verbose   int
 
 	APIID   int
 	APIHash string
+
+	// FLOOD_WAIT errors asking to wait no longer than this are waited out
+	// and the request is retried; defaults to DefaultMaxFloodWait
+	MaxFloodWait time.Duration
+
+	// rate limiter applied to all requests; defaults to NewDefaultLimiter()
+	Limiter Limiter
+
+	// max number of retries after FLOOD_WAIT or transient errors; defaults to DefaultMaxRetries
+	MaxRetries int
+
+	// TCP packet framing; defaults to mtproto.TCPAbridged
+	TCPMode mtproto.TCPMode
+
+	// use the obfuscated2 protocol to hide the connections from DPI; cannot be combined with mtproto.TCPFull
+	Obfuscated bool
+
+	// connect over HTTP with long polling instead of TCP, for networks that only allow HTTP
+	HTTP bool
+
+	// connect over WebSocket (wss://<dc>.web.telegram.org/apiws) instead of TCP; requires Obfuscated
+	WebSocket bool
+
+	// proxy for all DC connections: socks5://[user:password@]host:port or http://[user:password@]host:port (HTTP CONNECT)
+	Proxy string
+
+	// opens the network connections, or the connection to Proxy; defaults to net.Dial
+	Dial mtproto.DialFunc
+
+	// MTProto proxy (host:port) for all TCP connections, and its secret in hex or base64, as found in tg://proxy links
+	MTProxy       string
+	MTProxySecret string
+
+	// try the IPv6 addresses of DCs before the IPv4 ones
+	PreferIPv6 bool
+
+	// use perfect forward secrecy: encrypt the traffic with temporary auth keys of this lifetime (e.g. 24h), bound to the saved permanent ones; 0 disables
+	TempKeyTTL time.Duration
 }
 
+const DefaultMaxFloodWait = 60 * time.Second
+
+var ErrWebSocketNotObfuscated = errors.New("WebSocket connections require Obfuscated, as Telegram accepts no other framing over them")
+
+// DC an MTProto proxy forwards to before the home DC is known
+const defaultMTProxyDC = 2
+
 type Conn struct {
 	Options
 
@@ -31,6 +81,13 @@ type Conn struct {
 	stateMut sync.Mutex
 
 	session *mtproto.Session
+	// the DC the main session is connected to, 0 while unknown; guarded by
+	// stateMut, unlike session itself
+	sessionDC int
+
+	updates   *updateManager
+	scheduler *scheduler
+	pool      *dcPool
 }
 
 type Delegate interface {
@@ -42,22 +99,57 @@ func New(options Options, state *State, delegate Delegate) *Conn {
 	if options.SeedAddr.IP == "" {
 		panic("configuration error: missing SeedAddr")
 	}
-	if options.PublicKey == "" {
-		panic("configuration error: missing public key")
+	if options.MaxFloodWait == 0 {
+		options.MaxFloodWait = DefaultMaxFloodWait
+	}
+	if options.Limiter == nil {
+		options.Limiter = NewDefaultLimiter()
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultMaxRetries
 	}
 
-	return &Conn{
+	c := &Conn{
 		Options:  options,
 		delegate: delegate,
 		state:    state,
 		session:  nil,
 
 		delegateQueue: make(chan func(), 1),
+
+		scheduler: newScheduler(options.Limiter, options.MaxFloodWait, options.MaxRetries, options.Verbose),
+	}
+	c.pool = newDCPool(c)
+	if ud, ok := delegate.(UpdatesDelegate); ok {
+		c.updates = newUpdateManager(c, ud)
 	}
+	return c
 }
 
 func (c *Conn) Send(o tl.Object) (tl.Object, error) {
-	return c.session.Send(o)
+	return c.SendContext(context.Background(), o)
+}
+
+// SendContext sends an RPC call over the current session, giving up when ctx
+// is done. Requests go through the rate limiter; FLOOD_WAIT errors shorter
+// than MaxFloodWait are waited out and the call is retried, as are
+// idempotent calls failing with transient server errors.
+func (c *Conn) SendContext(ctx context.Context, o tl.Object) (tl.Object, error) {
+	r, err := c.scheduler.do(ctx, o, func(ctx context.Context, o tl.Object) (tl.Object, error) {
+		return c.session.SendContext(ctx, o)
+	})
+
+	if err == nil && c.updates != nil {
+		if u, ok := r.(mtproto.TLUpdatesType); ok {
+			c.updates.push(u)
+		}
+	}
+	return r, err
+}
+
+// Stats returns per-method request counters, keyed by MethodName.
+func (c *Conn) Stats() map[string]MethodStats {
+	return c.scheduler.Stats()
 }
 
 func (c *Conn) Shutdown() {
@@ -79,6 +171,9 @@ func (c *Conn) runProcessing() {
 		c.delegateQueue <- func() {
 			c.delegate.HandleConnectionReady()
 		}
+		if c.updates != nil && c.LoginState() == LoggedIn {
+			c.updates.sync()
+		}
 	} else {
 		c.session.Fail(err)
 	}
@@ -95,7 +190,10 @@ func (c *Conn) runProcessingErr() error {
 		c.session.SetDC(r.ThisDC)
 		c.updateState(func(state *State) {
 			updateDCs(state.DCs, r)
+			c.sessionDC = r.ThisDC
 		})
+		// the DC is now known, so save the key for other sessions to use
+		c.saveSessionState()
 	default:
 		return c.HandleUnknownReply(r)
 	}
@@ -128,18 +226,20 @@ func (c *Conn) SwitchToDC(dc int) {
 func (c *Conn) HandleUnknownReply(r tl.Object) error {
 	switch r := r.(type) {
 	case *mtproto.TLRPCError:
-		if r.ErrorCode == 303 {
-			if nstr := stripPrefix(r.ErrorMessage, "PHONE_MIGRATE_"); nstr != "" {
-				n, err := strconv.Atoi(nstr)
-				if err != nil {
-					return errors.New("X not numeric in PHONE_MIGRATE_X")
-				}
-				c.SwitchToDC(n)
+		err := NewRPCError(r)
+		switch err.Type {
+		case ErrTypePhoneMigrate, ErrTypeUserMigrate, ErrTypeNetworkMigrate:
+			if dc, ok := IsMigrate(err); ok {
+				c.SwitchToDC(dc)
 				return mtproto.ErrReconnectRequired
 			}
+		case ErrTypeAuthKeyUnregistered:
+			c.updateState(func(state *State) {
+				state.LoginState = LoggedOut
+			})
 		}
 		log.Printf("RPC error: %v", r)
-		return fmt.Errorf("telegram error: %s", r.ErrorMessage)
+		return err
 	default:
 		log.Printf("Unknown reply: %v", r)
 		return errors.New("unknown reply")
@@ -162,7 +262,24 @@ func (c *Conn) saveSessionState() {
 	})
 }
 
+// homeDC returns the DC the main session is connected to, or 0 while it is
+// connected to the seed address and has not got the config yet. Unlike
+// c.session, which runInternal replaces on reconnects, it is safe to use
+// from any goroutine.
+func (c *Conn) homeDC() int {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	return c.sessionDC
+}
+
 func (c *Conn) Run() error {
+	c.delegateDone.Add(1)
+	go c.dispatchDelegateCalls()
+
+	if c.updates != nil {
+		c.updates.start()
+	}
+
 	for {
 		err := c.runInternal()
 		if err != mtproto.ErrReconnectRequired {
@@ -173,6 +290,10 @@ func (c *Conn) Run() error {
 }
 
 func (c *Conn) finalize() {
+	c.pool.closeAll()
+	if c.updates != nil {
+		c.updates.stop()
+	}
 	close(c.delegateQueue)
 	c.delegateDone.Wait()
 }
@@ -201,37 +322,159 @@ func (c *Conn) runInternal() error {
 		}
 	}
 
-	pubKey, err := mtproto.ParsePublicKey(c.PublicKey)
-	if err != nil {
-		return err
-	}
-
-	tr, err := mtproto.DialTCP(dc.PrimaryAddr.Endpoint(), mtproto.TCPTransportOptions{})
+	sess, err := c.newSession(dc, false)
 	if err != nil {
 		return err
 	}
+	c.session = sess
+	c.stateMut.Lock()
+	c.sessionDC = dc.ID
+	c.stateMut.Unlock()
 
-	c.session = mtproto.NewSession(tr, mtproto.SessionOptions{
-		PubKey:  pubKey,
-		Verbose: c.Verbose,
-	})
-	if dc.ID != 0 {
-		c.session.SetDC(dc.ID)
-	}
-
-	if dc.Auth.KeyID != 0 {
-		c.session.RestoreAuthState(&dc.Auth, dc.FramerState)
-	} else {
+	if dc.Auth.KeyID == 0 {
 		c.state.LoginState = LoggedOut
 	}
 
 	c.session.OnStateChanged(c.saveSessionState)
+	if c.updates != nil {
+		c.session.OnUpdates(c.updates.push)
+	}
 
-	c.delegateDone.Add(1)
-	go c.dispatchDelegateCalls()
 	go c.runProcessing()
 
 	c.session.Run()
 	c.saveSessionState()
 	return c.session.Err()
 }
+
+// netDialer returns the function opening connections to the DCs, going
+// through the proxy, if any.
+func (c *Conn) netDialer() (mtproto.DialFunc, error) {
+	if c.Proxy == "" {
+		return c.Dial, nil
+	}
+	return mtproto.ProxyDialer(c.Proxy, c.Dial)
+}
+
+// mtproxyDC returns the DC number an MTProto proxy should forward to.
+func (c *Conn) mtproxyDC(dc *DCState) int {
+	if dc.ID != 0 {
+		return dc.ID
+	}
+	if c.state.PreferredDC != 0 {
+		return c.state.PreferredDC
+	}
+	return defaultMTProxyDC
+}
+
+// newSession connects to the given DC, restoring the auth key saved for it, if any.
+func (c *Conn) newSession(dc *DCState, media bool) (*mtproto.Session, error) {
+	if c.WebSocket && !c.Obfuscated {
+		return nil, ErrWebSocketNotObfuscated
+	}
+
+	var publicKeys *mtproto.PublicKeyRing
+	if dc.IsCDN() {
+		// CDN DCs have keys of their own, and only those are accepted
+		c.stateMut.Lock()
+		publicKey := c.state.CDNPublicKeys[dc.ID]
+		c.stateMut.Unlock()
+		if publicKey == "" {
+			return nil, fmt.Errorf("no public key known for CDN DC %d", dc.ID)
+		}
+		publicKeys = mtproto.NewPublicKeyRing()
+		if err := publicKeys.AddPEM(publicKey); err != nil {
+			return nil, err
+		}
+	} else {
+		publicKeys = mtproto.DefaultPublicKeyRing()
+		if c.PublicKey != "" {
+			if err := publicKeys.AddPEM(c.PublicKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	netDial, err := c.netDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	var proxySecret *mtproto.ProxySecret
+	if c.MTProxy != "" {
+		proxySecret, err = mtproto.ParseProxySecret(c.MTProxySecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	endpoints := dcEndpoints(dc, media, c.PreferIPv6, c.Obfuscated)
+	dial := func() (mtproto.Transport, error) {
+		if c.WebSocket {
+			return mtproto.DialWebSocket(webSocketURL(dc.ID), mtproto.TCPTransportOptions{
+				Mode:       c.TCPMode,
+				Obfuscated: c.Obfuscated,
+				Dial:       netDial,
+			})
+		}
+		if c.HTTP {
+			host, _, err := net.SplitHostPort(endpoints[0])
+			if err != nil {
+				return nil, err
+			}
+			return mtproto.DialHTTP(net.JoinHostPort(host, "80"), mtproto.HTTPTransportOptions{
+				Dial: netDial,
+			})
+		}
+		if proxySecret != nil {
+			proxyDC := c.mtproxyDC(dc)
+			if media {
+				proxyDC = -proxyDC
+			}
+			return mtproto.DialTCP(c.MTProxy, mtproto.TCPTransportOptions{
+				Mode:        c.TCPMode,
+				Dial:        netDial,
+				ProxySecret: proxySecret,
+				DC:          proxyDC,
+			})
+		}
+		return mtproto.DialTCPAny(endpoints, mtproto.TCPTransportOptions{
+			Mode:       c.TCPMode,
+			Obfuscated: c.Obfuscated,
+			Dial:       netDial,
+		})
+	}
+	tr, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	options := mtproto.SessionOptions{
+		PublicKeys: publicKeys,
+		Verbose:    c.Verbose,
+		Dial:       dial,
+		TempKeyTTL: c.TempKeyTTL,
+	}
+	if dc.IsCDN() {
+		// CDN DCs do not support binding temporary keys
+		options.TempKeyTTL = 0
+	}
+	sess := mtproto.NewSession(tr, options)
+	if dc.ID != 0 {
+		sess.SetDC(dc.ID)
+	}
+
+	if dc.Auth.KeyID != 0 {
+		auth := dc.Auth
+		fs := dc.FramerState
+		if media {
+			// a media connection shares the auth key of the DC, but runs a
+			// session of its own, with its own seqno
+			auth.SessionID = [8]byte{}
+			fs = mtproto.FramerState{}
+		}
+		sess.RestoreAuthState(&auth, fs)
+	}
+
+	return sess, nil
+}
@@ -3,6 +3,7 @@ package telegramapi
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"log"
 
 	"github.com/PROger4ever/telegramapi/mtproto"
@@ -70,7 +71,7 @@ func (c *Conn) CompleteLoginWithCode(code string) (*mtproto.TLAuthAuthorization,
 		c.completeLogin(r1)
 		c.saveSessionState()
 		return r1, nil
-	} else if r2, ok := r.(*mtproto.TLRPCError); ok && r2.ErrorMessage == "SESSION_PASSWORD_NEEDED" {
+	} else if r2, ok := r.(*mtproto.TLRPCError); ok && errors.Is(NewRPCError(r2), ErrSessionPasswordNeeded) {
 		if c.Verbose >= 2 {
 			log.Printf("Got auth.signIn response: %v", r2)
 		}
@@ -94,7 +95,14 @@ func (c *Conn) completeLogin(auth *mtproto.TLAuthAuthorization) {
 			state.LastName = user.LastName
 			state.Username = user.Username
 		}
+		// logins imported into other DCs belonged to the previous user, if any
+		for _, dc := range state.DCs {
+			dc.Authorized = false
+		}
 	})
+	if c.updates != nil {
+		c.updates.sync()
+	}
 }
 
 func (c *Conn) CompleteLoginWith2FAPassword(password []byte) error {
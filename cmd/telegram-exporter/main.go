@@ -18,17 +18,6 @@ import (
 	"github.com/PROger4ever/telegramapi"
 )
 
-const publicKey = `
------BEGIN RSA PUBLIC KEY-----
-MIIBCgKCAQEAwVACPi9w23mF3tBkdZz+zwrzKOaaQdr01vAbU4E1pvkfj4sqDsm6
-lyDONS789sVoD/xCS9Y0hkkC3gtL1tSfTlgCMOOul9lcixlEKzwKENj1Yz/s7daS
-an9tqw3bfUV/nqgbhGX81v/+7RFAEd+RwFnK7a+XYl9sluzHRyVVaTTveB2GazTw
-Efzk2DWgkBluml8OREmvfraX3bkHZJTKX4EQSjBbbdJ2ZXIsRrYOXfaA+xayEGB+
-8hdlLmAjbCVfaigxX0CDqWeR1yFL9kwd9P0NsZRPsmoqVwMbMu7mStFai6aIhc3n
-Slv8kg9qv1m6XHVQY3PnEw+QQtqSIXklHwIDAQAB
------END RSA PUBLIC KEY-----
-`
-
 var apiID string
 var apiHash string
 var version string
@@ -43,9 +32,8 @@ func main() {
 	fmt.Fprintf(os.Stderr, "Telegram Exporter v. %s\n\n", version)
 
 	options := telegramapi.Options{
-		SeedAddr:  telegramapi.Addr{"149.154.175.100", 443},
-		PublicKey: publicKey,
-		Verbose:   0,
+		SeedAddr: telegramapi.Addr{"149.154.175.100", 443},
+		Verbose:  0,
 	}
 
 	if apiID == "" {
@@ -0,0 +1,141 @@
+package telegramapi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/mtproto/mtprototest"
+)
+
+type testDelegate struct {
+	readyc chan struct{}
+	once   sync.Once
+}
+
+func (d *testDelegate) HandleConnectionReady() {
+	d.once.Do(func() {
+		close(d.readyc)
+	})
+}
+
+func (d *testDelegate) HandleStateChanged(newState *State) {
+}
+
+// startTestConn runs a Conn against srv, with DC 2 as the seed, and waits
+// until it is ready.
+func startTestConn(t *testing.T, srv *mtprototest.Server) *Conn {
+	delegate := &testDelegate{readyc: make(chan struct{})}
+	return startTestConnWith(t, srv, &State{}, delegate, delegate.readyc)
+}
+
+// startTestConnWith is startTestConn with the given state and delegate,
+// which must close readyc when the connection is ready.
+func startTestConnWith(t *testing.T, srv *mtprototest.Server, state *State, delegate Delegate, readyc <-chan struct{}) *Conn {
+	c := New(Options{
+		SeedAddr:  Addr{IP: "127.0.0.2", Port: 443},
+		Dial:      srv.Dial,
+		PublicKey: srv.PublicKeyPEM(),
+	}, state, delegate)
+
+	runDone := make(chan struct{})
+	go func() {
+		c.Run()
+		close(runDone)
+	}()
+	t.Cleanup(func() {
+		c.Shutdown()
+		<-runDone
+	})
+
+	select {
+	case <-readyc:
+	case <-runDone:
+		t.Fatal("Conn exited before becoming ready")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Conn not ready after 10s")
+	}
+	return c
+}
+
+func TestConnAgainstFakeServer(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	srv.Handle(mtproto.TagMessagesGetDialogs, mtprototest.Reply(&mtproto.TLMessagesDialogsSlice{Count: 7}))
+
+	c := startTestConn(t, srv)
+	if dc := c.session.DC(); dc != 2 {
+		t.Errorf("home DC is %d, expected 2", dc)
+	}
+	if dc := c.homeDC(); dc != 2 {
+		t.Errorf("homeDC returned %d, expected 2", dc)
+	}
+
+	r, err := c.Send(&mtproto.TLMessagesGetDialogs{OffsetPeer: &mtproto.TLInputPeerEmpty{}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialogs, ok := r.(*mtproto.TLMessagesDialogsSlice); !ok || dialogs.Count != 7 {
+		t.Errorf("messages.getDialogs returned %v", r)
+	}
+
+	// the session stays on DC 2 until it reconnects
+	c.SwitchToDC(4)
+	if dc := c.homeDC(); dc != 2 {
+		t.Errorf("homeDC returned %d before reconnecting, expected 2", dc)
+	}
+}
+
+func TestConnFollowsFileMigrate(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	srv.Handle(mtproto.TagHelpGetNearestDC, mtprototest.PerDC("FILE", map[int]mtprototest.Handler{
+		4: mtprototest.Reply(&mtproto.TLNearestDC{ThisDC: 4}),
+	}))
+
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := c.SendToDC(ctx, 0, &mtproto.TLHelpGetNearestDC{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest, ok := r.(*mtproto.TLNearestDC); !ok || nearest.ThisDC != 4 {
+		t.Errorf("help.getNearestDc returned %v", r)
+	}
+}
+
+func TestMediaSessionIsSeparate(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.SendToMediaDC(ctx, 0, &mtproto.TLHelpGetConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	media, err := c.pool.get(ctx, c.session.DC(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mainAuth, _ := c.session.AuthState()
+	mediaAuth, _ := media.AuthState()
+	if mainAuth.KeyID != mediaAuth.KeyID {
+		t.Errorf("media session uses key %x, expected %x", mediaAuth.KeyID, mainAuth.KeyID)
+	}
+	if mainAuth.SessionID == mediaAuth.SessionID {
+		t.Errorf("media session shares the session ID %x of the main one", mainAuth.SessionID)
+	}
+}
+
+func TestWebSocketRequiresObfuscated(t *testing.T) {
+	c := New(Options{SeedAddr: Addr{IP: "127.0.0.2", Port: 443}, WebSocket: true}, &State{}, &testDelegate{})
+	if _, err := c.newSession(&DCState{ID: 2}, false); err != ErrWebSocketNotObfuscated {
+		t.Errorf("newSession returned %v, expected ErrWebSocketNotObfuscated", err)
+	}
+}
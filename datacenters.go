@@ -1,38 +1,134 @@
 package telegramapi
 
 import (
+	"context"
+	"fmt"
+	"sort"
+
 	"github.com/PROger4ever/telegramapi/mtproto"
 )
 
 func updateDCs(dcs map[int]*DCState, config *mtproto.TLConfig) {
-	oldIDs := make(map[int]bool)
+	addrs := make(map[int][]DCAddr)
+	for _, opt := range config.DCOptions {
+		addrs[opt.ID] = append(addrs[opt.ID], DCAddr{
+			Addr: Addr{
+				IP:   opt.IPAddress,
+				Port: opt.Port,
+			},
+			IPv6:      opt.IPv6(),
+			MediaOnly: opt.MediaOnly(),
+			TCPoOnly:  opt.TCPoOnly(),
+			CDN:       opt.Cdn(),
+			Static:    opt.Static(),
+		})
+	}
+
 	for id, _ := range dcs {
-		oldIDs[id] = true
+		if addrs[id] == nil {
+			delete(dcs, id)
+		}
 	}
 
-	for _, opt := range config.DCOptions {
-		if opt.IPv6() {
-			continue
+	for id, list := range addrs {
+		dc := dcs[id]
+		if dc == nil {
+			dc = &DCState{ID: id}
+			dcs[dc.ID] = dc
+		}
+
+		dc.Addrs = list
+		for _, addr := range list {
+			if !addr.IPv6 && !addr.MediaOnly && !addr.TCPoOnly {
+				dc.PrimaryAddr = addr.Addr
+				break
+			}
+		}
+		if dc.PrimaryAddr.IP == "" {
+			dc.PrimaryAddr = list[0].Addr
 		}
-		if opt.MediaOnly() {
+	}
+}
+
+// dcEndpoints returns the addresses to try when connecting to the DC, best
+// first: media-only addresses for media connections, then the regular ones,
+// alternating between the address families starting with the preferred one.
+func dcEndpoints(dc *DCState, media, preferIPv6, obfuscated bool) []string {
+	var usable []DCAddr
+	for _, addr := range dc.Addrs {
+		if (addr.MediaOnly && !media) || (addr.TCPoOnly && !obfuscated) {
 			continue
 		}
+		usable = append(usable, addr)
+	}
+	if media {
+		sort.SliceStable(usable, func(i, j int) bool {
+			return usable[i].MediaOnly && !usable[j].MediaOnly
+		})
+	}
 
-		dc := dcs[opt.ID]
-		if dc == nil {
-			dc = &DCState{ID: opt.ID}
-			dcs[dc.ID] = dc
+	var preferred, fallback []string
+	for _, addr := range usable {
+		if addr.IPv6 == preferIPv6 {
+			preferred = append(preferred, addr.Endpoint())
+		} else {
+			fallback = append(fallback, addr.Endpoint())
 		}
+	}
 
-		dc.PrimaryAddr = Addr{
-			IP:   opt.IPAddress,
-			Port: opt.Port,
+	var endpoints []string
+	for len(preferred) > 0 || len(fallback) > 0 {
+		if len(preferred) > 0 {
+			endpoints = append(endpoints, preferred[0])
+			preferred = preferred[1:]
+		}
+		if len(fallback) > 0 {
+			endpoints = append(endpoints, fallback[0])
+			fallback = fallback[1:]
 		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = []string{dc.PrimaryAddr.Endpoint()}
+	}
+	return endpoints
+}
+
+var webSocketHosts = map[int]string{
+	1: "pluto",
+	2: "venus",
+	3: "aurora",
+	4: "vesta",
+	5: "flora",
+}
+
+// webSocketURL returns the WebSocket endpoint of a production DC.
+func webSocketURL(dc int) string {
+	host, ok := webSocketHosts[dc]
+	if !ok {
+		host = "venus"
+	}
+	return fmt.Sprintf("wss://%s.web.telegram.org/apiws", host)
+}
 
-		delete(oldIDs, dc.ID)
+// LoadCDNConfig fetches the public keys of the CDN DCs, which are needed to
+// connect to them.
+func (c *Conn) LoadCDNConfig(ctx context.Context) error {
+	r, err := c.SendContext(ctx, &mtproto.TLHelpGetCdnConfig{})
+	if err != nil {
+		return err
 	}
 
-	for id, _ := range oldIDs {
-		delete(dcs, id)
+	switch r := r.(type) {
+	case *mtproto.TLCdnConfig:
+		c.updateState(func(state *State) {
+			for _, key := range r.PublicKeys {
+				state.CDNPublicKeys[key.DCID] = key.PublicKey
+			}
+		})
+		return nil
+	case *mtproto.TLRPCError:
+		return NewRPCError(r)
+	default:
+		return c.HandleUnknownReply(r)
 	}
 }
@@ -0,0 +1,101 @@
+package telegramapi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+func newTestDCOption(id int, ip string, ipv6, media, cdn bool) *mtproto.TLDCOption {
+	opt := &mtproto.TLDCOption{ID: id, IPAddress: ip, Port: 443}
+	opt.SetIPv6(ipv6)
+	opt.SetMediaOnly(media)
+	opt.SetCdn(cdn)
+	return opt
+}
+
+func testDCConfig() *mtproto.TLConfig {
+	return &mtproto.TLConfig{
+		DCOptions: []*mtproto.TLDCOption{
+			newTestDCOption(2, "2001:67c:4e8:f002::a", true, false, false),
+			newTestDCOption(2, "149.154.167.51", false, false, false),
+			newTestDCOption(2, "149.154.167.222", false, true, false),
+			newTestDCOption(2, "2001:67c:4e8:f002::b", true, true, false),
+			newTestDCOption(203, "91.105.192.100", false, false, true),
+		},
+	}
+}
+
+func TestUpdateDCs(t *testing.T) {
+	dcs := map[int]*DCState{
+		1: {ID: 1},
+		2: {ID: 2, Authorized: true},
+	}
+	updateDCs(dcs, testDCConfig())
+
+	if dcs[1] != nil {
+		t.Errorf("DC 1 kept after it disappeared from the config")
+	}
+	dc := dcs[2]
+	if dc == nil || !dc.Authorized {
+		t.Fatalf("DC 2 state lost: %+v", dc)
+	}
+	if dc.PrimaryAddr.IP != "149.154.167.51" {
+		t.Errorf("PrimaryAddr == %v, expected the regular IPv4 address", dc.PrimaryAddr)
+	}
+	if len(dc.Addrs) != 4 || !dc.Addrs[0].IPv6 || !dc.Addrs[2].MediaOnly || dc.IsCDN() {
+		t.Errorf("DC 2 addresses == %+v", dc.Addrs)
+	}
+	if cdn := dcs[203]; cdn == nil || !cdn.IsCDN() {
+		t.Errorf("CDN DC 203 == %+v", cdn)
+	}
+}
+
+func TestDCEndpoints(t *testing.T) {
+	dcs := make(map[int]*DCState)
+	updateDCs(dcs, testDCConfig())
+	dc := dcs[2]
+
+	tests := []struct {
+		media, preferIPv6 bool
+		expected          []string
+	}{
+		{false, false, []string{"149.154.167.51:443", "[2001:67c:4e8:f002::a]:443"}},
+		{false, true, []string{"[2001:67c:4e8:f002::a]:443", "149.154.167.51:443"}},
+		{true, false, []string{"149.154.167.222:443", "[2001:67c:4e8:f002::b]:443", "149.154.167.51:443", "[2001:67c:4e8:f002::a]:443"}},
+	}
+	for _, tt := range tests {
+		if a := dcEndpoints(dc, tt.media, tt.preferIPv6, false); !reflect.DeepEqual(a, tt.expected) {
+			t.Errorf("dcEndpoints(media %v, IPv6 %v) == %v, expected %v", tt.media, tt.preferIPv6, a, tt.expected)
+		}
+	}
+
+	seed := &DCState{PrimaryAddr: Addr{"149.154.167.50", 443}}
+	if a := dcEndpoints(seed, false, false, false); !reflect.DeepEqual(a, []string{"149.154.167.50:443"}) {
+		t.Errorf("dcEndpoints of the seed DC == %v", a)
+	}
+}
+
+func TestStateKeepsDCAddrs(t *testing.T) {
+	state := &State{}
+	state.initialize()
+	updateDCs(state.DCs, testDCConfig())
+	state.CDNPublicKeys[203] = "-----BEGIN RSA PUBLIC KEY-----"
+
+	var w tl.Writer
+	state.WriteBareTo(&w)
+	var restored State
+	r := tl.NewReader(w.Bytes())
+	restored.ReadBareFrom(r)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.DCs[2].Addrs, state.DCs[2].Addrs) {
+		t.Errorf("restored addresses %+v, expected %+v", restored.DCs[2].Addrs, state.DCs[2].Addrs)
+	}
+	if !reflect.DeepEqual(restored.CDNPublicKeys, state.CDNPublicKeys) {
+		t.Errorf("restored CDN keys %v", restored.CDNPublicKeys)
+	}
+}
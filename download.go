@@ -0,0 +1,302 @@
+package telegramapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// DownloadPartSize is the size of the parts DownloadFile requests. The
+// offset and limit of upload.getFile must be multiples of 4 KiB, and a part
+// must not cross a 1 MiB boundary, which parts aligned to their size never do.
+const DownloadPartSize = 512 * 1024
+
+// how many parts DownloadFile requests at once
+const downloadWorkers = 4
+
+var ErrFileSizeMismatch = errors.New("downloaded file size does not match the expected one")
+
+// FileLocation is a file to download: either one stored by Telegram, or a
+// remote file that Telegram fetches for us.
+type FileLocation struct {
+	Location    mtproto.TLInputFileLocationType
+	WebLocation *mtproto.TLInputWebFileLocation
+
+	// DC stores the file, 0 meaning the home DC. FILE_MIGRATE errors lead to
+	// the right DC anyway, at the cost of a round trip.
+	DC int
+
+	// Size, if known, is checked against the downloaded data
+	Size int64
+}
+
+// DocumentLocation returns the location of a document.
+func DocumentLocation(doc *mtproto.TLDocument) *FileLocation {
+	return &FileLocation{
+		Location: &mtproto.TLInputDocumentFileLocation{
+			ID:         doc.ID,
+			AccessHash: doc.AccessHash,
+			Version:    doc.Version,
+		},
+		DC:   doc.DCID,
+		Size: int64(doc.Size),
+	}
+}
+
+// PhotoLocation returns the location of the largest size of a photo, or nil
+// if none of them can be downloaded.
+func PhotoLocation(photo *mtproto.TLPhoto) *FileLocation {
+	var best *mtproto.TLPhotoSize
+	var bestLoc *mtproto.TLFileLocation
+	for _, size := range photo.Sizes {
+		size, ok := size.(*mtproto.TLPhotoSize)
+		if !ok {
+			continue
+		}
+		loc, ok := size.Location.(*mtproto.TLFileLocation)
+		if !ok {
+			continue
+		}
+		if best == nil || size.W*size.H > best.W*best.H {
+			best, bestLoc = size, loc
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return &FileLocation{
+		Location: &mtproto.TLInputFileLocation{
+			VolumeID: bestLoc.VolumeID,
+			LocalID:  bestLoc.LocalID,
+			Secret:   bestLoc.Secret,
+		},
+		DC:   bestLoc.DCID,
+		Size: int64(best.Size),
+	}
+}
+
+// MediaLocation returns the location of the photo or document attached to a
+// message, or nil for other media.
+func MediaLocation(media mtproto.TLMessageMediaType) *FileLocation {
+	switch media := media.(type) {
+	case *mtproto.TLMessageMediaPhoto:
+		if photo, ok := media.Photo.(*mtproto.TLPhoto); ok {
+			return PhotoLocation(photo)
+		}
+	case *mtproto.TLMessageMediaDocument:
+		if doc, ok := media.Document.(*mtproto.TLDocument); ok {
+			return DocumentLocation(doc)
+		}
+	}
+	return nil
+}
+
+// DownloadFile writes a file to w, fetching parts of it in parallel over
+// media connections. It returns the size of the file; on failure, it returns
+// the length of the beginning of the file that has been written, for
+// ResumeDownload to continue from.
+func (c *Conn) DownloadFile(ctx context.Context, loc *FileLocation, w io.WriterAt) (int64, error) {
+	return c.ResumeDownload(ctx, loc, w, 0)
+}
+
+// ResumeDownload is like DownloadFile, but skips the first offset bytes of
+// the file, which w already has. The offset is rounded down to a multiple of
+// DownloadPartSize.
+func (c *Conn) ResumeDownload(ctx context.Context, loc *FileLocation, w io.WriterAt, offset int64) (int64, error) {
+	if (loc.Location == nil) == (loc.WebLocation == nil) {
+		return 0, errors.New("file location must have either Location or WebLocation")
+	}
+
+	first := int(offset / DownloadPartSize)
+	d := &download{
+		conn:  c,
+		loc:   loc,
+		w:     w,
+		dc:    loc.DC,
+		first: first,
+		next:  first,
+		end:   -1,
+		parts: make(map[int]int),
+	}
+	d.expectSize(loc.Size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < downloadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.work(ctx); err != nil {
+				d.fail(err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return d.result()
+}
+
+// download is the state shared by the workers of DownloadFile.
+type download struct {
+	conn *Conn
+	loc  *FileLocation
+	w    io.WriterAt
+
+	mut   sync.Mutex
+	dc    int
+	size  int64       // expected size, or 0 if unknown
+	first int         // first part to download
+	next  int         // next part to request
+	end   int         // number of parts, or -1 while unknown
+	parts map[int]int // lengths of the parts written
+	err   error
+}
+
+func (d *download) work(ctx context.Context) error {
+	for {
+		part, ok := d.nextPart()
+		if !ok {
+			return nil
+		}
+		data, err := d.fetch(ctx, part)
+		if err != nil {
+			return err
+		}
+		if len(data) > DownloadPartSize {
+			return fmt.Errorf("part %d of the file is %d bytes long", part, len(data))
+		}
+		if len(data) > 0 {
+			if _, err := d.w.WriteAt(data, int64(part)*DownloadPartSize); err != nil {
+				return err
+			}
+		}
+		d.finishPart(part, len(data))
+	}
+}
+
+func (d *download) nextPart() (int, bool) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.err != nil || (d.end >= 0 && d.next >= d.end) {
+		return 0, false
+	}
+	part := d.next
+	d.next++
+	return part, true
+}
+
+// finishPart records a part; a short one is the last part of the file.
+func (d *download) finishPart(part, n int) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.parts[part] = n
+	if n < DownloadPartSize {
+		end := part
+		if n > 0 {
+			end++
+		}
+		if d.end < 0 || end < d.end {
+			d.end = end
+		}
+	}
+}
+
+// expectSize sets the size of the file, which bounds the parts to request.
+func (d *download) expectSize(size int64) {
+	if size <= 0 {
+		return
+	}
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.size == 0 {
+		d.size = size
+		end := int((size + DownloadPartSize - 1) / DownloadPartSize)
+		if d.end < 0 || end < d.end {
+			d.end = end
+		}
+	}
+}
+
+func (d *download) fail(err error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *download) fetch(ctx context.Context, part int) ([]byte, error) {
+	var req tl.Object
+	offset := part * DownloadPartSize
+	if d.loc.WebLocation != nil {
+		req = &mtproto.TLUploadGetWebFile{Location: d.loc.WebLocation, Offset: offset, Limit: DownloadPartSize}
+	} else {
+		req = &mtproto.TLUploadGetFile{Location: d.loc.Location, Offset: offset, Limit: DownloadPartSize}
+	}
+
+	d.mut.Lock()
+	dc := d.dc
+	d.mut.Unlock()
+	r, dc, err := d.conn.sendToDCFollow(ctx, dc, true, req)
+	if err != nil {
+		return nil, err
+	}
+	d.mut.Lock()
+	d.dc = dc
+	d.mut.Unlock()
+
+	switch r := r.(type) {
+	case *mtproto.TLUploadFile:
+		return r.Bytes, nil
+	case *mtproto.TLUploadWebFile:
+		d.expectSize(int64(r.Size))
+		return r.Bytes, nil
+	case *mtproto.TLRPCError:
+		return nil, NewRPCError(r)
+	default:
+		return nil, d.conn.HandleUnknownReply(r)
+	}
+}
+
+// result returns the length of the beginning of the file that has been
+// written, and checks that it is the whole file as expected.
+func (d *download) result() (int64, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	written := int64(d.first) * DownloadPartSize
+	last := d.first
+	for ; ; last++ {
+		n, ok := d.parts[last]
+		if !ok {
+			break
+		}
+		written += int64(n)
+		if n < DownloadPartSize {
+			break
+		}
+	}
+	if d.err != nil {
+		return written, d.err
+	}
+
+	for part, n := range d.parts {
+		if part >= d.end && n > 0 {
+			return written, fmt.Errorf("%w: got data after the end at part %d", ErrFileSizeMismatch, part)
+		}
+	}
+	if last < d.end-1 {
+		return written, fmt.Errorf("%w: part %d is short", ErrFileSizeMismatch, last)
+	}
+	if d.size > 0 && written != d.size {
+		return written, fmt.Errorf("%w: got %d bytes, expected %d", ErrFileSizeMismatch, written, d.size)
+	}
+	return written, nil
+}
@@ -0,0 +1,137 @@
+package telegramapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/mtproto/mtprototest"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// memFile is an in-memory io.WriterAt.
+type memFile struct {
+	mut  sync.Mutex
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p)
+	return len(p), nil
+}
+
+// fileServer serves upload.getFile requests for a file stored on DC 4.
+type fileServer struct {
+	content []byte
+
+	mut     sync.Mutex
+	offsets []int
+	failAt  int
+}
+
+func newFileServer(srv *mtprototest.Server, size int) *fileServer {
+	fs := &fileServer{content: make([]byte, size), failAt: -1}
+	rand.New(rand.NewSource(1)).Read(fs.content)
+	srv.Handle(mtproto.TagUploadGetFile, mtprototest.PerDC("FILE", map[int]mtprototest.Handler{4: fs.handle}))
+	return fs
+}
+
+func (fs *fileServer) handle(req *mtprototest.Request) tl.Object {
+	q := req.Query.(*mtproto.TLUploadGetFile)
+	fs.mut.Lock()
+	fs.offsets = append(fs.offsets, q.Offset)
+	fail := fs.failAt >= 0 && q.Offset >= fs.failAt
+	fs.mut.Unlock()
+	if fail {
+		return &mtproto.TLRPCError{ErrorCode: 400, ErrorMessage: "FILE_PARTS_INVALID"}
+	}
+
+	start, end := q.Offset, q.Offset+q.Limit
+	if start > len(fs.content) {
+		start = len(fs.content)
+	}
+	if end > len(fs.content) {
+		end = len(fs.content)
+	}
+	return &mtproto.TLUploadFile{Type: &mtproto.TLStorageFilePartial{}, Bytes: fs.content[start:end]}
+}
+
+func (fs *fileServer) setFailAt(offset int) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	fs.failAt = offset
+	fs.offsets = nil
+}
+
+func TestDownloadFile(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	fs := newFileServer(srv, 3*DownloadPartSize+1000)
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	location := &mtproto.TLInputDocumentFileLocation{ID: 1, AccessHash: 2}
+	for _, size := range []int64{int64(len(fs.content)), 0} {
+		var f memFile
+		n, err := c.DownloadFile(ctx, &FileLocation{Location: location, Size: size}, &f)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if n != int64(len(fs.content)) || !bytes.Equal(f.data, fs.content) {
+			t.Errorf("size %d: downloaded %d bytes, content matches: %v", size, n, bytes.Equal(f.data, fs.content))
+		}
+	}
+
+	var f memFile
+	_, err := c.DownloadFile(ctx, &FileLocation{Location: location, DC: 4, Size: int64(len(fs.content)) - 1}, &f)
+	if !errors.Is(err, ErrFileSizeMismatch) {
+		t.Errorf("download with a wrong size: %v", err)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	fs := newFileServer(srv, 4*DownloadPartSize)
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	loc := &FileLocation{Location: &mtproto.TLInputDocumentFileLocation{ID: 1, AccessHash: 2}, DC: 4}
+
+	fs.setFailAt(2 * DownloadPartSize)
+	var f memFile
+	n, err := c.DownloadFile(ctx, loc, &f)
+	if e, ok := err.(*RPCError); !ok || e.Type != "FILE_PARTS_INVALID" {
+		t.Fatalf("failed download returned %v", err)
+	}
+	if n%DownloadPartSize != 0 || n > 2*DownloadPartSize || !bytes.Equal(f.data[:n], fs.content[:n]) {
+		t.Fatalf("failed download reports %d bytes written", n)
+	}
+
+	resumeFrom := n
+	fs.setFailAt(-1)
+	n, err = c.ResumeDownload(ctx, loc, &f, resumeFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(fs.content)) || !bytes.Equal(f.data, fs.content) {
+		t.Errorf("resumed download has %d bytes, content matches: %v", n, bytes.Equal(f.data, fs.content))
+	}
+	for _, offset := range fs.offsets {
+		if int64(offset) < resumeFrom {
+			t.Errorf("part at %d requested again", offset)
+		}
+	}
+}
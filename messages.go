@@ -2,7 +2,6 @@ package telegramapi
 
 import (
 	"log"
-	"time"
 
 	"github.com/PROger4ever/telegramapi/mtproto"
 )
@@ -139,8 +138,6 @@ func (c *Conn) LoadHistory(contacts *ContactList, chat *Chat, limit int) error {
 		if more {
 			log.Printf("Loaded %d messages...", count)
 		}
-
-		time.Sleep(1 * time.Second)
 	}
 	log.Printf("Done. Loaded %d messages.", count)
 
@@ -0,0 +1,55 @@
+package mtproto
+
+import (
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// TLBoolTrue is a boxed boolTrue, as returned by RPC calls like
+// auth.bindTempAuthKey. Bool fields of generated types are plain Go bools.
+type TLBoolTrue struct{}
+
+func (o *TLBoolTrue) Cmd() uint32 {
+	return TagBoolTrue
+}
+
+func (o *TLBoolTrue) ReadBareFrom(r *tl.Reader) {
+}
+
+func (o *TLBoolTrue) WriteBareTo(w *tl.Writer) {
+}
+
+func (o *TLBoolTrue) String() string {
+	return "true"
+}
+
+// TLBoolFalse is a boxed boolFalse.
+type TLBoolFalse struct{}
+
+func (o *TLBoolFalse) Cmd() uint32 {
+	return TagBoolFalse
+}
+
+func (o *TLBoolFalse) ReadBareFrom(r *tl.Reader) {
+}
+
+func (o *TLBoolFalse) WriteBareTo(w *tl.Writer) {
+}
+
+func (o *TLBoolFalse) String() string {
+	return "false"
+}
+
+func init() {
+	// the generated factory does not know about boxed Bools
+	factory := Schema.Factory
+	Schema.Factory = func(cmd uint32) tl.Object {
+		switch cmd {
+		case TagBoolTrue:
+			return new(TLBoolTrue)
+		case TagBoolFalse:
+			return new(TLBoolFalse)
+		default:
+			return factory(cmd)
+		}
+	}
+}
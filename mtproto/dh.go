@@ -0,0 +1,134 @@
+package mtproto
+
+import (
+	"crypto/sha1"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/PROger4ever/telegramapi/binints"
+)
+
+const dhPrimeBits = 2048
+
+var (
+	ErrBadDHPrime = errors.New("dh_prime is not a safe 2048-bit prime")
+	ErrBadDHG     = errors.New("g is not a valid generator for dh_prime")
+	ErrBadDHValue = errors.New("DH value out of the allowed range")
+)
+
+// telegramDHPrime is the prime Telegram servers currently send.
+const telegramDHPrime = "" +
+	"C71CAEB9C6B1C9048E6C522F70F13F73980D40238E3E21C14934D037563D930F" +
+	"48198A0AA7C14058229493D22530F4DBFA336F6E0AC925139543AED44CCE7C37" +
+	"20FD51F69458705AC68CD4FE6B6B13ABDC9746512969328454F18FAF8C595F64" +
+	"2477FE96BB2A941D5BCD1D4AC8CC49880708FA9B378E3C4F3A9060BEE67CF9A4" +
+	"A4A695811051907E162753B56B0F6B410DBA74D8A84B2A14B3144E0EF1284754" +
+	"FD17ED950D5965B4B9DD46582DB1178D169C6BC465B0D6FF9CA3928FEF5B9AE4" +
+	"E418FC15E83EBEA0F87FA9FF5EED70050DED2849F47BF959D956850CE929851F" +
+	"0D8115F635B105EE2E4E15D04B2454BF6F4FADF034B10403119CD8E3B92FCC5B"
+
+// safeDHPrimes remembers the primes that passed the full check, so that the
+// expensive primality tests only run once per prime.
+var safeDHPrimes = struct {
+	sync.Mutex
+	primes []*big.Int
+}{
+	primes: []*big.Int{mustParseHexInt(telegramDHPrime)},
+}
+
+func mustParseHexInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex number " + s)
+	}
+	return n
+}
+
+// checkDHParams verifies that p is a 2048-bit safe prime and that g generates
+// the cyclic subgroup of order (p-1)/2, as required by MTProto.
+func checkDHParams(g int, p *big.Int) error {
+	if p.Sign() <= 0 || p.BitLen() != dhPrimeBits {
+		return ErrBadDHPrime
+	}
+	if err := checkDHGenerator(g, p); err != nil {
+		return err
+	}
+
+	safeDHPrimes.Lock()
+	defer safeDHPrimes.Unlock()
+	for _, known := range safeDHPrimes.primes {
+		if known.Cmp(p) == 0 {
+			return nil
+		}
+	}
+
+	if !p.ProbablyPrime(20) {
+		return ErrBadDHPrime
+	}
+	half := new(big.Int).Rsh(p, 1)
+	if !half.ProbablyPrime(20) {
+		return ErrBadDHPrime
+	}
+	safeDHPrimes.primes = append(safeDHPrimes.primes, new(big.Int).Set(p))
+	return nil
+}
+
+// checkDHGenerator checks g against the quadratic residue conditions on p
+// listed in the MTProto key exchange spec.
+func checkDHGenerator(g int, p *big.Int) error {
+	mod := func(m int64) int64 {
+		return new(big.Int).Mod(p, big.NewInt(m)).Int64()
+	}
+
+	var ok bool
+	switch g {
+	case 2:
+		ok = mod(8) == 7
+	case 3:
+		ok = mod(3) == 2
+	case 4:
+		ok = true
+	case 5:
+		r := mod(5)
+		ok = r == 1 || r == 4
+	case 6:
+		r := mod(24)
+		ok = r == 19 || r == 23
+	case 7:
+		r := mod(7)
+		ok = r == 3 || r == 5 || r == 6
+	}
+	if !ok {
+		return ErrBadDHG
+	}
+	return nil
+}
+
+// checkDHValue checks that 1 < v < p-1 and that v is at least 2^(2048-64)
+// away from both ends, as required for g_a and g_b.
+func checkDHValue(v, p *big.Int) error {
+	one := big.NewInt(1)
+	if v.Cmp(one) <= 0 || v.Cmp(new(big.Int).Sub(p, one)) >= 0 {
+		return ErrBadDHValue
+	}
+	margin := new(big.Int).Lsh(one, dhPrimeBits-64)
+	if v.Cmp(margin) < 0 || v.Cmp(new(big.Int).Sub(p, margin)) > 0 {
+		return ErrBadDHValue
+	}
+	return nil
+}
+
+// newNonceHash computes new_nonce_hash1, 2 or 3: the lower 128 bits of
+// SHA1(new_nonce + n + auth_key_aux_hash).
+func newNonceHash(newNonce []byte, n byte, authKeyAuxHash uint64) [16]byte {
+	var src [32 + 1 + 8]byte
+	copy(src[:32], newNonce)
+	src[32] = n
+	binints.EncodeUint64LE(authKeyAuxHash, src[33:])
+
+	h := sha1.Sum(src[:])
+	var result [16]byte
+	copy(result[:], h[4:])
+	return result
+}
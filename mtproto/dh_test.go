@@ -0,0 +1,58 @@
+package mtproto
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestCheckDHParams(t *testing.T) {
+	p := mustParseHexInt(telegramDHPrime)
+
+	if err := checkDHParams(3, p); err != nil {
+		t.Errorf("g=3: %v", err)
+	}
+	if err := checkDHParams(4, p); err != nil {
+		t.Errorf("g=4: %v", err)
+	}
+	for _, g := range []int{0, 1, 2, 5, 8} {
+		if err := checkDHParams(g, p); err != ErrBadDHG {
+			t.Errorf("g=%d: got %v, wanted %v", g, err, ErrBadDHG)
+		}
+	}
+
+	// p+4 is 2048 bits and keeps p mod 3, but is not prime
+	notPrime := new(big.Int).Add(p, big.NewInt(4))
+	if err := checkDHParams(4, notPrime); err != ErrBadDHPrime {
+		t.Errorf("non-prime: got %v, wanted %v", err, ErrBadDHPrime)
+	}
+	short := new(big.Int).Rsh(p, 1)
+	if err := checkDHParams(4, short); err != ErrBadDHPrime {
+		t.Errorf("2047-bit prime: got %v, wanted %v", err, ErrBadDHPrime)
+	}
+}
+
+func TestCheckDHValue(t *testing.T) {
+	p := mustParseHexInt(telegramDHPrime)
+	margin := new(big.Int).Lsh(big.NewInt(1), dhPrimeBits-64)
+
+	tests := []struct {
+		v  *big.Int
+		ok bool
+	}{
+		{big.NewInt(1), false},
+		{big.NewInt(2), false},
+		{new(big.Int).Sub(margin, big.NewInt(1)), false},
+		{margin, true},
+		{new(big.Int).Rsh(p, 1), true},
+		{new(big.Int).Sub(p, margin), true},
+		{new(big.Int).Sub(p, big.NewInt(2)), false},
+		{new(big.Int).Sub(p, big.NewInt(1)), false},
+		{p, false},
+	}
+	for i, tt := range tests {
+		err := checkDHValue(tt.v, p)
+		if (err == nil) != tt.ok {
+			t.Errorf("#%d: got %v, wanted ok=%v", i, err, tt.ok)
+		}
+	}
+}
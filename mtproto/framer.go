@@ -1,27 +1,82 @@
 package mtproto
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
+	"github.com/PROger4ever/telegramapi/binints"
 	"github.com/PROger4ever/telegramapi/tl"
 	"io"
 	"log"
+	"sort"
+	"time"
 )
 
 var ErrUnknownKeyID = errors.New("unknown auth key ID")
 
+// ProtocolVersion selects how encrypted messages are formatted.
+type ProtocolVersion int
+
+const (
+	// MTProto1 is the legacy scheme with SHA-1 based msg_key and key derivation.
+	MTProto1 ProtocolVersion = 1
+	// MTProto2 uses SHA-256 and 12 to 1024 bytes of random padding.
+	MTProto2 ProtocolVersion = 2
+
+	DefaultProtocolVersion = MTProto2
+)
+
+// MTProto 2.0 padding limits; a few random extra blocks of padding are added
+// on top of the minimum to hide the exact message length
+const (
+	minPaddingV2          = 12
+	maxPaddingV2          = 1024
+	maxExtraPaddingBlocks = 16
+)
+
 type FramerState struct {
 	SeqNo uint32
+
+	// salts to switch to as the current one expires, sorted by ValidSince
+	FutureSalts []FutureSalt
+}
+
+// FutureSalt is a server salt valid between two Unix times (in server time).
+type FutureSalt struct {
+	Salt       uint64
+	ValidSince int
+	ValidUntil int
 }
 
 type Framer struct {
 	MsgIDOverride uint64
 	RandomReader  io.Reader
 
+	// Version is the protocol version of encrypted messages; defaults to
+	// DefaultProtocolVersion.
+	Version ProtocolVersion
+
+	// Now returns the local time; defaults to time.Now
+	Now func() time.Time
+
+	// Server makes the framer format messages as the server and parse the
+	// ones of a client. A server framer replies in the session of the last
+	// message it has parsed, and does not adjust its clock to the peer.
+	Server bool
+
 	gen  MsgIDGen
 	auth *AuthResult
 
+	// the key replaced by RotateAuth, still accepted for incoming messages
+	prevAuth *AuthResult
+
+	// difference between the server clock and the local one
+	timeOffset time.Duration
+	timeSynced bool
+	seen       replayWindow
+
 	FramerState
 }
 
@@ -34,6 +89,13 @@ func (fr *Framer) Restore(state FramerState) {
 	fr.FramerState = state
 }
 
+func (fr *Framer) version() ProtocolVersion {
+	if fr.Version == 0 {
+		return DefaultProtocolVersion
+	}
+	return fr.Version
+}
+
 func (fr *Framer) SetAuth(auth *AuthResult) {
 	fr.auth = auth
 	if fr.RandomReader == nil {
@@ -41,14 +103,147 @@ func (fr *Framer) SetAuth(auth *AuthResult) {
 	}
 }
 
-func (fr *Framer) Format(msg Msg) ([]byte, uint64, error) {
-	var msgID uint64
+// RotateAuth switches to a new auth key, like a new temporary key, starting
+// a new session. Messages encrypted with the previous key are still accepted,
+// as replies to requests sent before the switch may arrive after it.
+func (fr *Framer) RotateAuth(auth *AuthResult) {
+	fr.prevAuth = fr.auth
+	fr.SeqNo = 0
+	fr.FutureSalts = nil
+	fr.SetAuth(auth)
+}
+
+// NextMsgID allocates a msg_id for an outgoing message. Server msg_ids are
+// 3 mod 4, as for messages that are not responses.
+func (fr *Framer) NextMsgID() uint64 {
 	if fr.MsgIDOverride != 0 {
-		msgID = fr.MsgIDOverride
+		msgID := fr.MsgIDOverride
 		fr.MsgIDOverride = 0
-	} else {
-		msgID = fr.gen.Generate()
+		return msgID
+	}
+	msgID := fr.gen.GenerateAt(fr.now().Add(fr.timeOffset))
+	if fr.Server {
+		msgID |= 3
+	}
+	return msgID
+}
+
+// nextMsgIDFor allocates the msg_id of an outgoing payload; server responses
+// get msg_ids that are 1 mod 4.
+func (fr *Framer) nextMsgIDFor(payload []byte) uint64 {
+	override := fr.MsgIDOverride != 0
+	msgID := fr.NextMsgID()
+	if fr.Server && !override && isServerResponse(tl.CmdOfPayload(payload)) {
+		msgID &^= 2
+	}
+	return msgID
+}
+
+// isServerResponse reports whether a server message answers a client one.
+func isServerResponse(cmd uint32) bool {
+	switch cmd {
+	case TagRPCResult, TagPong, TagFutureSalts, TagMsgsStateInfo, TagMsgsAllInfo,
+		TagResPQ, TagServerDHParamsOK, TagServerDHParamsFail, TagDHGenOK, TagDHGenRetry, TagDHGenFail:
+		return true
+	default:
+		return false
 	}
+}
+
+// ParseAuthKeyID returns the auth key ID of a raw message, 0 for unencrypted
+// ones, so that a server can pick the key to parse it with.
+func ParseAuthKeyID(raw []byte) (uint64, error) {
+	r := tl.NewReader(raw)
+	authKeyID := r.ReadUint64()
+	return authKeyID, r.Err()
+}
+
+// NextSeqNo allocates a seq_no for an outgoing message of the given type.
+func (fr *Framer) NextSeqNo(typ MsgType) uint32 {
+	if typ == ContentMsg {
+		seqNo := fr.SeqNo + 1
+		fr.SeqNo += 2
+		return seqNo
+	}
+	return fr.SeqNo
+}
+
+// AddFutureSalts merges salts into the cache of future salts.
+func (fr *Framer) AddFutureSalts(salts []FutureSalt) {
+	merged := make([]FutureSalt, 0, len(fr.FutureSalts)+len(salts))
+	seen := make(map[uint64]bool)
+	for _, list := range [][]FutureSalt{salts, fr.FutureSalts} {
+		for _, salt := range list {
+			if !seen[salt.Salt] {
+				seen[salt.Salt] = true
+				merged = append(merged, salt)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].ValidSince < merged[j].ValidSince
+	})
+	fr.FutureSalts = merged
+	fr.rotateSalt()
+}
+
+// ServerTime returns the current time according to the server clock, as far
+// as it is known.
+func (fr *Framer) ServerTime() time.Time {
+	return fr.now().Add(fr.timeOffset)
+}
+
+// SyncTime sets the clock offset from the msg_id of a message the server
+// has just sent, after it rejected ours for their msg_ids. Later msg_ids may
+// then be lower than the rejected ones.
+func (fr *Framer) SyncTime(serverMsgID uint64) {
+	fr.timeOffset = msgIDTime(serverMsgID).Sub(fr.now())
+	fr.timeSynced = true
+	fr.gen = MsgIDGen{}
+}
+
+// SaltsValidUntil returns the server time when the last cached salt expires,
+// or 0 if there are none.
+func (fr *Framer) SaltsValidUntil() int {
+	until := 0
+	for _, salt := range fr.FutureSalts {
+		if salt.ValidUntil > until {
+			until = salt.ValidUntil
+		}
+	}
+	return until
+}
+
+// rotateSalt drops expired salts from the cache and switches to the most
+// recent salt that is already valid.
+func (fr *Framer) rotateSalt() {
+	if fr.auth == nil || len(fr.FutureSalts) == 0 {
+		return
+	}
+	now := int(fr.ServerTime().Unix())
+
+	var current uint64
+	var found bool
+	var valid []FutureSalt
+	for _, salt := range fr.FutureSalts {
+		if salt.ValidUntil <= now {
+			continue
+		}
+		valid = append(valid, salt)
+		if salt.ValidSince <= now {
+			current, found = salt.Salt, true
+		}
+	}
+	if len(valid) != len(fr.FutureSalts) {
+		fr.FutureSalts = valid
+	}
+	if found {
+		binints.EncodeUint64LE(current, fr.auth.ServerSalt[:])
+	}
+}
+
+func (fr *Framer) Format(msg Msg) ([]byte, uint64, error) {
+	msgID := fr.nextMsgIDFor(msg.Payload)
 
 	w := tl.NewWriter()
 	if fr.auth == nil {
@@ -61,13 +256,8 @@ func (fr *Framer) Format(msg Msg) ([]byte, uint64, error) {
 		w.WriteInt(len(msg.Payload))
 		w.Write(msg.Payload)
 	} else {
-		var seqNo uint32
-		if msg.Type == ContentMsg {
-			seqNo = fr.SeqNo + 1
-			fr.SeqNo += 2
-		} else {
-			seqNo = fr.SeqNo
-		}
+		fr.rotateSalt()
+		seqNo := fr.NextSeqNo(msg.Type)
 
 		w.Write(fr.auth.ServerSalt[:])
 		w.Write(fr.auth.SessionID[:])
@@ -75,32 +265,53 @@ func (fr *Framer) Format(msg Msg) ([]byte, uint64, error) {
 		w.WriteUint32(seqNo)
 		w.WriteInt(len(msg.Payload))
 		w.Write(msg.Payload)
-		hash := sha1.Sum(w.Bytes())
 
 		var msgKey [16]byte
-		copy(msgKey[:], hash[4:20])
+		var key, iv [32]byte
+		if fr.version() == MTProto1 {
+			hash := sha1.Sum(w.Bytes())
+			copy(msgKey[:], hash[4:20])
+
+			pad := w.PaddingTo(16)
+			if pad > 0 {
+				var padding [16]byte
+				_, err := io.ReadFull(fr.RandomReader, padding[:pad])
+				if err != nil {
+					log.Printf("failed to read padding (%d): %v", pad, err)
+					return nil, 0, err
+				}
+				w.Write(padding[:pad])
+			}
+
+			deriveAESKey(fr.auth.Key, msgKey[:], key[:], iv[:], !fr.Server)
+		} else {
+			var extra [1]byte
+			_, err := io.ReadFull(fr.RandomReader, extra[:])
+			if err != nil {
+				return nil, 0, err
+			}
+			pad := minPaddingV2 + (16-(len(w.Bytes())+minPaddingV2)%16)%16
+			pad += int(extra[0]%maxExtraPaddingBlocks) * 16
 
-		pad := w.PaddingTo(16)
-		if pad > 0 {
-			var padding [16]byte
-			_, err := io.ReadFull(fr.RandomReader, padding[:pad])
+			padding := make([]byte, pad)
+			_, err = io.ReadFull(fr.RandomReader, padding)
 			if err != nil {
 				log.Printf("failed to read padding (%d): %v", pad, err)
 				return nil, 0, err
 			}
-			w.Write(padding[:pad])
+			w.Write(padding)
+
+			computeMsgKeyV2(fr.auth.Key, w.Bytes(), msgKey[:], !fr.Server)
+			deriveAESKeyV2(fr.auth.Key, msgKey[:], key[:], iv[:], !fr.Server)
 		}
 		data := w.Bytes()
 
-		var key, iv [32]byte
-		deriveAESKey(fr.auth.Key, msgKey[:], key[:], iv[:], true)
-
 		// log.Printf("AES key: %x", key)
 		// log.Printf("AES iv: %x", key)
 
 		encrypted, err := AESIGEPadEncrypt(nil, data, key[:], iv[:], nil)
 		if err != nil {
-			log.Printf("encryption failed: %v", pad, err)
+			log.Printf("encryption failed: %v", err)
 			return nil, 0, err
 		}
 
@@ -113,6 +324,19 @@ func (fr *Framer) Format(msg Msg) ([]byte, uint64, error) {
 	return w.Bytes(), msgID, nil
 }
 
+// FormatUnencrypted formats a message of the auth key exchange, which is
+// sent in plain text even while a key is in use.
+func (fr *Framer) FormatUnencrypted(msg Msg) ([]byte, uint64, error) {
+	msgID := fr.nextMsgIDFor(msg.Payload)
+
+	w := tl.NewWriter()
+	w.WriteUint64(0)
+	w.WriteUint64(msgID)
+	w.WriteInt(len(msg.Payload))
+	w.Write(msg.Payload)
+	return w.Bytes(), msgID, nil
+}
+
 func (fr *Framer) Parse(raw []byte) (Msg, error) {
 	var r tl.Reader
 	r.Reset(raw)
@@ -130,7 +354,10 @@ func (fr *Framer) Parse(raw []byte) (Msg, error) {
 
 		return Msg{payload, KeyExMsg, msgID}, r.Err()
 	} else {
-		if authKeyID != fr.auth.KeyID {
+		auth := fr.auth
+		if fr.prevAuth != nil && authKeyID == fr.prevAuth.KeyID {
+			auth = fr.prevAuth
+		} else if auth == nil || authKeyID != auth.KeyID {
 			return Msg{}, ErrUnknownKeyID
 		}
 
@@ -143,8 +370,15 @@ func (fr *Framer) Parse(raw []byte) (Msg, error) {
 
 		// log.Printf("Received encrypted: authKeyID=%x data=(%d) %x", authKeyID, len(enc), enc)
 
+		// incoming messages are from the client when we are the server
+		fromClient := fr.Server
+		v1 := fr.version() == MTProto1
 		var key, iv [32]byte
-		deriveAESKey(fr.auth.Key, msgKey[:], key[:], iv[:], false)
+		if v1 {
+			deriveAESKey(auth.Key, msgKey[:], key[:], iv[:], fromClient)
+		} else {
+			deriveAESKeyV2(auth.Key, msgKey[:], key[:], iv[:], fromClient)
+		}
 		// log.Printf("AES key: %x", key)
 		// log.Printf("AES iv: %x", key)
 
@@ -161,6 +395,40 @@ func (fr *Framer) Parse(raw []byte) (Msg, error) {
 		msgID := r.ReadUint64()
 		seqNo := r.ReadInt()
 		msgLen := r.ReadInt()
+		if err := r.Err(); err != nil {
+			return Msg{}, r.Err()
+		}
+
+		const headerLen = 32
+		if msgLen < 0 || msgLen > len(decrypted)-headerLen {
+			return Msg{}, &SecurityError{msgID, ErrInvalidLength}
+		}
+		pad := len(decrypted) - headerLen - msgLen
+		var expectedKey [16]byte
+		if v1 {
+			if pad >= 16 {
+				return Msg{}, &SecurityError{msgID, ErrInvalidLength}
+			}
+			hash := sha1.Sum(decrypted[:headerLen+msgLen])
+			copy(expectedKey[:], hash[4:20])
+		} else {
+			if pad < minPaddingV2 || pad > maxPaddingV2 {
+				return Msg{}, &SecurityError{msgID, ErrInvalidLength}
+			}
+			computeMsgKeyV2(auth.Key, decrypted, expectedKey[:], fromClient)
+		}
+		if !bytes.Equal(expectedKey[:], msgKey[:]) {
+			return Msg{}, &SecurityError{msgID, ErrMsgKeyMismatch}
+		}
+		if fr.Server {
+			auth.SessionID = sessid
+		} else if sessid != auth.SessionID {
+			return Msg{}, &SecurityError{msgID, ErrSessionIDMismatch}
+		}
+		if err := fr.checkMsgID(msgID); err != nil {
+			return Msg{}, &SecurityError{msgID, err}
+		}
+
 		payload := r.ReadN(msgLen)
 		if err := r.Err(); err != nil {
 			return Msg{}, r.Err()
@@ -227,3 +495,55 @@ func deriveAESKey(authKey, msgKey []byte, key, iv []byte, isClient bool) {
 	copy(iv[20:24], c[16:16+4])
 	copy(iv[24:32], d[0:8])
 }
+
+// computeMsgKeyV2 computes the MTProto 2.0 msg_key of a padded plaintext.
+func computeMsgKeyV2(authKey, plaintext []byte, msgKey []byte, isClient bool) {
+	x := 0
+	if !isClient {
+		x = 8
+	}
+
+	// msg_key_large = SHA256(substr(auth_key, 88+x, 32) + plaintext + random_padding)
+	h := sha256.New()
+	h.Write(authKey[88+x : 88+x+32])
+	h.Write(plaintext)
+	large := h.Sum(nil)
+
+	// msg_key = substr(msg_key_large, 8, 16)
+	copy(msgKey, large[8:24])
+}
+
+func deriveAESKeyV2(authKey, msgKey []byte, key, iv []byte, isClient bool) {
+	if len(authKey) != 256 {
+		panic("invalid auth key len")
+	}
+	if len(msgKey) != 16 {
+		panic("invalid msg key len")
+	}
+
+	x := 0
+	if !isClient {
+		x = 8
+	}
+	var src [52]byte
+
+	// sha256_a = SHA256(msg_key + substr(auth_key, x, 36))
+	copy(src[0:16], msgKey)
+	copy(src[16:52], authKey[x:x+36])
+	a := sha256.Sum256(src[:])
+
+	// sha256_b = SHA256(substr(auth_key, 40+x, 36) + msg_key)
+	copy(src[0:36], authKey[40+x:40+x+36])
+	copy(src[36:52], msgKey)
+	b := sha256.Sum256(src[:])
+
+	// aes_key = substr(sha256_a, 0, 8) + substr(sha256_b, 8, 16) + substr(sha256_a, 24, 8)
+	copy(key[0:8], a[0:8])
+	copy(key[8:24], b[8:24])
+	copy(key[24:32], a[24:32])
+
+	// aes_iv = substr(sha256_b, 0, 8) + substr(sha256_a, 8, 16) + substr(sha256_b, 24, 8)
+	copy(iv[0:8], b[0:8])
+	copy(iv[8:24], a[8:24])
+	copy(iv[24:32], b[24:32])
+}
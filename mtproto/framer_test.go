@@ -0,0 +1,328 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// formatServerMsg encrypts a message the way the server would.
+func formatServerMsg(auth *AuthResult, msgID uint64, seqNo uint32, payload []byte) []byte {
+	return formatServerMsgVersion(MTProto2, auth, msgID, seqNo, payload)
+}
+
+func formatServerMsgVersion(version ProtocolVersion, auth *AuthResult, msgID uint64, seqNo uint32, payload []byte) []byte {
+	w := tl.NewWriter()
+	w.Write(auth.ServerSalt[:])
+	w.Write(auth.SessionID[:])
+	w.WriteUint64(msgID)
+	w.WriteUint32(seqNo)
+	w.WriteInt(len(payload))
+	w.Write(payload)
+
+	msgKey := make([]byte, 16)
+	var key, iv [32]byte
+	if version == MTProto1 {
+		hash := sha1.Sum(w.Bytes())
+		copy(msgKey, hash[4:20])
+		if pad := w.PaddingTo(16); pad > 0 {
+			w.Write(make([]byte, pad))
+		}
+		deriveAESKey(auth.Key, msgKey, key[:], iv[:], false)
+	} else {
+		w.Write(make([]byte, minPaddingV2+(16-(len(w.Bytes())+minPaddingV2)%16)%16))
+		computeMsgKeyV2(auth.Key, w.Bytes(), msgKey, false)
+		deriveAESKeyV2(auth.Key, msgKey, key[:], iv[:], false)
+	}
+	encrypted, err := AESIGEPadEncrypt(nil, w.Bytes(), key[:], iv[:], nil)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Clear()
+	w.WriteUint64(auth.KeyID)
+	w.Write(msgKey)
+	w.Write(encrypted)
+	return w.Bytes()
+}
+
+func serverMsgID(t time.Time) uint64 {
+	var g MsgIDGen
+	return g.GenerateAt(t) | 1
+}
+
+func newTestFramer(now time.Time) *Framer {
+	return newTestFramerVersion(DefaultProtocolVersion, now)
+}
+
+func newTestFramerVersion(version ProtocolVersion, now time.Time) *Framer {
+	fr := &Framer{
+		Version: version,
+		Now:     func() time.Time { return now },
+	}
+	auth := newTestAuth()
+	auth.SessionID = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fr.SetAuth(auth)
+	return fr
+}
+
+func TestFramerParseValidation(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	payload := tl.Bytes(&TLPong{MsgID: 1, PingID: 2})
+
+	fr := newTestFramer(now)
+	auth, _ := fr.State()
+	msgID := serverMsgID(now)
+	msg, err := fr.Parse(formatServerMsg(auth, msgID, 1, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgID != msgID || msg.Type != ContentMsg {
+		t.Errorf("parsed msgID %08x, type %v, expected %08x, Content", msg.MsgID, msg.Type, msgID)
+	}
+
+	tampered := formatServerMsg(auth, serverMsgID(now.Add(time.Second)), 1, payload)
+	tampered[len(tampered)-1] ^= 1
+	otherSession := *auth
+	otherSession.SessionID[0] ^= 1
+
+	tests := []struct {
+		name   string
+		raw    []byte
+		reason error
+	}{
+		{"replay", formatServerMsg(auth, msgID, 1, payload), ErrMsgIDReplay},
+		{"msg_key", tampered, ErrMsgKeyMismatch},
+		{"session", formatServerMsg(&otherSession, serverMsgID(now.Add(2*time.Second)), 1, payload), ErrSessionIDMismatch},
+		{"parity", formatServerMsg(auth, serverMsgID(now.Add(3*time.Second))&^3, 1, payload), ErrMsgIDParity},
+		{"old", formatServerMsg(auth, serverMsgID(now.Add(-10*time.Minute)), 1, payload), ErrMsgIDTooOld},
+		{"future", formatServerMsg(auth, serverMsgID(now.Add(time.Minute)), 1, payload), ErrMsgIDTooNew},
+	}
+	for _, tt := range tests {
+		_, err := fr.Parse(tt.raw)
+		var secErr *SecurityError
+		if !errors.As(err, &secErr) || !errors.Is(err, tt.reason) {
+			t.Errorf("%s: Parse returned %v, expected %v", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestFramerSyncsServerTime(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	fr := newTestFramer(now)
+	auth, _ := fr.State()
+	payload := tl.Bytes(&TLPong{MsgID: 1, PingID: 2})
+
+	// the local clock is an hour behind
+	server := now.Add(time.Hour)
+	if _, err := fr.Parse(formatServerMsg(auth, serverMsgID(server), 1, payload)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fr.Parse(formatServerMsg(auth, serverMsgID(server.Add(time.Second)), 1, payload)); err != nil {
+		t.Errorf("Parse after time sync failed: %v", err)
+	}
+
+	if d := msgIDTime(fr.NextMsgID()).Sub(server); d < -time.Second || d > time.Second {
+		t.Errorf("outgoing msg_id is %v off the server time", d)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for i := 1; i <= replayWindowSize+10; i++ {
+		if err := w.check(uint64(i * 4)); err != nil {
+			t.Fatalf("check(%d) failed: %v", i*4, err)
+		}
+		w.add(uint64(i * 4))
+	}
+	if err := w.check(8); err != ErrMsgIDReplay {
+		t.Errorf("msg_id below the window accepted")
+	}
+	if err := w.check(uint64((replayWindowSize + 5) * 4)); err != ErrMsgIDReplay {
+		t.Errorf("duplicate msg_id accepted")
+	}
+	if err := w.check(uint64((replayWindowSize+5)*4 + 1)); err != nil {
+		t.Errorf("new msg_id inside the window rejected: %v", err)
+	}
+}
+
+// generated independently from the MTProto 2.0 spec for the auth key 00 01 02 .. ff
+const (
+	clientMsgV2 = "88776655443322114929fcf71b5625b23d99431701f489b043c214c354acbf0d6345a614e6a138e52171a6ef72506c87e41adaa69d9a167b82a497c53529f4d1c5ce477f9dedaddbff72c87cc45355084270f85c26f594c6a528c6e80e6ef218a5b379f86a82e2d55fc5bf84eb75b8b5fb262b30becf72f22873fdd67174720c1729afe87b73b914"
+	serverMsgV2 = "88776655443322111eb278cc8d1bb6e6f6e77060f810b4b2b21e9111bb0702266d70a1db8ba728aa0148b9feb4183213abfaa807e582198d010aacfcb7702edcbb7799c130327faad66fe7fa41de6c154dc3f096df1a530c"
+)
+
+func TestFramerV2KnownAnswer(t *testing.T) {
+	random := make([]byte, 200)
+	for i := range random {
+		random[i] = byte(i*7 + 3)
+	}
+
+	fr := newTestFramer(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	fr.RandomReader = bytes.NewReader(random)
+	fr.MsgIDOverride = 0x5868468003291400
+
+	ping := tl.Bytes(&TLPing{PingID: 0x0102030405060708})
+	raw, _, err := fr.Format(Msg{ping, ContentMsg, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := hex.EncodeToString(raw); a != clientMsgV2 {
+		t.Errorf("formatted %s, expected %s", a, clientMsgV2)
+	}
+
+	msg, err := fr.Parse(fromHex(serverMsgV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := Schema.ReadBoxedObject(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pong, ok := o.(*TLPong)
+	if !ok || pong.MsgID != 0x5868468003291400 || pong.PingID != 0x0102030405060708 {
+		t.Errorf("parsed %v, expected pong", o)
+	}
+	if msg.MsgID != 0x5868468412345601 || msg.Type != ContentMsg {
+		t.Errorf("parsed msgID %08x, type %v", msg.MsgID, msg.Type)
+	}
+}
+
+func TestFramerV1(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	fr := newTestFramerVersion(MTProto1, now)
+	auth, _ := fr.State()
+	payload := tl.Bytes(&TLPong{MsgID: 1, PingID: 2})
+
+	if _, err := fr.Parse(formatServerMsgVersion(MTProto1, auth, serverMsgID(now), 1, payload)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fr.Parse(formatServerMsgVersion(MTProto2, auth, serverMsgID(now.Add(time.Second)), 1, payload))
+	if !errors.Is(err, ErrMsgKeyMismatch) && !errors.Is(err, ErrInvalidLength) {
+		t.Errorf("MTProto 2.0 message parsed by a 1.0 framer: %v", err)
+	}
+}
+
+func TestFramerRotatesSalts(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	fr := newTestFramer(now)
+	unix := int(now.Unix())
+	fr.AddFutureSalts([]FutureSalt{
+		{Salt: 2, ValidSince: unix + 1800, ValidUntil: unix + 5400},
+		{Salt: 1, ValidSince: unix - 1800, ValidUntil: unix + 1900},
+	})
+
+	salt := func(at time.Time) uint64 {
+		fr.Now = func() time.Time { return at }
+		if _, _, err := fr.Format(Msg{tl.Bytes(&TLPing{}), ContentMsg, 0}); err != nil {
+			t.Fatal(err)
+		}
+		auth, _ := fr.State()
+		return binints.DecodeUint64LE(auth.ServerSalt[:])
+	}
+
+	if s := salt(now); s != 1 {
+		t.Errorf("salt is %d, expected 1", s)
+	}
+	// switches to the new salt before the old one expires
+	if s := salt(now.Add(1850 * time.Second)); s != 2 {
+		t.Errorf("salt is %d, expected 2", s)
+	}
+	salt(now.Add(2000 * time.Second))
+	if len(fr.FutureSalts) != 1 {
+		t.Errorf("%d salts cached, expected the expired one to be dropped", len(fr.FutureSalts))
+	}
+	if u := fr.SaltsValidUntil(); u != unix+5400 {
+		t.Errorf("SaltsValidUntil == %d, expected %d", u, unix+5400)
+	}
+}
+
+func TestFramerRotateAuth(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	fr := newTestFramer(now)
+	old, _ := fr.State()
+	fr.SeqNo = 10
+
+	temp := newTestAuth()
+	temp.KeyID = 0x99
+	temp.Key[0] = 0xFF
+	temp.SessionID = [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	fr.RotateAuth(temp)
+	if fr.SeqNo != 0 {
+		t.Errorf("seqno %d kept for the new session", fr.SeqNo)
+	}
+
+	payload := tl.Bytes(&TLPong{MsgID: 1, PingID: 2})
+	if _, err := fr.Parse(formatServerMsg(temp, serverMsgID(now), 1, payload)); err != nil {
+		t.Errorf("message encrypted with the new key: %v", err)
+	}
+	if _, err := fr.Parse(formatServerMsg(old, serverMsgID(now.Add(time.Second)), 3, payload)); err != nil {
+		t.Errorf("message encrypted with the previous key: %v", err)
+	}
+
+	other := newTestAuth()
+	other.KeyID = 0x77
+	if _, err := fr.Parse(formatServerMsg(other, serverMsgID(now.Add(2*time.Second)), 1, payload)); err != ErrUnknownKeyID {
+		t.Errorf("message encrypted with an unknown key: %v", err)
+	}
+}
+
+func TestServerFramer(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := newTestFramer(now)
+	clientAuth, _ := client.State()
+	serverAuth := *clientAuth
+	serverAuth.SessionID = [8]byte{}
+	server := &Framer{Server: true, Now: func() time.Time { return now }}
+	server.SetAuth(&serverAuth)
+
+	raw, pingMsgID, err := client.Format(Msg{tl.Bytes(&TLPing{PingID: 2}), ContentMsg, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := server.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgID != pingMsgID {
+		t.Errorf("server parsed msg_id %x, expected %x", msg.MsgID, pingMsgID)
+	}
+	if serverAuth.SessionID != clientAuth.SessionID {
+		t.Errorf("server did not adopt the session of the client")
+	}
+
+	tests := []struct {
+		o      tl.Object
+		parity uint64
+	}{
+		{&TLPong{MsgID: pingMsgID, PingID: 2}, 1},
+		{&TLNewSessionCreated{FirstMsgID: pingMsgID}, 3},
+	}
+	for _, test := range tests {
+		raw, msgID, err := server.Format(Msg{tl.Bytes(test.o), ContentMsg, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgID&3 != test.parity {
+			t.Errorf("%T sent with msg_id %x, expected %d mod 4", test.o, msgID, test.parity)
+		}
+		if _, err := client.Parse(raw); err != nil {
+			t.Errorf("client failed to parse %T: %v", test.o, err)
+		}
+	}
+
+	client.MsgIDOverride = serverMsgID(now.Add(time.Second))
+	raw, _, err = client.Format(Msg{tl.Bytes(&TLPing{PingID: 3}), ContentMsg, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Parse(raw); !errors.Is(err, ErrClientMsgIDParity) {
+		t.Errorf("odd client msg_id: %v", err)
+	}
+}
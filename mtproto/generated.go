@@ -12,10 +12,12 @@ import (
 const (
 	TagResPQ                   uint32 = 0x05162463
 	TagPQInnerData                    = 0x83c95aec
+	TagPQInnerDataTemp                = 0x3c6a84d4
 	TagServerDHParamsFail             = 0x79cb045d
 	TagServerDHParamsOK               = 0xd0e8075c
 	TagServerDHInnerData              = 0xb5890dba
 	TagClientDHInnerData              = 0x6643b654
+	TagBindAuthKeyInner               = 0x75a3f765
 	TagDHGenOK                        = 0x3bcbf734
 	TagDHGenRetry                     = 0x46dc1fb9
 	TagDHGenFail                      = 0xa69dae02
@@ -458,6 +460,8 @@ const (
 	TagChannelsChannelParticipants                   = 0xf56ee2a8
 	TagChannelsChannelParticipant                    = 0xd0d9b163
 	TagHelpTermsOfService                            = 0xf1ee3e90
+	TagCdnPublicKey                                  = 0xc982eaba
+	TagCdnConfig                                     = 0x5725e40a
 	TagFoundGif                                      = 0x162ecc1f
 	TagFoundGifCached                                = 0x9c750409
 	TagMessagesFoundGifs                             = 0x450a1c0a
@@ -761,6 +765,7 @@ const (
 	TagHelpGetAppChangelog                           = 0x9010ef6f
 	TagHelpGetTermsOfService                         = 0x350170f3
 	TagHelpSetBotUpdatesStatus                       = 0xec22cfcd
+	TagHelpGetCdnConfig                              = 0x52029342
 	TagChannelsReadHistory                           = 0xcc104937
 	TagChannelsDeleteMessages                        = 0x84c1fd4e
 	TagChannelsDeleteUserHistory                     = 0xd10dd71b
@@ -831,10 +836,12 @@ const (
 var combOrigins = map[uint32]SchemaOrigin{
 	TagResPQ:                                  SchemaOriginMTProto,
 	TagPQInnerData:                            SchemaOriginMTProto,
+	TagPQInnerDataTemp:                        SchemaOriginMTProto,
 	TagServerDHParamsFail:                     SchemaOriginMTProto,
 	TagServerDHParamsOK:                       SchemaOriginMTProto,
 	TagServerDHInnerData:                      SchemaOriginMTProto,
 	TagClientDHInnerData:                      SchemaOriginMTProto,
+	TagBindAuthKeyInner:                       SchemaOriginMTProto,
 	TagDHGenOK:                                SchemaOriginMTProto,
 	TagDHGenRetry:                             SchemaOriginMTProto,
 	TagDHGenFail:                              SchemaOriginMTProto,
@@ -1273,6 +1280,8 @@ var combOrigins = map[uint32]SchemaOrigin{
 	TagChannelsChannelParticipants:            SchemaOriginTelegram,
 	TagChannelsChannelParticipant:             SchemaOriginTelegram,
 	TagHelpTermsOfService:                     SchemaOriginTelegram,
+	TagCdnPublicKey:                           SchemaOriginTelegram,
+	TagCdnConfig:                              SchemaOriginTelegram,
 	TagFoundGif:                               SchemaOriginTelegram,
 	TagFoundGifCached:                         SchemaOriginTelegram,
 	TagMessagesFoundGifs:                      SchemaOriginTelegram,
@@ -1576,6 +1585,7 @@ var combOrigins = map[uint32]SchemaOrigin{
 	TagHelpGetAppChangelog:              SchemaOriginTelegram,
 	TagHelpGetTermsOfService:            SchemaOriginTelegram,
 	TagHelpSetBotUpdatesStatus:          SchemaOriginTelegram,
+	TagHelpGetCdnConfig:                 SchemaOriginTelegram,
 	TagChannelsReadHistory:              SchemaOriginTelegram,
 	TagChannelsDeleteMessages:           SchemaOriginTelegram,
 	TagChannelsDeleteUserHistory:        SchemaOriginTelegram,
@@ -1671,40 +1681,12 @@ func (o *TLResPQ) String() string {
 	return tl.Pretty(o)
 }
 
-// TLPQInnerData represents ctor p_q_inner_data#83c95aec pq:bytes p:bytes q:bytes nonce:int128 server_nonce:int128 new_nonce:int256 = P_Q_inner_data from MTProto
-type TLPQInnerData struct {
-	PQ          *big.Int // pq:bytes
-	P           *big.Int // p:bytes
-	Q           *big.Int // q:bytes
-	Nonce       [16]byte // nonce:int128
-	ServerNonce [16]byte // server_nonce:int128
-	NewNonce    [32]byte // new_nonce:int256
-}
-
-func (o *TLPQInnerData) Cmd() uint32 {
-	return TagPQInnerData
-}
-
-func (o *TLPQInnerData) ReadBareFrom(r *tl.Reader) {
-	o.PQ = r.ReadBigInt()
-	o.P = r.ReadBigInt()
-	o.Q = r.ReadBigInt()
-	r.ReadUint128(o.Nonce[:])
-	r.ReadUint128(o.ServerNonce[:])
-	r.ReadFull(o.NewNonce[:])
-}
-
-func (o *TLPQInnerData) WriteBareTo(w *tl.Writer) {
-	w.WriteBigInt(o.PQ)
-	w.WriteBigInt(o.P)
-	w.WriteBigInt(o.Q)
-	w.WriteUint128(o.Nonce[:])
-	w.WriteUint128(o.ServerNonce[:])
-	w.Write(o.NewNonce[:])
-}
-
-func (o *TLPQInnerData) String() string {
-	return tl.Pretty(o)
+// TLPQInnerDataType represents P_Q_inner_data from MTProto
+type TLPQInnerDataType interface {
+	IsTLPQInnerData()
+	Cmd() uint32
+	ReadBareFrom(r *tl.Reader)
+	WriteBareTo(w *tl.Writer)
 }
 
 // TLServerDHParamsType represents Server_DH_Params from MTProto
@@ -1781,6 +1763,39 @@ func (o *TLClientDHInnerData) String() string {
 	return tl.Pretty(o)
 }
 
+// TLBindAuthKeyInner represents ctor bind_auth_key_inner#75a3f765 nonce:long temp_auth_key_id:long perm_auth_key_id:long temp_session_id:long expires_at:int = BindAuthKeyInner from MTProto
+type TLBindAuthKeyInner struct {
+	Nonce         uint64 // nonce:long
+	TempAuthKeyID uint64 // temp_auth_key_id:long
+	PermAuthKeyID uint64 // perm_auth_key_id:long
+	TempSessionID uint64 // temp_session_id:long
+	ExpiresAt     int    // expires_at:int
+}
+
+func (o *TLBindAuthKeyInner) Cmd() uint32 {
+	return TagBindAuthKeyInner
+}
+
+func (o *TLBindAuthKeyInner) ReadBareFrom(r *tl.Reader) {
+	o.Nonce = r.ReadUint64()
+	o.TempAuthKeyID = r.ReadUint64()
+	o.PermAuthKeyID = r.ReadUint64()
+	o.TempSessionID = r.ReadUint64()
+	o.ExpiresAt = r.ReadInt()
+}
+
+func (o *TLBindAuthKeyInner) WriteBareTo(w *tl.Writer) {
+	w.WriteUint64(o.Nonce)
+	w.WriteUint64(o.TempAuthKeyID)
+	w.WriteUint64(o.PermAuthKeyID)
+	w.WriteUint64(o.TempSessionID)
+	w.WriteInt(o.ExpiresAt)
+}
+
+func (o *TLBindAuthKeyInner) String() string {
+	return tl.Pretty(o)
+}
+
 // TLSetClientDHParamsAnswerType represents Set_client_DH_params_answer from MTProto
 type TLSetClientDHParamsAnswerType interface {
 	IsTLSetClientDHParamsAnswer()
@@ -3501,7 +3516,7 @@ func (o *TLUploadFile) String() string {
 	return tl.Pretty(o)
 }
 
-// TLDCOption represents ctor dcOption#05d8c6cc flags:# flags.0?ipv6:true flags.1?media_only:true flags.2?tcpo_only:true id:int ip_address:string port:int = DcOption from Telegram
+// TLDCOption represents ctor dcOption#05d8c6cc flags:# flags.0?ipv6:true flags.1?media_only:true flags.2?tcpo_only:true flags.3?cdn:true flags.4?static:true id:int ip_address:string port:int = DcOption from Telegram
 type TLDCOption struct {
 	Flags     uint   // flags:#
 	ID        int    // id:int
@@ -3563,6 +3578,30 @@ func (o *TLDCOption) SetTCPoOnly(v bool) {
 	}
 }
 
+func (o *TLDCOption) Cdn() bool {
+	return (o.Flags & (1 << 3)) != 0
+}
+
+func (o *TLDCOption) SetCdn(v bool) {
+	if v {
+		o.Flags |= (1 << 3)
+	} else {
+		o.Flags &= ^uint(1 << 3)
+	}
+}
+
+func (o *TLDCOption) Static() bool {
+	return (o.Flags & (1 << 4)) != 0
+}
+
+func (o *TLDCOption) SetStatic(v bool) {
+	if v {
+		o.Flags |= (1 << 4)
+	} else {
+		o.Flags &= ^uint(1 << 4)
+	}
+}
+
 func (o *TLDCOption) String() string {
 	return tl.Pretty(o)
 }
@@ -4987,6 +5026,66 @@ func (o *TLHelpTermsOfService) String() string {
 	return tl.Pretty(o)
 }
 
+// TLCdnPublicKey represents ctor cdnPublicKey#c982eaba dc_id:int public_key:string = CdnPublicKey from Telegram
+type TLCdnPublicKey struct {
+	DCID      int    // dc_id:int
+	PublicKey string // public_key:string
+}
+
+func (o *TLCdnPublicKey) Cmd() uint32 {
+	return TagCdnPublicKey
+}
+
+func (o *TLCdnPublicKey) ReadBareFrom(r *tl.Reader) {
+	o.DCID = r.ReadInt()
+	o.PublicKey = r.ReadString()
+}
+
+func (o *TLCdnPublicKey) WriteBareTo(w *tl.Writer) {
+	w.WriteInt(o.DCID)
+	w.WriteString(o.PublicKey)
+}
+
+func (o *TLCdnPublicKey) String() string {
+	return tl.Pretty(o)
+}
+
+// TLCdnConfig represents ctor cdnConfig#5725e40a public_keys:Vector<CdnPublicKey> = CdnConfig from Telegram
+type TLCdnConfig struct {
+	PublicKeys []*TLCdnPublicKey // public_keys:Vector<CdnPublicKey>
+}
+
+func (o *TLCdnConfig) Cmd() uint32 {
+	return TagCdnConfig
+}
+
+func (o *TLCdnConfig) ReadBareFrom(r *tl.Reader) {
+	if cmd := r.ReadCmd(); cmd != TagVector {
+		r.Fail(errors.New("expected: vector"))
+	}
+	o.PublicKeys = make([]*TLCdnPublicKey, r.ReadInt())
+	for i := 0; i < len(o.PublicKeys); i++ {
+		if cmd := r.ReadCmd(); cmd != TagCdnPublicKey {
+			r.Fail(errors.New("expected: cdnPublicKey"))
+		}
+		o.PublicKeys[i] = new(TLCdnPublicKey)
+		o.PublicKeys[i].ReadBareFrom(r)
+	}
+}
+
+func (o *TLCdnConfig) WriteBareTo(w *tl.Writer) {
+	w.WriteCmd(TagVector)
+	w.WriteInt(len(o.PublicKeys))
+	for i := 0; i < len(o.PublicKeys); i++ {
+		w.WriteCmd(TagCdnPublicKey)
+		o.PublicKeys[i].WriteBareTo(w)
+	}
+}
+
+func (o *TLCdnConfig) String() string {
+	return tl.Pretty(o)
+}
+
 // TLFoundGifType represents FoundGif from Telegram
 type TLFoundGifType interface {
 	IsTLFoundGif()
@@ -12950,6 +13049,24 @@ func (o *TLHelpSetBotUpdatesStatus) String() string {
 	return tl.Pretty(o)
 }
 
+// TLHelpGetCdnConfig represents func help.getCdnConfig#52029342 = CdnConfig from Telegram
+type TLHelpGetCdnConfig struct {
+}
+
+func (o *TLHelpGetCdnConfig) Cmd() uint32 {
+	return TagHelpGetCdnConfig
+}
+
+func (o *TLHelpGetCdnConfig) ReadBareFrom(r *tl.Reader) {
+}
+
+func (o *TLHelpGetCdnConfig) WriteBareTo(w *tl.Writer) {
+}
+
+func (o *TLHelpGetCdnConfig) String() string {
+	return tl.Pretty(o)
+}
+
 // TLChannelsReadHistory represents func channels.readHistory#cc104937 channel:InputChannel max_id:int = Bool from Telegram
 type TLChannelsReadHistory struct {
 	Channel TLInputChannelType // channel:InputChannel
@@ -14262,6 +14379,85 @@ func (o *TLPhoneSaveCallDebug) String() string {
 	return tl.Pretty(o)
 }
 
+// TLPQInnerData represents ctor p_q_inner_data#83c95aec pq:bytes p:bytes q:bytes nonce:int128 server_nonce:int128 new_nonce:int256 = P_Q_inner_data from MTProto
+type TLPQInnerData struct {
+	PQ          *big.Int // pq:bytes
+	P           *big.Int // p:bytes
+	Q           *big.Int // q:bytes
+	Nonce       [16]byte // nonce:int128
+	ServerNonce [16]byte // server_nonce:int128
+	NewNonce    [32]byte // new_nonce:int256
+}
+
+func (o *TLPQInnerData) IsTLPQInnerData() {}
+
+func (o *TLPQInnerData) Cmd() uint32 {
+	return TagPQInnerData
+}
+
+func (o *TLPQInnerData) ReadBareFrom(r *tl.Reader) {
+	o.PQ = r.ReadBigInt()
+	o.P = r.ReadBigInt()
+	o.Q = r.ReadBigInt()
+	r.ReadUint128(o.Nonce[:])
+	r.ReadUint128(o.ServerNonce[:])
+	r.ReadFull(o.NewNonce[:])
+}
+
+func (o *TLPQInnerData) WriteBareTo(w *tl.Writer) {
+	w.WriteBigInt(o.PQ)
+	w.WriteBigInt(o.P)
+	w.WriteBigInt(o.Q)
+	w.WriteUint128(o.Nonce[:])
+	w.WriteUint128(o.ServerNonce[:])
+	w.Write(o.NewNonce[:])
+}
+
+func (o *TLPQInnerData) String() string {
+	return tl.Pretty(o)
+}
+
+// TLPQInnerDataTemp represents ctor p_q_inner_data_temp#3c6a84d4 pq:bytes p:bytes q:bytes nonce:int128 server_nonce:int128 new_nonce:int256 expires_in:int = P_Q_inner_data from MTProto
+type TLPQInnerDataTemp struct {
+	PQ          *big.Int // pq:bytes
+	P           *big.Int // p:bytes
+	Q           *big.Int // q:bytes
+	Nonce       [16]byte // nonce:int128
+	ServerNonce [16]byte // server_nonce:int128
+	NewNonce    [32]byte // new_nonce:int256
+	ExpiresIn   int      // expires_in:int
+}
+
+func (o *TLPQInnerDataTemp) IsTLPQInnerData() {}
+
+func (o *TLPQInnerDataTemp) Cmd() uint32 {
+	return TagPQInnerDataTemp
+}
+
+func (o *TLPQInnerDataTemp) ReadBareFrom(r *tl.Reader) {
+	o.PQ = r.ReadBigInt()
+	o.P = r.ReadBigInt()
+	o.Q = r.ReadBigInt()
+	r.ReadUint128(o.Nonce[:])
+	r.ReadUint128(o.ServerNonce[:])
+	r.ReadFull(o.NewNonce[:])
+	o.ExpiresIn = r.ReadInt()
+}
+
+func (o *TLPQInnerDataTemp) WriteBareTo(w *tl.Writer) {
+	w.WriteBigInt(o.PQ)
+	w.WriteBigInt(o.P)
+	w.WriteBigInt(o.Q)
+	w.WriteUint128(o.Nonce[:])
+	w.WriteUint128(o.ServerNonce[:])
+	w.Write(o.NewNonce[:])
+	w.WriteInt(o.ExpiresIn)
+}
+
+func (o *TLPQInnerDataTemp) String() string {
+	return tl.Pretty(o)
+}
+
 // TLServerDHParamsFail represents ctor server_DH_params_fail#79cb045d nonce:int128 server_nonce:int128 new_nonce_hash:int128 = Server_DH_Params from MTProto
 type TLServerDHParamsFail struct {
 	Nonce        [16]byte // nonce:int128
@@ -31249,12 +31445,12 @@ var Schema = &tl.Schema{
 		switch cmd {
 		case TagResPQ:
 			return new(TLResPQ)
-		case TagPQInnerData:
-			return new(TLPQInnerData)
 		case TagServerDHInnerData:
 			return new(TLServerDHInnerData)
 		case TagClientDHInnerData:
 			return new(TLClientDHInnerData)
+		case TagBindAuthKeyInner:
+			return new(TLBindAuthKeyInner)
 		case TagRPCResult:
 			return new(TLRPCResult)
 		case TagRPCError:
@@ -31385,6 +31581,10 @@ var Schema = &tl.Schema{
 			return new(TLChannelsChannelParticipant)
 		case TagHelpTermsOfService:
 			return new(TLHelpTermsOfService)
+		case TagCdnPublicKey:
+			return new(TLCdnPublicKey)
+		case TagCdnConfig:
+			return new(TLCdnConfig)
 		case TagMessagesFoundGifs:
 			return new(TLMessagesFoundGifs)
 		case TagMessagesBotResults:
@@ -31817,6 +32017,8 @@ var Schema = &tl.Schema{
 			return new(TLHelpGetTermsOfService)
 		case TagHelpSetBotUpdatesStatus:
 			return new(TLHelpSetBotUpdatesStatus)
+		case TagHelpGetCdnConfig:
+			return new(TLHelpGetCdnConfig)
 		case TagChannelsReadHistory:
 			return new(TLChannelsReadHistory)
 		case TagChannelsDeleteMessages:
@@ -31903,6 +32105,10 @@ var Schema = &tl.Schema{
 			return new(TLPhoneSetCallRating)
 		case TagPhoneSaveCallDebug:
 			return new(TLPhoneSaveCallDebug)
+		case TagPQInnerData:
+			return new(TLPQInnerData)
+		case TagPQInnerDataTemp:
+			return new(TLPQInnerDataTemp)
 		case TagServerDHParamsFail:
 			return new(TLServerDHParamsFail)
 		case TagServerDHParamsOK:
@@ -0,0 +1,209 @@
+package mtproto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+const (
+	// DefaultHTTPMaxConns is the default number of concurrent HTTP requests.
+	DefaultHTTPMaxConns = 4
+
+	// httpWaitMax is the max_wait of the http_wait long polling requests
+	httpWaitMax = 25 * time.Second
+)
+
+// PollingTransport is implemented by transports that can only deliver server
+// messages in responses to client requests. The session keeps an http_wait
+// request pending on them, so that the server can push updates.
+type PollingTransport interface {
+	Transport
+
+	// Idle returns a channel that receives a value whenever no request is
+	// pending anymore.
+	Idle() <-chan struct{}
+}
+
+type HTTPTransportOptions struct {
+	// Client sends the requests; defaults to a client with a timeout long
+	// enough for http_wait.
+	Client *http.Client
+
+	// Dial opens the connections of the default Client, e.g. through a
+	// proxy (see ProxyDialer); defaults to net.Dial.
+	Dial DialFunc
+
+	// MaxConns limits the requests in flight; defaults to DefaultHTTPMaxConns.
+	MaxConns int
+}
+
+type httpResponse struct {
+	data    []byte
+	errcode int
+	err     error
+}
+
+// HTTPTransport sends every frame as the body of a POST request and receives
+// frames from the response bodies. Several requests may be in flight at once,
+// so frames can arrive out of order.
+type HTTPTransport struct {
+	url    string
+	client *http.Client
+
+	sem   chan struct{}
+	recvc chan httpResponse
+	idlec chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mut     sync.Mutex
+	pending int
+}
+
+// DialHTTP returns an HTTP transport for the /api endpoint of a DC. No
+// connection is made until the first frame is sent.
+func DialHTTP(endpoint string, options HTTPTransportOptions) (*HTTPTransport, error) {
+	return NewHTTPTransport("http://"+endpoint+"/api", options), nil
+}
+
+func NewHTTPTransport(url string, options HTTPTransportOptions) *HTTPTransport {
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: httpWaitMax + 15*time.Second}
+		if dial := options.Dial; dial != nil {
+			options.Client.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return dial(network, address)
+				},
+			}
+		}
+	}
+	if options.MaxConns == 0 {
+		options.MaxConns = DefaultHTTPMaxConns
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &HTTPTransport{
+		url:    url,
+		client: options.Client,
+		sem:    make(chan struct{}, options.MaxConns),
+		recvc:  make(chan httpResponse),
+		idlec:  make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	tr.idlec <- struct{}{}
+	return tr
+}
+
+func (tr *HTTPTransport) Send(data []byte) error {
+	if tr.ctx.Err() != nil {
+		return io.EOF
+	}
+
+	tr.mut.Lock()
+	tr.pending++
+	tr.mut.Unlock()
+
+	go tr.post(data)
+	return nil
+}
+
+func (tr *HTTPTransport) post(data []byte) {
+	defer tr.finished()
+
+	select {
+	case tr.sem <- struct{}{}:
+		defer func() { <-tr.sem }()
+	case <-tr.ctx.Done():
+		return
+	}
+
+	resp := tr.roundTrip(data)
+	if resp.err == nil && resp.errcode == 0 && len(resp.data) == 0 {
+		return
+	}
+	select {
+	case tr.recvc <- resp:
+	case <-tr.ctx.Done():
+	}
+}
+
+func (tr *HTTPTransport) roundTrip(data []byte) httpResponse {
+	req, err := http.NewRequest("POST", tr.url, bytes.NewReader(data))
+	if err != nil {
+		return httpResponse{err: err}
+	}
+	req = req.WithContext(tr.ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return httpResponse{err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return httpResponse{err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body) == 4 {
+			return httpResponse{data: body}
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return httpResponse{errcode: -resp.StatusCode}
+		}
+		return httpResponse{err: fmt.Errorf("HTTP %s", resp.Status)}
+	}
+	return httpResponse{data: body}
+}
+
+func (tr *HTTPTransport) finished() {
+	tr.mut.Lock()
+	tr.pending--
+	idle := (tr.pending == 0)
+	tr.mut.Unlock()
+
+	if idle {
+		select {
+		case tr.idlec <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (tr *HTTPTransport) Recv() ([]byte, int, error) {
+	select {
+	case resp := <-tr.recvc:
+		if resp.err != nil {
+			if tr.ctx.Err() != nil {
+				return nil, 0, io.EOF
+			}
+			return nil, 0, resp.err
+		}
+		if len(resp.data) == 4 {
+			return nil, int(int32(tl.NewReader(resp.data).Cmd())), nil
+		}
+		return resp.data, resp.errcode, nil
+	case <-tr.ctx.Done():
+		return nil, 0, io.EOF
+	}
+}
+
+// Idle implements PollingTransport.
+func (tr *HTTPTransport) Idle() <-chan struct{} {
+	return tr.idlec
+}
+
+func (tr *HTTPTransport) Close() {
+	tr.cancel()
+}
@@ -0,0 +1,106 @@
+package mtproto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api" {
+			t.Errorf("received %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case bytes.Equal(body, []byte("long poll request")):
+			// a long poll, answered after the next request
+			<-release
+			w.Write([]byte("long poll response"))
+		case bytes.Equal(body, []byte("invalid request")):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write(body)
+		}
+	}))
+	defer srv.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	tr := NewHTTPTransport(srv.URL+"/api", HTTPTransportOptions{})
+	<-tr.Idle()
+
+	if err := tr.Send([]byte("long poll request")); err != nil {
+		t.Fatal(err)
+	}
+	// not blocked by the pending long poll
+	if err := tr.Send([]byte("echoed request")); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _, err := tr.Recv(); err != nil || string(raw) != "echoed request" {
+		t.Fatalf("Recv == %q, %v, expected the echo", raw, err)
+	}
+	close(release)
+	if raw, _, err := tr.Recv(); err != nil || string(raw) != "long poll response" {
+		t.Fatalf("Recv == %q, %v, expected the poll response", raw, err)
+	}
+	select {
+	case <-tr.Idle():
+	case <-time.After(time.Second):
+		t.Errorf("transport not idle after all requests finished")
+	}
+
+	tr.Send([]byte("invalid request"))
+	if raw, code, err := tr.Recv(); raw != nil || code != -404 || err != nil {
+		t.Errorf("Recv == %q, %d, %v, expected error code -404", raw, code, err)
+	}
+
+	tr.Close()
+	if _, _, err := tr.Recv(); err != io.EOF {
+		t.Errorf("Recv after Close == %v, expected EOF", err)
+	}
+	if err := tr.Send([]byte("echoed request")); err != io.EOF {
+		t.Errorf("Send after Close == %v, expected EOF", err)
+	}
+}
+
+// fakePollingTransport is a fakeTransport that reports being idle on demand.
+type fakePollingTransport struct {
+	*fakeTransport
+	idlec chan struct{}
+}
+
+func (tr *fakePollingTransport) Idle() <-chan struct{} {
+	return tr.idlec
+}
+
+func TestSessionLongPolls(t *testing.T) {
+	tr := &fakePollingTransport{newFakeTransport(), make(chan struct{}, 1)}
+	sess := newTestSession(tr)
+	go sess.Run()
+	defer sess.Shutdown()
+
+	for i := 1; i <= 2; i++ {
+		tr.idlec <- struct{}{}
+		sent := waitSent(t, tr.fakeTransport, i)
+		_, payload := decryptClientFrame(t, sent[i-1])
+		o, err := Schema.ReadBoxedObject(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait, ok := o.(*TLHttpWait)
+		if !ok || wait.MaxWait != 25000 {
+			t.Errorf("sent %v, expected http_wait", o)
+		}
+	}
+}
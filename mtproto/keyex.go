@@ -18,6 +18,11 @@ type keyExState int
 
 var ErrAfterKeyExchangeFailed = errors.New("no commands can be processed after failed key exchange")
 var ErrKeyExchangeNotFinished = errors.New("key exchange not yet finished")
+var ErrNewNonceHashMismatch = errors.New("new_nonce_hash does not match")
+
+// maxDHGenRetries limits how many times the server may ask for a new g_b
+// with dh_gen_retry.
+const maxDHGenRetries = 5
 
 const (
 	KeyExInit keyExState = iota
@@ -34,15 +39,28 @@ type AuthResult struct {
 	ServerSalt [8]byte
 	TimeOffset int
 	SessionID  [8]byte
+
+	// ExpiresAt is the Unix time (in server time) when a temporary key
+	// expires, or 0 for permanent keys
+	ExpiresAt int
 }
 
 type KeyEx struct {
 	RandomReader io.Reader
-	PubKey       *rsa.PublicKey
+
+	// PubKey and PublicKeys are the server keys the exchange may use; the
+	// first one the server offers is picked
+	PubKey     *rsa.PublicKey
+	PublicKeys *PublicKeyRing
+
+	// ExpiresIn, if not zero, makes the exchange create a temporary key that
+	// the server destroys after this many seconds.
+	ExpiresIn int
 
 	state keyExState
 	err   error
 
+	pubKey      *rsa.PublicKey
 	nonce       [16]byte
 	newNonce    [32]byte
 	serverNonce [16]byte
@@ -51,9 +69,12 @@ type KeyEx struct {
 	tmpAESKey [32]byte
 	tmpAESIV  [32]byte
 
-	g       int
-	b       *big.Int
-	dhPrime *big.Int
+	g          int
+	b          *big.Int
+	dhPrime    *big.Int
+	ga         *big.Int
+	serverTime int
+	retries    int
 
 	auth           AuthResult
 	authKeyAuxHash uint64
@@ -135,9 +156,9 @@ func (kex *KeyEx) handle(o tl.Object) (tl.Object, error) {
 		case *TLDHGenOK:
 			return kex.handleDHGenOK(o)
 		case *TLDHGenFail:
-			return nil, errors.New("got dh_gen_fail")
+			return nil, kex.handleDHGenFail(o)
 		case *TLDHGenRetry:
-			return nil, errors.New("got dh_gen_retry")
+			return kex.handleDHGenRetry(o)
 		default:
 			return nil, ErrUnexpectedCommand
 		}
@@ -171,17 +192,11 @@ func (kex *KeyEx) handleResPQ(in *TLResPQ) (tl.Object, error) {
 
 	//log.Printf("res_pq: %+#v", *in)
 
-	expectedFingerprint := ComputePubKeyFingerprint(kex.PubKey)
-	var keyOK bool
-	for _, fingerprint := range in.ServerPublicKeyFingerprints {
-		if fingerprint == expectedFingerprint {
-			keyOK = true
-		}
-	}
-	if !keyOK {
-		log.Printf("res_pq public key fingerprints = %v, wanted %v", in.ServerPublicKeyFingerprints, expectedFingerprint)
-		return nil, errors.New("public key fingerprint mismatch")
+	pubKey, fingerprint, err := kex.selectPubKey(in.ServerPublicKeyFingerprints)
+	if err != nil {
+		return nil, err
 	}
+	kex.pubKey = pubKey
 
 	if in.PQ.BitLen() > 64 {
 		log.Printf("mtproto/keyex: PQ number does not fit into uint64: %v", in.PQ)
@@ -191,7 +206,7 @@ func (kex *KeyEx) handleResPQ(in *TLResPQ) (tl.Object, error) {
 	p, q := factorize(pqn)
 	// log.Printf("mtproto/keyex: %v = %v (p) * %v (q)", pqn, p, q)
 
-	_, err := io.ReadFull(kex.RandomReader, kex.newNonce[:])
+	_, err = io.ReadFull(kex.RandomReader, kex.newNonce[:])
 	if err != nil {
 		panic(err)
 	}
@@ -201,22 +216,37 @@ func (kex *KeyEx) handleResPQ(in *TLResPQ) (tl.Object, error) {
 		panic(err)
 	}
 
-	inner := &TLPQInnerData{
-		PQ: in.PQ,
-		P:  big.NewInt(int64(p)),
-		Q:  big.NewInt(int64(q)),
+	var inner tl.Object
+	if kex.ExpiresIn > 0 {
+		temp := &TLPQInnerDataTemp{
+			PQ:        in.PQ,
+			P:         big.NewInt(int64(p)),
+			Q:         big.NewInt(int64(q)),
+			ExpiresIn: kex.ExpiresIn,
+		}
+		copy(temp.Nonce[:], kex.nonce[:])
+		copy(temp.ServerNonce[:], kex.serverNonce[:])
+		copy(temp.NewNonce[:], kex.newNonce[:])
+		inner = temp
+	} else {
+		perm := &TLPQInnerData{
+			PQ: in.PQ,
+			P:  big.NewInt(int64(p)),
+			Q:  big.NewInt(int64(q)),
+		}
+		copy(perm.Nonce[:], kex.nonce[:])
+		copy(perm.ServerNonce[:], kex.serverNonce[:])
+		copy(perm.NewNonce[:], kex.newNonce[:])
+		inner = perm
 	}
-	copy(inner.Nonce[:], kex.nonce[:])
-	copy(inner.ServerNonce[:], kex.serverNonce[:])
-	copy(inner.NewNonce[:], kex.newNonce[:])
 
 	// TODO: fill randomPadding
 
 	m := &TLReqDHParams{
-		P:                    inner.P,
-		Q:                    inner.Q,
-		PublicKeyFingerprint: expectedFingerprint,
-		EncryptedData:        EncryptRSAWithHash(tl.Bytes(inner), randomPadding[:], kex.PubKey),
+		P:                    big.NewInt(int64(p)),
+		Q:                    big.NewInt(int64(q)),
+		PublicKeyFingerprint: fingerprint,
+		EncryptedData:        EncryptRSAWithHash(tl.Bytes(inner), randomPadding[:], kex.pubKey),
 	}
 	copy(m.Nonce[:], kex.nonce[:])
 	copy(m.ServerNonce[:], kex.serverNonce[:])
@@ -225,7 +255,45 @@ func (kex *KeyEx) handleResPQ(in *TLResPQ) (tl.Object, error) {
 	return m, nil
 }
 
+// selectPubKey picks the first of the keys offered by the server that is
+// either PubKey or in PublicKeys.
+func (kex *KeyEx) selectPubKey(fingerprints []uint64) (*rsa.PublicKey, uint64, error) {
+	ring := kex.PublicKeys
+	if kex.PubKey != nil {
+		ring = NewPublicKeyRing()
+		ring.Add(kex.PubKey)
+		if kex.PublicKeys != nil {
+			for _, fingerprint := range kex.PublicKeys.Fingerprints() {
+				ring.Add(kex.PublicKeys.Lookup(fingerprint))
+			}
+		}
+	} else if ring == nil {
+		return nil, 0, errors.New("no server public keys configured")
+	}
+	return ring.Select(fingerprints)
+}
+
 func (kex *KeyEx) handleServerDHParamsOK(o *TLServerDHParamsOK) (tl.Object, error) {
+	inner, err := kex.decryptServerDHParams(o)
+	if err != nil {
+		return nil, err
+	}
+
+	// VERIFICATION
+
+	if err := checkDHParams(inner.G, inner.DHPrime); err != nil {
+		return nil, err
+	}
+	if err := checkDHValue(inner.GA, inner.DHPrime); err != nil {
+		return nil, err
+	}
+
+	return kex.acceptServerDHParams(inner)
+}
+
+// decryptServerDHParams decrypts server_DH_inner_data and checks its hash
+// and nonces, but not the DH parameters in it.
+func (kex *KeyEx) decryptServerDHParams(o *TLServerDHParamsOK) (*TLServerDHInnerData, error) {
 	if 1 != subtle.ConstantTimeCompare(o.Nonce[:], kex.nonce[:]) {
 		// log.Printf("server_dh_params_ok nonce = %v, wanted %v", o.Nonce[:], kex.nonce[:])
 		return nil, errors.New("bad nonce")
@@ -254,13 +322,19 @@ func (kex *KeyEx) handleServerDHParamsOK(o *TLServerDHParamsOK) (tl.Object, erro
 		log.Printf("Decrypted: %v", hex.EncodeToString(answer))
 	}
 
-	// TODO: check hash here (need to determine the reader offset here)
-	_ = answerHash
-
-	rawinner, err := Schema.ReadLimitedBoxedObjectNoEOFCheck(answer, TagServerDHInnerData)
-	if err != nil {
+	r := tl.NewReader(answer)
+	rawinner := Schema.ReadLimitedBoxedObjectFrom(r, TagServerDHInnerData)
+	if err := r.Err(); err != nil {
 		return nil, err
 	}
+	padding := r.ReadToEnd()
+	innerLen := len(answer) - len(padding)
+	if len(padding) >= 16 {
+		return nil, ErrHashMismatch
+	}
+	if h := sha1.Sum(answer[:innerLen]); 1 != subtle.ConstantTimeCompare(h[:], answerHash) {
+		return nil, ErrHashMismatch
+	}
 	inner := rawinner.(*TLServerDHInnerData)
 
 	if 1 != subtle.ConstantTimeCompare(inner.Nonce[:], kex.nonce[:]) {
@@ -270,33 +344,43 @@ func (kex *KeyEx) handleServerDHParamsOK(o *TLServerDHParamsOK) (tl.Object, erro
 		return nil, errors.New("bad server nonce")
 	}
 
+	return inner, nil
+}
+
+// acceptServerDHParams goes on with the DH parameters of the server, once
+// they have been verified.
+func (kex *KeyEx) acceptServerDHParams(inner *TLServerDHInnerData) (tl.Object, error) {
 	kex.g = inner.G
 	kex.dhPrime = inner.DHPrime
+	kex.ga = inner.GA
+	kex.serverTime = int(inner.ServerTime.Unix())
 
-	// VERIFICATION
-
-	if !kex.dhPrime.ProbablyPrime(20) {
-		return nil, errors.New("DHPrime not prime")
-	}
-	// TODO: more checks required by MTProto protocol
+	return kex.setClientDHParams()
+}
 
-	// PROCESSING
+// setClientDHParams picks b and answers with g_b. It runs again with a new b
+// when the server replies dh_gen_retry.
+func (kex *KeyEx) setClientDHParams() (tl.Object, error) {
+	gb := new(big.Int)
+	for {
+		var bbytes [256]byte
+		_, err := io.ReadFull(kex.RandomReader, bbytes[:])
+		if err != nil {
+			return nil, err
+		}
+		kex.b = new(big.Int)
+		kex.b.SetBytes(bbytes[:])
 
-	var bbytes [256]byte
-	_, err = io.ReadFull(kex.RandomReader, bbytes[:])
-	if err != nil {
-		return nil, err
+		gb.Exp(big.NewInt(int64(kex.g)), kex.b, kex.dhPrime)
+		if checkDHValue(gb, kex.dhPrime) == nil {
+			break
+		}
 	}
-	kex.b = new(big.Int)
-	kex.b.SetBytes(bbytes[:])
 
 	retryID := kex.authKeyAuxHash // zero on first attempt
 
-	gb := new(big.Int)
-	gb.Exp(big.NewInt(int64(kex.g)), kex.b, kex.dhPrime)
-
 	gab := new(big.Int)
-	gab.Exp(inner.GA, kex.b, kex.dhPrime)
+	gab.Exp(kex.ga, kex.b, kex.dhPrime)
 	kex.auth.Key = leftZeroPad(gab.Bytes(), 256)
 
 	authKeyHash := sha1.Sum(kex.auth.Key)
@@ -305,6 +389,9 @@ func (kex *KeyEx) handleServerDHParamsOK(o *TLServerDHParamsOK) (tl.Object, erro
 	for i := 0; i < 8; i++ {
 		kex.auth.ServerSalt[i] = kex.newNonce[i] ^ kex.serverNonce[i]
 	}
+	if kex.ExpiresIn > 0 {
+		kex.auth.ExpiresAt = kex.serverTime + kex.ExpiresIn
+	}
 
 	// log.Printf("Auth key: %v (key ID: %x, server salt: %x)", hex.EncodeToString(kex.auth.Key), kex.auth.KeyID, kex.auth.ServerSalt)
 
@@ -332,17 +419,24 @@ func (kex *KeyEx) handleServerDHParamsOK(o *TLServerDHParamsOK) (tl.Object, erro
 	return reply, nil
 }
 
-func (kex *KeyEx) handleDHGenOK(in *TLDHGenOK) (tl.Object, error) {
-	if 1 != subtle.ConstantTimeCompare(in.Nonce[:], kex.nonce[:]) {
-		// log.Printf("server_dh_params_ok nonce = %v, wanted %v", in.Nonce[:], kex.nonce[:])
-		return nil, errors.New("bad nonce")
+func (kex *KeyEx) checkDHGenNonces(nonce, serverNonce, hash []byte, n byte) error {
+	if 1 != subtle.ConstantTimeCompare(nonce, kex.nonce[:]) {
+		return errors.New("bad nonce")
 	}
-	if 1 != subtle.ConstantTimeCompare(in.ServerNonce[:], kex.serverNonce[:]) {
-		// log.Printf("server_dh_params_ok server nonce = %v, wanted %v", in.Nonce[:], kex.serverNonce[:])
-		return nil, errors.New("bad server nonce")
+	if 1 != subtle.ConstantTimeCompare(serverNonce, kex.serverNonce[:]) {
+		return errors.New("bad server nonce")
+	}
+	expected := newNonceHash(kex.newNonce[:], n, kex.authKeyAuxHash)
+	if 1 != subtle.ConstantTimeCompare(hash, expected[:]) {
+		return ErrNewNonceHashMismatch
 	}
+	return nil
+}
 
-	// TODO: check in.NewNonceHash1
+func (kex *KeyEx) handleDHGenOK(in *TLDHGenOK) (tl.Object, error) {
+	if err := kex.checkDHGenNonces(in.Nonce[:], in.ServerNonce[:], in.NewNonceHash1[:], 1); err != nil {
+		return nil, err
+	}
 
 	log.Printf("✓ Key exchange complete")
 
@@ -350,6 +444,24 @@ func (kex *KeyEx) handleDHGenOK(in *TLDHGenOK) (tl.Object, error) {
 	return nil, nil
 }
 
+func (kex *KeyEx) handleDHGenRetry(in *TLDHGenRetry) (tl.Object, error) {
+	if err := kex.checkDHGenNonces(in.Nonce[:], in.ServerNonce[:], in.NewNonceHash2[:], 2); err != nil {
+		return nil, err
+	}
+	kex.retries++
+	if kex.retries > maxDHGenRetries {
+		return nil, errors.New("too many dh_gen_retry")
+	}
+	return kex.setClientDHParams()
+}
+
+func (kex *KeyEx) handleDHGenFail(in *TLDHGenFail) error {
+	if err := kex.checkDHGenNonces(in.Nonce[:], in.ServerNonce[:], in.NewNonceHash3[:], 3); err != nil {
+		return err
+	}
+	return errors.New("got dh_gen_fail")
+}
+
 func deriveTempAESKey(serverNonce, newNonce []byte, key, iv []byte) {
 	if len(key) != 32 {
 		panic("len(key) != 32")
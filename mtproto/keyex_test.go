@@ -2,9 +2,12 @@ package mtproto
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/hex"
 	"strings"
 	"testing"
+
+	"github.com/PROger4ever/telegramapi/tl"
 )
 
 const randomness = `
@@ -208,7 +211,7 @@ func TestKeyExchange(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	msg, err = keyex.Handle(Schema.MustReadBoxedObject(inmsg.Payload))
+	msg, err = handleSampleDHParams(&keyex, Schema.MustReadBoxedObject(inmsg.Payload))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,6 +256,123 @@ func TestKeyExchange(t *testing.T) {
 	}
 }
 
+// handleSampleDHParams handles the server_DH_params_ok of the documentation
+// sample like KeyEx.Handle does, except for the check of g: the sample uses
+// g=2 with p mod 8 = 3, which KeyEx rightly refuses.
+func handleSampleDHParams(keyex *KeyEx, o tl.Object) (tl.Object, error) {
+	inner, err := keyex.decryptServerDHParams(o.(*TLServerDHParamsOK))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDHValue(inner.GA, inner.DHPrime); err != nil {
+		return nil, err
+	}
+	return keyex.acceptServerDHParams(inner)
+}
+
+// sampleKeyExUntilDH replays the documentation sample up to
+// server_DH_params_ok and returns the result of handling it, with
+// handleSampleDHParams if sampleG is set.
+func sampleKeyExUntilDH(t *testing.T, keyex *KeyEx, sampleG bool) (tl.Object, error) {
+	var framer Framer
+	var err error
+
+	keyex.RandomReader = bytes.NewReader(fromHex(randomness))
+	keyex.PubKey, err = ParsePublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyex.Start()
+
+	for _, res := range []string{res1, res2} {
+		inmsg, err := framer.Parse(fromHex(res))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := Schema.MustReadBoxedObject(inmsg.Payload)
+		if res == res2 && sampleG {
+			return handleSampleDHParams(keyex, o)
+		}
+		msg, err := keyex.Handle(o)
+		if err != nil || res == res2 {
+			return msg, err
+		}
+	}
+	panic("unreachable")
+}
+
+func TestKeyExchangeRejectsBadGenerator(t *testing.T) {
+	var keyex KeyEx
+	_, err := sampleKeyExUntilDH(t, &keyex, false)
+	if err != ErrBadDHG {
+		t.Fatalf("got %v, wanted %v", err, ErrBadDHG)
+	}
+	if _, err := keyex.Result(); err != ErrBadDHG {
+		t.Errorf("Result() error is %v, wanted %v", err, ErrBadDHG)
+	}
+}
+
+func TestKeyExchangeRetry(t *testing.T) {
+	var keyex KeyEx
+	if _, err := sampleKeyExUntilDH(t, &keyex, true); err != nil {
+		t.Fatal(err)
+	}
+	keyex.RandomReader = rand.Reader
+	firstKey := keyex.auth.Key
+	auxHash := keyex.authKeyAuxHash
+
+	retry := &TLDHGenRetry{
+		Nonce:         keyex.nonce,
+		ServerNonce:   keyex.serverNonce,
+		NewNonceHash2: newNonceHash(keyex.newNonce[:], 1, auxHash),
+	}
+	if _, err := (&KeyEx{}).Handle(retry); err == nil {
+		t.Fatal("dh_gen_retry accepted outside of the exchange")
+	}
+
+	// a hash of the wrong kind must be rejected
+	bad := keyex
+	if _, err := bad.Handle(retry); err != ErrNewNonceHashMismatch {
+		t.Fatalf("got %v, wanted %v", err, ErrNewNonceHashMismatch)
+	}
+
+	retry.NewNonceHash2 = newNonceHash(keyex.newNonce[:], 2, auxHash)
+	msg, err := keyex.Handle(retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := msg.(*TLSetClientDHParams)
+	if !ok {
+		t.Fatalf("reply to dh_gen_retry is %T", msg)
+	}
+	answer, _, err := AESIGEDecryptWithHash(nil, reply.EncryptedData, keyex.tmpAESKey[:], keyex.tmpAESIV[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := Schema.ReadLimitedBoxedObjectNoEOFCheck(answer, TagClientDHInnerData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner := o.(*TLClientDHInnerData); inner.RetryID != auxHash {
+		t.Errorf("retry_id is %x, wanted %x", inner.RetryID, auxHash)
+	}
+	if bytes.Equal(keyex.auth.Key, firstKey) {
+		t.Error("auth key not regenerated on retry")
+	}
+
+	ok1 := &TLDHGenOK{
+		Nonce:         keyex.nonce,
+		ServerNonce:   keyex.serverNonce,
+		NewNonceHash1: newNonceHash(keyex.newNonce[:], 1, keyex.authKeyAuxHash),
+	}
+	if _, err := keyex.Handle(ok1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyex.Result(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func fromHex(s string) []byte {
 	data, err := hex.DecodeString(strings.Map(dropSpace, s))
 	if err != nil {
@@ -0,0 +1,133 @@
+package mtproto
+
+import (
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProductionPublicKeys are the RSA keys of the production Telegram servers,
+// as PEM blocks.
+const ProductionPublicKeys = `
+-----BEGIN RSA PUBLIC KEY-----
+MIIBCgKCAQEA6LszBcC1LGzyr992NzE0ieY+BSaOW622Aa9Bd4ZHLl+TuFQ4lo4g
+5nKaMBwK/BIb9xUfg0Q29/2mgIR6Zr9krM7HjuIcCzFvDtr+L0GQjae9H0pRB2OO
+62cECs5HKhT5DZ98K33vmWiLowc621dQuwKWSQKjWf50XYFw42h21P2KXUGyp2y/
++aEyZ+uVgLLQbRA1dEjSDZ2iGRy12Mk5gpYc397aYp438fsJoHIgJ2lgMv5h7WY9
+t6N/byY9Nw9p21Og3AoXSL2q/2IJ1WRUhebgAdGVMlV1fkuOQoEzR7EdpqtQD9Cs
+5+bfo3Nhmcyvk5ftB0WkJ9z6bNZ7yxrP8wIDAQAB
+-----END RSA PUBLIC KEY-----
+-----BEGIN RSA PUBLIC KEY-----
+MIIBCgKCAQEAwVACPi9w23mF3tBkdZz+zwrzKOaaQdr01vAbU4E1pvkfj4sqDsm6
+lyDONS789sVoD/xCS9Y0hkkC3gtL1tSfTlgCMOOul9lcixlEKzwKENj1Yz/s7daS
+an9tqw3bfUV/nqgbhGX81v/+7RFAEd+RwFnK7a+XYl9sluzHRyVVaTTveB2GazTw
+Efzk2DWgkBluml8OREmvfraX3bkHZJTKX4EQSjBbbdJ2ZXIsRrYOXfaA+xayEGB+
+8hdlLmAjbCVfaigxX0CDqWeR1yFL9kwd9P0NsZRPsmoqVwMbMu7mStFai6aIhc3n
+Slv8kg9qv1m6XHVQY3PnEw+QQtqSIXklHwIDAQAB
+-----END RSA PUBLIC KEY-----
+`
+
+// TestPublicKeys are the RSA keys of the Telegram test servers.
+const TestPublicKeys = `
+-----BEGIN RSA PUBLIC KEY-----
+MIIBCgKCAQEAyMEdY1aR+sCR3ZSJrtztKTKqigvO/vBfqACJLZtS7QMgCGXJ6XIR
+yy7mx66W0/sOFa7/1mAZtEoIokDP3ShoqF4fVNb6XeqgQfaUHd8wJpDWHcR2OFwv
+plUUI1PLTktZ9uW2WE23b+ixNwJjJGwBDJPQEQFBE+vfmH0JP503wr5INS1poWg/
+j25sIWeYPHYeOrFp/eXaqhISP6G+q2IeTaWTXpwZj4LzXq5YOpk4bYEQ6mvRq7D1
+aHWfYmlEGepfaYR8Q0YqvvhYtMte3ITnuSJs171+GDqpdKcSwHnd6FudwGO4pcCO
+j4WcDuXc2CTHgH8gFTNhp/Y8/SpDOhvn9QIDAQAB
+-----END RSA PUBLIC KEY-----
+`
+
+var ErrNoMatchingPublicKey = errors.New("none of the public keys offered by the server is known")
+
+// PublicKeyRing is a set of server RSA keys, indexed by their fingerprints.
+// It must not be modified once in use.
+type PublicKeyRing struct {
+	keys  map[uint64]*rsa.PublicKey
+	order []uint64
+}
+
+func NewPublicKeyRing() *PublicKeyRing {
+	return &PublicKeyRing{keys: make(map[uint64]*rsa.PublicKey)}
+}
+
+// DefaultPublicKeyRing returns a ring with the keys of the production and the
+// test servers.
+func DefaultPublicKeyRing() *PublicKeyRing {
+	ring := NewPublicKeyRing()
+	for _, keys := range []string{ProductionPublicKeys, TestPublicKeys} {
+		if err := ring.AddPEM(keys); err != nil {
+			panic(err)
+		}
+	}
+	return ring
+}
+
+// Add adds a key to the ring and returns its fingerprint.
+func (ring *PublicKeyRing) Add(key *rsa.PublicKey) uint64 {
+	fingerprint := ComputePubKeyFingerprint(key)
+	if ring.keys[fingerprint] == nil {
+		ring.order = append(ring.order, fingerprint)
+	}
+	ring.keys[fingerprint] = key
+	return fingerprint
+}
+
+// AddPEM adds all the keys of one or more concatenated PEM blocks.
+func (ring *PublicKeyRing) AddPEM(s string) error {
+	rest := []byte(s)
+	n := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		key, err := parsePublicKeyBlock(block)
+		if err != nil {
+			return err
+		}
+		ring.Add(key)
+		n++
+	}
+	if n == 0 || strings.TrimSpace(string(rest)) != "" {
+		return errors.New("failed to parse PEM block containing the public key")
+	}
+	return nil
+}
+
+// Fingerprints returns the fingerprints of the keys, in the order they have
+// been added.
+func (ring *PublicKeyRing) Fingerprints() []uint64 {
+	return append([]uint64(nil), ring.order...)
+}
+
+// Lookup returns the key with the given fingerprint, or nil.
+func (ring *PublicKeyRing) Lookup(fingerprint uint64) *rsa.PublicKey {
+	return ring.keys[fingerprint]
+}
+
+// Select returns the first of the keys advertised by the server that is in
+// the ring, along with its fingerprint.
+func (ring *PublicKeyRing) Select(fingerprints []uint64) (*rsa.PublicKey, uint64, error) {
+	for _, fingerprint := range fingerprints {
+		if key := ring.keys[fingerprint]; key != nil {
+			return key, fingerprint, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: server offers %s, known are %s", ErrNoMatchingPublicKey, formatFingerprints(fingerprints), formatFingerprints(ring.order))
+}
+
+func formatFingerprints(fingerprints []uint64) string {
+	if len(fingerprints) == 0 {
+		return "none"
+	}
+	s := make([]string, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		s[i] = fmt.Sprintf("%016x", fingerprint)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,68 @@
+package mtproto
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultPublicKeyRing(t *testing.T) {
+	ring := DefaultPublicKeyRing()
+	expected := []uint64{0xd09d1d85de64fd85, 0xc3b42b026ce86b21, 0xb25898df208d2603}
+	if a := ring.Fingerprints(); !reflect.DeepEqual(a, expected) {
+		t.Errorf("fingerprints == %x, expected %x", a, expected)
+	}
+
+	key, fingerprint, err := ring.Select([]uint64{0x1234, 0xb25898df208d2603, 0xd09d1d85de64fd85})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != 0xb25898df208d2603 || ComputePubKeyFingerprint(key) != fingerprint {
+		t.Errorf("selected key %016x, expected the first known one offered", fingerprint)
+	}
+
+	if _, _, err := ring.Select([]uint64{0x1234}); !errors.Is(err, ErrNoMatchingPublicKey) {
+		t.Errorf("Select of unknown keys returned %v", err)
+	}
+}
+
+func TestPublicKeyRingAddPEM(t *testing.T) {
+	ring := NewPublicKeyRing()
+	if err := ring.AddPEM(publicKey); err != nil {
+		t.Fatal(err)
+	}
+	if ring.Lookup(0xc3b42b026ce86b21) == nil {
+		t.Errorf("added key not found")
+	}
+	if err := ring.AddPEM("garbage"); err == nil {
+		t.Errorf("AddPEM accepted a string without keys")
+	}
+	if err := ring.AddPEM(publicKey + "garbage"); err == nil {
+		t.Errorf("AddPEM accepted trailing garbage")
+	}
+}
+
+func TestKeyExSelectsOfferedKey(t *testing.T) {
+	start := func() (*KeyEx, *TLResPQ) {
+		kex := &KeyEx{PublicKeys: DefaultPublicKeyRing()}
+		req := kex.Start().(*TLReqPQ)
+		return kex, &TLResPQ{Nonce: req.Nonce, PQ: big.NewInt(0x17ED48941A08F981)}
+	}
+
+	kex, res := start()
+	res.ServerPublicKeyFingerprints = []uint64{0x1234, 0xb25898df208d2603}
+	o, err := kex.Handle(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := o.(*TLReqDHParams).PublicKeyFingerprint; fingerprint != 0xb25898df208d2603 {
+		t.Errorf("req_DH_params uses key %016x", fingerprint)
+	}
+
+	kex, res = start()
+	res.ServerPublicKeyFingerprints = []uint64{0x1234}
+	if _, err := kex.Handle(res); !errors.Is(err, ErrNoMatchingPublicKey) {
+		t.Errorf("key exchange with unknown server keys failed with %v", err)
+	}
+}
@@ -46,9 +46,26 @@ func MsgFromObj(o tl.Object) Msg {
 }
 
 func IsContentMsg(o tl.Object) bool {
+	switch o.(type) {
+	case *TLGetFutureSalts, *TLPing, *TLPingDelayDisconnect, *TLRPCDropAnswer, *TLDestroySession:
+		// MTProto service queries that are answered, and so are content-related
+		return true
+	}
 	return combOrigins[o.Cmd()] == SchemaOriginTelegram
 }
 
 func RequiresAck(o tl.Object) bool {
 	return IsContentMsg(o)
 }
+
+// IsKeyExMsg reports whether o belongs to the auth key exchange, and so is
+// sent unencrypted.
+func IsKeyExMsg(o tl.Object) bool {
+	switch o.(type) {
+	case *TLReqPQ, *TLReqDHParams, *TLSetClientDHParams:
+		return true
+	case *TLResPQ, *TLServerDHParamsOK, *TLServerDHParamsFail, *TLDHGenOK, *TLDHGenRetry, *TLDHGenFail:
+		return true
+	}
+	return false
+}
@@ -13,6 +13,8 @@ func TestMsgType(t *testing.T) {
 	}{
 		{&TLReqPQ{}, KeyExMsg},
 		{&TLNearestDC{}, ContentMsg},
+		{&TLGetFutureSalts{}, ContentMsg},
+		{&TLMsgsAck{}, KeyExMsg},
 	}
 	for _, tt := range tests {
 		actual := MsgFromObj(tt.input).Type
@@ -0,0 +1,257 @@
+package mtprototest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// transport error sent for unknown auth keys, like Telegram does
+var errCodeUnknownAuthKey int32 = -404
+
+// serverConn serves one client connection.
+type serverConn struct {
+	srv *Server
+	dc  int
+	tr  *mtproto.TCPTransport
+	kex *mtproto.ServerKeyEx
+
+	// frames are queued and written by a goroutine of their own, as writes
+	// to a net.Pipe block until the client reads them
+	sendMut sync.Mutex
+	fr      mtproto.Framer
+	queue   [][]byte
+	queuedc chan struct{}
+	closed  bool
+
+	handlers sync.WaitGroup
+}
+
+func (s *Server) serve(c net.Conn, dc int) {
+	defer s.untrack(c)
+	defer c.Close()
+
+	tr, err := mtproto.AcceptTCP(c, mtproto.TCPTransportOptions{})
+	if err != nil {
+		s.logf("accept: %v", err)
+		return
+	}
+
+	sc := &serverConn{srv: s, dc: dc, tr: tr, queuedc: make(chan struct{}, 1)}
+	sc.fr.Server = true
+	writerDone := make(chan struct{})
+	go func() {
+		sc.writeLoop()
+		close(writerDone)
+	}()
+	defer func() {
+		sc.handlers.Wait()
+		sc.sendMut.Lock()
+		sc.closed = true
+		sc.sendMut.Unlock()
+		sc.signal()
+		<-writerDone
+	}()
+	for {
+		raw, _, err := tr.Recv()
+		if err != nil {
+			if err != io.EOF {
+				s.logf("recv: %v", err)
+			}
+			return
+		}
+		if err := sc.handleFrame(raw); err != nil {
+			s.logf("DC %d: %v", dc, err)
+			return
+		}
+	}
+}
+
+func (sc *serverConn) handleFrame(raw []byte) error {
+	keyID, err := mtproto.ParseAuthKeyID(raw)
+	if err != nil {
+		return err
+	}
+
+	sc.sendMut.Lock()
+	if keyID != 0 {
+		if auth, _ := sc.fr.State(); auth == nil || auth.KeyID != keyID {
+			auth, ok := sc.srv.authKey(keyID)
+			if !ok {
+				var code [4]byte
+				binints.EncodeUint32LE(uint32(errCodeUnknownAuthKey), code[:])
+				sc.enqueue(code[:])
+				sc.sendMut.Unlock()
+				return mtproto.ErrUnknownKeyID
+			}
+			sc.fr.SetAuth(&auth)
+		}
+	}
+	msg, err := sc.fr.Parse(raw)
+	auth, _ := sc.fr.State()
+	sc.sendMut.Unlock()
+	if err != nil {
+		return err
+	}
+	o, err := mtproto.Schema.ReadBoxedObject(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	if keyID == 0 {
+		if sc.kex == nil || sc.kex.IsFinished() {
+			sc.kex = &mtproto.ServerKeyEx{PrivateKeys: []*rsa.PrivateKey{sc.srv.key}}
+		}
+		reply, err := sc.kex.Handle(o)
+		if err != nil {
+			return err
+		}
+		if newAuth, err := sc.kex.Result(); err == nil {
+			sc.srv.addAuthKey(newAuth)
+		}
+		sc.sendUnencrypted(reply)
+		return nil
+	}
+
+	if sc.srv.newSession(sessionKey{keyID, auth.SessionID}) {
+		var unique [8]byte
+		io.ReadFull(rand.Reader, unique[:])
+		sc.send(&mtproto.TLNewSessionCreated{
+			FirstMsgID: msg.MsgID,
+			UniqueID:   binints.DecodeUint64LE(unique[:]),
+			ServerSalt: binints.DecodeUint64LE(auth.ServerSalt[:]),
+		})
+	}
+	sc.dispatch(keyID, binints.DecodeUint64LE(auth.ServerSalt[:]), msg.MsgID, o)
+	return nil
+}
+
+func (sc *serverConn) dispatch(keyID, salt, msgID uint64, o tl.Object) {
+	switch o := o.(type) {
+	case *mtproto.TLMsgContainer:
+		for _, msg := range o.Messages {
+			sc.dispatch(keyID, salt, msg.MsgID, msg.Body)
+		}
+	case *mtproto.TLMsgsAck, *mtproto.TLHttpWait:
+	case *mtproto.TLPing:
+		sc.send(&mtproto.TLPong{MsgID: msgID, PingID: o.PingID})
+	case *mtproto.TLPingDelayDisconnect:
+		sc.send(&mtproto.TLPong{MsgID: msgID, PingID: o.PingID})
+	case *mtproto.TLGetFutureSalts:
+		now := int(time.Now().Unix())
+		sc.send(&mtproto.TLFutureSalts{
+			ReqMsgID: msgID,
+			Now:      now,
+			Salts: []*mtproto.TLFutureSalt{{
+				ValidSince: now - 3600,
+				ValidUntil: now + 86400,
+				Salt:       salt,
+			}},
+		})
+	default:
+		req := &Request{
+			Query:     unwrapQuery(o),
+			MsgID:     msgID,
+			AuthKeyID: keyID,
+			DC:        sc.dc,
+		}
+		sc.handlers.Add(1)
+		go func() {
+			defer sc.handlers.Done()
+			sc.send(&mtproto.TLRPCResult{ReqMsgID: msgID, Result: sc.srv.call(req)})
+		}()
+	}
+}
+
+func unwrapQuery(o tl.Object) tl.Object {
+	for {
+		switch q := o.(type) {
+		case *mtproto.TLInvokeWithLayer:
+			o = q.Query
+		case *mtproto.TLInitConnection:
+			o = q.Query
+		case *mtproto.TLInvokeWithoutUpdates:
+			o = q.Query
+		default:
+			return o
+		}
+	}
+}
+
+func (s *Server) call(req *Request) tl.Object {
+	h := s.handler(req.Query.Cmd())
+	if h == nil {
+		s.logf("DC %d: no handler for %T", req.DC, req.Query)
+		return &mtproto.TLRPCError{ErrorCode: 400, ErrorMessage: "METHOD_NOT_IMPLEMENTED"}
+	}
+	result := h(req)
+	s.logf("DC %d: %T -> %T", req.DC, req.Query, result)
+	return result
+}
+
+func (sc *serverConn) sendUnencrypted(o tl.Object) {
+	sc.sendMut.Lock()
+	defer sc.sendMut.Unlock()
+
+	raw, _, err := sc.fr.FormatUnencrypted(mtproto.MsgFromObj(o))
+	if err != nil {
+		sc.srv.logf("format: %v", err)
+		return
+	}
+	sc.enqueue(raw)
+}
+
+// send queues a message in the session of the last message received. All
+// of them are content-related, as those of Telegram servers.
+func (sc *serverConn) send(o tl.Object) {
+	sc.sendMut.Lock()
+	defer sc.sendMut.Unlock()
+
+	raw, _, err := sc.fr.Format(mtproto.Msg{Payload: tl.Bytes(o), Type: mtproto.ContentMsg})
+	if err != nil {
+		sc.srv.logf("format: %v", err)
+		return
+	}
+	sc.enqueue(raw)
+}
+
+// enqueue must be called with sendMut held.
+func (sc *serverConn) enqueue(frame []byte) {
+	sc.queue = append(sc.queue, frame)
+	sc.signal()
+}
+
+func (sc *serverConn) signal() {
+	select {
+	case sc.queuedc <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the queued frames until the connection is done and the
+// queue is empty.
+func (sc *serverConn) writeLoop() {
+	for range sc.queuedc {
+		sc.sendMut.Lock()
+		queue, closed := sc.queue, sc.closed
+		sc.queue = nil
+		sc.sendMut.Unlock()
+
+		for _, frame := range queue {
+			if err := sc.tr.Send(frame); err != nil {
+				sc.srv.logf("send: %v", err)
+				break
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package mtprototest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// Reply returns a handler always answering with o.
+func Reply(o tl.Object) Handler {
+	return func(req *Request) tl.Object {
+		return o
+	}
+}
+
+// Error returns a handler failing every request with an RPC error.
+func Error(code int, message string) Handler {
+	return Reply(&mtproto.TLRPCError{ErrorCode: code, ErrorMessage: message})
+}
+
+// Migrate returns a handler answering with a 303 error redirecting the
+// client to another DC, like Migrate("FILE", 4) for FILE_MIGRATE_4.
+func Migrate(kind string, dc int) Handler {
+	return Error(303, fmt.Sprintf("%s_MIGRATE_%d", kind, dc))
+}
+
+// PerDC returns a handler passing requests to the handler of their DC, and
+// failing them with a migrate error of the given kind to the first DC in
+// handlers otherwise.
+func PerDC(kind string, handlers map[int]Handler) Handler {
+	home := 0
+	for dc := range handlers {
+		if home == 0 || dc < home {
+			home = dc
+		}
+	}
+	return func(req *Request) tl.Object {
+		if h := handlers[req.DC]; h != nil {
+			return h(req)
+		}
+		return Migrate(kind, home)(req)
+	}
+}
+
+// Sequence returns a handler passing the n-th request to the n-th handler,
+// and all requests past the end to the last one.
+func Sequence(handlers ...Handler) Handler {
+	var mut sync.Mutex
+	n := 0
+	return func(req *Request) tl.Object {
+		mut.Lock()
+		h := handlers[n]
+		if n < len(handlers)-1 {
+			n++
+		}
+		mut.Unlock()
+		return h(req)
+	}
+}
@@ -0,0 +1,312 @@
+// Package mtprototest provides an in-process MTProto server for testing
+// clients without reaching Telegram, in the spirit of net/http/httptest.
+//
+// The server performs the auth key exchange with a key of its own, decrypts
+// the requests, unwraps them from invokeWithLayer and initConnection, and
+// passes them to the handlers registered for their constructors:
+//
+//	srv := mtprototest.NewServer()
+//	defer srv.Close()
+//	srv.Handle(mtproto.TagMessagesGetDialogs, mtprototest.Reply(&mtproto.TLMessagesDialogs{}))
+//
+//	tr, err := mtproto.DialTCP(srv.DCAddr(2), mtproto.TCPTransportOptions{Dial: srv.Dial})
+//	sess := mtproto.NewSession(tr, mtproto.SessionOptions{PublicKeys: srv.PublicKeys()})
+package mtprototest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// DefaultDC is the DC of connections whose DC is not known.
+const DefaultDC = 2
+
+// number of DCs listed by the default help.getConfig handler
+const numDCs = 5
+
+// Request is an RPC call received by the server.
+type Request struct {
+	// Query is the call, unwrapped from invokeWithLayer, initConnection and
+	// invokeWithoutUpdates.
+	Query tl.Object
+
+	MsgID     uint64
+	AuthKeyID uint64
+
+	// DC is the DC the client connected to (see DCAddr).
+	DC int
+}
+
+// Handler answers a request. The result may be an *mtproto.TLRPCError.
+type Handler func(req *Request) tl.Object
+
+// Server is a fake MTProto server. It accepts connections made with Dial, or
+// over loopback after Start.
+type Server struct {
+	// Verbose logs the requests and connection errors.
+	Verbose bool
+
+	key *rsa.PrivateKey
+
+	mut      sync.Mutex
+	handlers map[uint32]Handler
+	authKeys map[uint64]mtproto.AuthResult
+	sessions map[sessionKey]bool
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type sessionKey struct {
+	authKeyID uint64
+	sessionID [8]byte
+}
+
+var (
+	serverKeyOnce sync.Once
+	serverKey     *rsa.PrivateKey
+)
+
+// generating RSA keys is slow, so all servers of a test binary share one
+func sharedServerKey() *rsa.PrivateKey {
+	serverKeyOnce.Do(func() {
+		var err error
+		serverKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(fmt.Sprintf("mtprototest: failed to generate the server key: %v", err))
+		}
+	})
+	return serverKey
+}
+
+// NewServer returns a server with the default handlers: help.getConfig
+// returns Config(req.DC), and auth.bindTempAuthKey succeeds. Other requests
+// fail with a 400 METHOD_NOT_IMPLEMENTED error until handlers are added.
+func NewServer() *Server {
+	key := sharedServerKey()
+	s := &Server{
+		key:      key,
+		handlers: make(map[uint32]Handler),
+		authKeys: make(map[uint64]mtproto.AuthResult),
+		sessions: make(map[sessionKey]bool),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.Handle(mtproto.TagHelpGetConfig, func(req *Request) tl.Object {
+		return s.Config(req.DC)
+	})
+	s.Handle(mtproto.TagAuthBindTempAuthKey, Reply(&mtproto.TLBoolTrue{}))
+	return s
+}
+
+// Handle sets the handler for requests with the given constructor, like
+// mtproto.TagHelpGetConfig, replacing the previous one.
+func (s *Server) Handle(cmd uint32, h Handler) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.handlers[cmd] = h
+}
+
+func (s *Server) handler(cmd uint32) Handler {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.handlers[cmd]
+}
+
+// PublicKeyPEM returns the server key in PEM, as expected by
+// telegramapi.Options.PublicKey.
+func (s *Server) PublicKeyPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&s.key.PublicKey),
+	}))
+}
+
+// PublicKeys returns a ring with only the server key.
+func (s *Server) PublicKeys() *mtproto.PublicKeyRing {
+	ring := mtproto.NewPublicKeyRing()
+	ring.Add(&s.key.PublicKey)
+	return ring
+}
+
+// DCAddr returns the address to Dial to reach the given DC. These addresses
+// are only meaningful to Dial.
+func (s *Server) DCAddr(dc int) string {
+	return net.JoinHostPort(fmt.Sprintf("127.0.0.%d", dc), "443")
+}
+
+func (s *Server) dcOf(address string) int {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return DefaultDC
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil || ip[0] != 127 || ip[1] != 0 || ip[2] != 0 || ip[3] == 0 {
+		return DefaultDC
+	}
+	return int(ip[3])
+}
+
+// Config returns a config for the given DC, listing DCs 1 to 5. After Start,
+// all of them are at the loopback address of the server; otherwise they are
+// at their DCAddr.
+func (s *Server) Config(dc int) *mtproto.TLConfig {
+	s.mut.Lock()
+	listener := s.listener
+	s.mut.Unlock()
+
+	now := time.Now()
+	config := &mtproto.TLConfig{
+		Date:    int(now.Unix()),
+		Expires: int(now.Add(time.Hour).Unix()),
+		ThisDC:  dc,
+	}
+	for id := 1; id <= numDCs; id++ {
+		addr := s.DCAddr(id)
+		if listener != nil {
+			addr = listener.Addr().String()
+		}
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		config.DCOptions = append(config.DCOptions, &mtproto.TLDCOption{
+			ID:        id,
+			IPAddress: host,
+			Port:      port,
+		})
+	}
+	return config
+}
+
+// Dial connects to the server over net.Pipe; it can be used as an
+// mtproto.DialFunc. The DC of the connection is given by the address (see
+// DCAddr), and is DefaultDC for other addresses.
+func (s *Server) Dial(network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	if !s.track(server) {
+		client.Close()
+		return nil, fmt.Errorf("mtprototest: dial %s: server closed", address)
+	}
+	go s.serve(server, s.dcOf(address))
+	return client, nil
+}
+
+// Start makes the server accept connections on a loopback address, returned
+// by Addr. They are all served as DefaultDC.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		l.Close()
+		return fmt.Errorf("mtprototest: server closed")
+	}
+	s.listener = l
+	s.wg.Add(1)
+	s.mut.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !s.track(c) {
+				c.Close()
+				return
+			}
+			go s.serve(c, DefaultDC)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the loopback address of the server after Start.
+func (s *Server) Addr() string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Close drops all connections and waits for their handlers to return.
+func (s *Server) Close() {
+	s.mut.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mut.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) track(c net.Conn) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.mut.Lock()
+	delete(s.conns, c)
+	s.mut.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) addAuthKey(auth *mtproto.AuthResult) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.authKeys[auth.KeyID] = *auth
+}
+
+// authKey returns a copy of a key, as each connection keeps the session it
+// serves in it.
+func (s *Server) authKey(keyID uint64) (mtproto.AuthResult, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	auth, ok := s.authKeys[keyID]
+	return auth, ok
+}
+
+// newSession records a session and reports whether it was not seen before.
+func (s *Server) newSession(key sessionKey) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.sessions[key] {
+		return false
+	}
+	s.sessions[key] = true
+	return true
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Verbose {
+		log.Printf("mtprototest: "+format, args...)
+	}
+}
@@ -0,0 +1,190 @@
+package mtprototest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+func startSession(t *testing.T, srv *Server, options mtproto.SessionOptions, dial func() (mtproto.Transport, error)) *mtproto.Session {
+	sess := newSession(t, srv, options, dial)
+	runSession(t, sess)
+	return sess
+}
+
+func newSession(t *testing.T, srv *Server, options mtproto.SessionOptions, dial func() (mtproto.Transport, error)) *mtproto.Session {
+	tr, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.PublicKeys = srv.PublicKeys()
+	options.Dial = dial
+	return mtproto.NewSession(tr, options)
+}
+
+func runSession(t *testing.T, sess *mtproto.Session) {
+	runDone := make(chan struct{})
+	go func() {
+		sess.Run()
+		close(runDone)
+	}()
+	t.Cleanup(func() {
+		sess.Shutdown()
+		<-runDone
+	})
+
+	ready := make(chan struct{})
+	go func() {
+		sess.WaitReady()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session not ready after 10s")
+	}
+}
+
+func pipeDialer(srv *Server, dc int) func() (mtproto.Transport, error) {
+	return func() (mtproto.Transport, error) {
+		return mtproto.DialTCP(srv.DCAddr(dc), mtproto.TCPTransportOptions{Dial: srv.Dial})
+	}
+}
+
+func TestServerOverPipe(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	var gotDC int
+	srv.Handle(mtproto.TagMessagesGetDialogs, func(req *Request) tl.Object {
+		gotDC = req.DC
+		return &mtproto.TLMessagesDialogsSlice{Count: 42}
+	})
+	srv.Handle(mtproto.TagHelpGetNearestDC, Error(420, "FLOOD_WAIT_3"))
+
+	sess := startSession(t, srv, mtproto.SessionOptions{}, pipeDialer(srv, 4))
+
+	r, err := sess.Send(&mtproto.TLHelpGetConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, ok := r.(*mtproto.TLConfig)
+	if !ok {
+		t.Fatalf("help.getConfig returned %v", r)
+	}
+	if config.ThisDC != 4 || len(config.DCOptions) != numDCs {
+		t.Errorf("config is for DC %d with %d DCs", config.ThisDC, len(config.DCOptions))
+	}
+
+	r, err = sess.Send(&mtproto.TLMessagesGetDialogs{OffsetPeer: &mtproto.TLInputPeerEmpty{}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialogs, ok := r.(*mtproto.TLMessagesDialogsSlice); !ok || dialogs.Count != 42 {
+		t.Errorf("messages.getDialogs returned %v", r)
+	}
+	if gotDC != 4 {
+		t.Errorf("request received on DC %d, expected 4", gotDC)
+	}
+
+	r, err = sess.Send(&mtproto.TLHelpGetNearestDC{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := r.(*mtproto.TLRPCError); !ok || e.ErrorCode != 420 || e.ErrorMessage != "FLOOD_WAIT_3" {
+		t.Errorf("help.getNearestDc returned %v", r)
+	}
+
+	r, err = sess.Send(&mtproto.TLHelpGetSupport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := r.(*mtproto.TLRPCError); !ok || e.ErrorMessage != "METHOD_NOT_IMPLEMENTED" {
+		t.Errorf("unhandled request returned %v", r)
+	}
+}
+
+func TestServerOverLoopback(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() (mtproto.Transport, error) {
+		return mtproto.DialTCP(srv.Addr(), mtproto.TCPTransportOptions{Mode: mtproto.TCPIntermediate})
+	}
+	sess := startSession(t, srv, mtproto.SessionOptions{}, dial)
+
+	r, err := sess.Send(&mtproto.TLHelpGetConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, ok := r.(*mtproto.TLConfig)
+	if !ok {
+		t.Fatalf("help.getConfig returned %v", r)
+	}
+	if config.ThisDC != DefaultDC || config.DCOptions[0].IPAddress != "127.0.0.1" {
+		t.Errorf("config is for DC %d at %v", config.ThisDC, config.DCOptions[0].IPAddress)
+	}
+}
+
+func TestServerKeepsAuthKeys(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	sess := startSession(t, srv, mtproto.SessionOptions{}, pipeDialer(srv, 2))
+	if _, err := sess.Send(&mtproto.TLHelpGetConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sess.Shutdown()
+	<-sess.Done()
+	auth, fs := sess.AuthState()
+	auth2 := *auth
+
+	// a new session with the saved key skips the key exchange
+	sess2 := newSession(t, srv, mtproto.SessionOptions{}, pipeDialer(srv, 2))
+	sess2.RestoreAuthState(&auth2, fs)
+	runSession(t, sess2)
+	if _, err := sess2.Send(&mtproto.TLHelpGetConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if auth3, _ := sess2.AuthState(); auth3.KeyID != auth.KeyID {
+		t.Errorf("second session uses key %x, expected %x", auth3.KeyID, auth.KeyID)
+	}
+}
+
+func TestServerWithTempKeys(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	sess := startSession(t, srv, mtproto.SessionOptions{TempKeyTTL: time.Hour}, pipeDialer(srv, 2))
+	if _, err := sess.Send(&mtproto.TLHelpGetConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	req := &Request{Query: &mtproto.TLHelpGetConfig{}, DC: 2}
+
+	seq := Sequence(Migrate("FILE", 4), Reply(&mtproto.TLBoolTrue{}))
+	if e, ok := seq(req).(*mtproto.TLRPCError); !ok || e.ErrorCode != 303 || e.ErrorMessage != "FILE_MIGRATE_4" {
+		t.Errorf("first reply of Sequence is %v", e)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := seq(req).(*mtproto.TLBoolTrue); !ok {
+			t.Errorf("reply %d of Sequence is not the last one", i+2)
+		}
+	}
+
+	perDC := PerDC("NETWORK", map[int]Handler{3: Reply(&mtproto.TLBoolTrue{}), 5: Reply(&mtproto.TLBoolFalse{})})
+	if e, ok := perDC(req).(*mtproto.TLRPCError); !ok || e.ErrorMessage != "NETWORK_MIGRATE_3" {
+		t.Errorf("PerDC on an unknown DC returned %v", e)
+	}
+	req.DC = 5
+	if _, ok := perDC(req).(*mtproto.TLBoolFalse); !ok {
+		t.Error("PerDC did not use the handler of the DC")
+	}
+}
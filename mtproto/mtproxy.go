@@ -0,0 +1,337 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidProxySecret = errors.New("invalid MTProxy secret")
+	ErrFakeTLSHandshake   = errors.New("MTProxy fake-TLS handshake failed")
+)
+
+// ProxySecret is the secret of an MTProto proxy.
+type ProxySecret struct {
+	Key []byte
+
+	// Secure is set for dd secrets, which require padded intermediate mode.
+	Secure bool
+
+	// Domain is set for ee secrets, which additionally wrap the connection in
+	// fake TLS records, pretending to talk to this domain.
+	Domain string
+}
+
+// ParseProxySecret parses a secret in hex or URL-safe base64, as found in
+// tg://proxy links: 16 bytes, 0xdd followed by 16 bytes, or 0xee followed by
+// 16 bytes and a domain name.
+func ParseProxySecret(s string) (*ProxySecret, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, ErrInvalidProxySecret
+		}
+	}
+
+	switch {
+	case len(raw) == 16:
+		return &ProxySecret{Key: raw}, nil
+	case len(raw) == 17 && raw[0] == 0xdd:
+		return &ProxySecret{Key: raw[1:], Secure: true}, nil
+	case len(raw) > 17 && raw[0] == 0xee:
+		return &ProxySecret{Key: raw[1:17], Domain: string(raw[17:])}, nil
+	default:
+		return nil, ErrInvalidProxySecret
+	}
+}
+
+// FakeTLS reports whether the proxy expects fake-TLS connections.
+func (s *ProxySecret) FakeTLS() bool {
+	return s.Domain != ""
+}
+
+// mode returns the TCP mode to use with the proxy.
+func (s *ProxySecret) mode(mode TCPMode) TCPMode {
+	if s.Secure || s.FakeTLS() {
+		return TCPPaddedIntermediate
+	}
+	return mode
+}
+
+// TLS record types
+const (
+	tlsHandshake        = 0x16
+	tlsChangeCipherSpec = 0x14
+	tlsApplicationData  = 0x17
+)
+
+const (
+	tlsMaxRecordLen   = 16384
+	tlsClientHelloLen = 517
+	tlsRandomOffset   = 11
+
+	// max difference between the clocks of the client and the proxy
+	fakeTLSMaxTimeSkew = 2 * time.Minute
+)
+
+var tlsChangeCipherSpecRecord = []byte{tlsChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+// fakeTLSClientHello builds a TLS 1.3 ClientHello for domain whose random
+// field is an HMAC of the message and the current time, keyed by the secret.
+func fakeTLSClientHello(secret *ProxySecret, now time.Time) ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sessionID := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, sessionID); err != nil {
+		return nil, err
+	}
+
+	var ext bytes.Buffer
+	writeTLSExtension(&ext, 0x0000, tlsVector(2, []byte{0}, tlsVector(2, []byte(secret.Domain))))                                 // server_name
+	writeTLSExtension(&ext, 0x000a, tlsVector(2, []byte{0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}))                                     // supported_groups
+	writeTLSExtension(&ext, 0x000b, tlsVector(1, []byte{0}))                                                                      // ec_point_formats
+	writeTLSExtension(&ext, 0x000d, tlsVector(2, []byte{0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03, 0x08, 0x05, 0x05, 0x01})) // signature_algorithms
+	writeTLSExtension(&ext, 0x0010, tlsVector(2, tlsVector(1, []byte("h2")), tlsVector(1, []byte("http/1.1"))))                   // ALPN
+	writeTLSExtension(&ext, 0x002b, tlsVector(1, []byte{0x03, 0x04, 0x03, 0x03}))                                                 // supported_versions
+	writeTLSExtension(&ext, 0x0033, tlsVector(2, []byte{0x00, 0x1d}, tlsVector(2, key.PublicKey().Bytes())))                      // key_share
+
+	var hello bytes.Buffer
+	hello.Write([]byte{0x03, 0x03})
+	hello.Write(make([]byte, 32)) // random
+	hello.Write(tlsVector(1, sessionID))
+	hello.Write(tlsVector(2, []byte{0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30, 0xcc, 0xa9, 0xcc, 0xa8}))
+	hello.Write(tlsVector(1, []byte{0})) // compression methods
+
+	// pad the record to the usual size
+	n := 5 + 4 + hello.Len() + 2 + ext.Len()
+	if pad := tlsClientHelloLen - n - 4; pad >= 0 {
+		writeTLSExtension(&ext, 0x0015, make([]byte, pad))
+	}
+	hello.Write(tlsVector(2, ext.Bytes()))
+
+	handshake := append([]byte{0x01}, tlsVector(3, hello.Bytes())...)
+	record := append([]byte{tlsHandshake, 0x03, 0x01}, tlsVector(2, handshake)...)
+
+	digest := fakeTLSDigest(secret, record)
+	binary.LittleEndian.PutUint32(digest[28:], binary.LittleEndian.Uint32(digest[28:])^uint32(now.Unix()))
+	copy(record[tlsRandomOffset:], digest)
+	return record, nil
+}
+
+func fakeTLSDigest(secret *ProxySecret, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret.Key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func writeTLSExtension(buf *bytes.Buffer, typ uint16, data []byte) {
+	buf.Write([]byte{byte(typ >> 8), byte(typ)})
+	buf.Write(tlsVector(2, data))
+}
+
+// tlsVector prefixes the concatenated items with their length in lenSize
+// bytes, big-endian.
+func tlsVector(lenSize int, items ...[]byte) []byte {
+	var data []byte
+	for _, item := range items {
+		data = append(data, item...)
+	}
+	v := make([]byte, lenSize, lenSize+len(data))
+	for i := 0; i < lenSize; i++ {
+		v[i] = byte(len(data) >> (8 * uint(lenSize-1-i)))
+	}
+	return append(v, data...)
+}
+
+func readTLSRecord(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if n > tlsMaxRecordLen+256 {
+		return nil, ErrFakeTLSHandshake
+	}
+	record := make([]byte, 5+n)
+	copy(record, hdr[:])
+	if _, err := io.ReadFull(r, record[5:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// fakeTLSClientHandshake sends a ClientHello and checks that the response
+// was signed by a proxy knowing the secret.
+func fakeTLSClientHandshake(c net.Conn, secret *ProxySecret) (net.Conn, error) {
+	hello, err := fakeTLSClientHello(secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(hello); err != nil {
+		return nil, err
+	}
+
+	// ServerHello, ChangeCipherSpec and a fake encrypted record
+	var resp []byte
+	for _, typ := range []byte{tlsHandshake, tlsChangeCipherSpec, tlsApplicationData} {
+		record, err := readTLSRecord(c)
+		if err != nil {
+			return nil, err
+		}
+		if record[0] != typ {
+			return nil, ErrFakeTLSHandshake
+		}
+		resp = append(resp, record...)
+	}
+	if len(resp) < tlsRandomOffset+32 {
+		return nil, ErrFakeTLSHandshake
+	}
+
+	random := append([]byte(nil), resp[tlsRandomOffset:tlsRandomOffset+32]...)
+	copy(resp[tlsRandomOffset:], make([]byte, 32))
+	if !hmac.Equal(random, fakeTLSDigest(secret, hello[tlsRandomOffset:tlsRandomOffset+32], resp)) {
+		return nil, ErrFakeTLSHandshake
+	}
+
+	return &fakeTLSConn{Conn: c, sendCCS: true}, nil
+}
+
+// fakeTLSServerHandshake is the proxy side of fakeTLSClientHandshake.
+func fakeTLSServerHandshake(c net.Conn, secret *ProxySecret, now time.Time) (net.Conn, error) {
+	hello, err := readTLSRecord(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) < 44+32 || hello[0] != tlsHandshake {
+		return nil, ErrFakeTLSHandshake
+	}
+
+	random := append([]byte(nil), hello[tlsRandomOffset:tlsRandomOffset+32]...)
+	copy(hello[tlsRandomOffset:], make([]byte, 32))
+	expected := fakeTLSDigest(secret, hello)
+	if !hmac.Equal(random[:28], expected[:28]) {
+		return nil, ErrFakeTLSHandshake
+	}
+	timestamp := int64(binary.LittleEndian.Uint32(random[28:]) ^ binary.LittleEndian.Uint32(expected[28:]))
+	if d := now.Sub(time.Unix(timestamp, 0)); d < -fakeTLSMaxTimeSkew || d > fakeTLSMaxTimeSkew {
+		return nil, ErrFakeTLSHandshake
+	}
+
+	// mirror the session ID, pick TLS_AES_128_GCM_SHA256 and x25519
+	sessionID := hello[44 : 44+32]
+	keyShare := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, keyShare); err != nil {
+		return nil, err
+	}
+	var ext bytes.Buffer
+	writeTLSExtension(&ext, 0x0033, append([]byte{0x00, 0x1d}, tlsVector(2, keyShare)...))
+	writeTLSExtension(&ext, 0x002b, []byte{0x03, 0x04})
+
+	var serverHello bytes.Buffer
+	serverHello.Write([]byte{0x03, 0x03})
+	serverHello.Write(make([]byte, 32))
+	serverHello.Write(tlsVector(1, sessionID))
+	serverHello.Write([]byte{0x13, 0x01, 0x00})
+	serverHello.Write(tlsVector(2, ext.Bytes()))
+
+	var resp []byte
+	resp = append(resp, tlsHandshake, 0x03, 0x03)
+	resp = append(resp, tlsVector(2, append([]byte{0x02}, tlsVector(3, serverHello.Bytes())...))...)
+	resp = append(resp, tlsChangeCipherSpecRecord...)
+	fakeData := make([]byte, 1024+int(keyShare[0])*4)
+	if _, err := io.ReadFull(rand.Reader, fakeData); err != nil {
+		return nil, err
+	}
+	resp = append(resp, tlsApplicationData, 0x03, 0x03)
+	resp = append(resp, tlsVector(2, fakeData)...)
+
+	copy(resp[tlsRandomOffset:], fakeTLSDigest(secret, random, resp))
+	if _, err := c.Write(resp); err != nil {
+		return nil, err
+	}
+	return &fakeTLSConn{Conn: c, skipCCS: true}, nil
+}
+
+// fakeTLSConn wraps the data of a fake-TLS connection in application data
+// records.
+type fakeTLSConn struct {
+	net.Conn
+
+	// the client sends a ChangeCipherSpec before its first record, which the
+	// server skips
+	sendCCS bool
+	skipCCS bool
+
+	writeMut  sync.Mutex
+	remaining int
+}
+
+func (c *fakeTLSConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		var hdr [5]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:5]))
+		switch {
+		case hdr[0] == tlsChangeCipherSpec && c.skipCCS:
+			c.skipCCS = false
+			if _, err := io.ReadFull(c.Conn, make([]byte, n)); err != nil {
+				return 0, err
+			}
+		case hdr[0] == tlsApplicationData:
+			c.remaining = n
+		default:
+			return 0, fmt.Errorf("unexpected TLS record type %#x", hdr[0])
+		}
+	}
+
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *fakeTLSConn) Write(b []byte) (int, error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+
+	var buf []byte
+	if c.sendCCS {
+		c.sendCCS = false
+		buf = append(buf, tlsChangeCipherSpecRecord...)
+	}
+	for data := b; len(data) > 0; {
+		n := len(data)
+		if n > tlsMaxRecordLen {
+			n = tlsMaxRecordLen
+		}
+		buf = append(buf, tlsApplicationData, 0x03, 0x03, byte(n>>8), byte(n))
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,128 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+const testProxyKey = "00112233445566778899aabbccddeeff"
+
+func TestParseProxySecret(t *testing.T) {
+	domain := hex.EncodeToString([]byte("example.com"))
+	key, _ := hex.DecodeString(testProxyKey)
+	tests := []struct {
+		secret string
+		secure bool
+		domain string
+	}{
+		{testProxyKey, false, ""},
+		{"dd" + testProxyKey, true, ""},
+		{"ee" + testProxyKey + domain, false, "example.com"},
+		{base64.RawURLEncoding.EncodeToString(append(append([]byte{0xee}, key...), "example.com"...)), false, "example.com"},
+	}
+	for _, tt := range tests {
+		s, err := ParseProxySecret(tt.secret)
+		if err != nil {
+			t.Errorf("ParseProxySecret(%q) failed: %v", tt.secret, err)
+			continue
+		}
+		if !bytes.Equal(s.Key, key) || s.Secure != tt.secure || s.Domain != tt.domain {
+			t.Errorf("ParseProxySecret(%q) == %+v", tt.secret, s)
+		}
+	}
+
+	for _, secret := range []string{"", "0011", "ab" + testProxyKey, "dd" + testProxyKey + "00"} {
+		if _, err := ParseProxySecret(secret); err != ErrInvalidProxySecret {
+			t.Errorf("ParseProxySecret(%q) returned %v, expected %v", secret, err, ErrInvalidProxySecret)
+		}
+	}
+}
+
+func TestFakeTLSClientHello(t *testing.T) {
+	secret, _ := ParseProxySecret("ee" + testProxyKey + hex.EncodeToString([]byte("example.com")))
+	hello, err := fakeTLSClientHello(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hello) != tlsClientHelloLen || hello[0] != tlsHandshake || hello[5] != 0x01 {
+		t.Errorf("ClientHello is %d bytes, starting with %x", len(hello), hello[:6])
+	}
+	if !bytes.Contains(hello, []byte("example.com")) {
+		t.Errorf("ClientHello does not include the domain")
+	}
+}
+
+func TestMTProxyRoundTrip(t *testing.T) {
+	domain := hex.EncodeToString([]byte("example.com"))
+	for _, s := range []string{testProxyKey, "dd" + testProxyKey, "ee" + testProxyKey + domain} {
+		secret, err := ParseProxySecret(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientConn, serverConn := net.Pipe()
+		clientc := make(chan *TCPTransport, 1)
+		go func() {
+			client, err := NewTCPTransport(clientConn, TCPTransportOptions{ProxySecret: secret, DC: -2})
+			if err != nil {
+				t.Errorf("%s: NewTCPTransport failed: %v", s, err)
+				clientConn.Close()
+			}
+			clientc <- client
+			if client != nil {
+				for _, p := range testPackets() {
+					client.Send(p)
+				}
+			}
+		}()
+
+		server, err := AcceptTCP(serverConn, TCPTransportOptions{ProxySecret: secret})
+		if err != nil {
+			t.Fatalf("%s: AcceptTCP failed: %v", s, err)
+		}
+		client := <-clientc
+		if client == nil {
+			t.FailNow()
+		}
+		if server.DC() != -2 || server.Mode() != client.Mode() {
+			t.Errorf("%s: proxy got DC %d, mode %v, expected -2, %v", s, server.DC(), server.Mode(), client.Mode())
+		}
+		if secret.Secure || secret.FakeTLS() {
+			if client.Mode() != TCPPaddedIntermediate {
+				t.Errorf("%s: client used %v mode", s, client.Mode())
+			}
+		}
+
+		for i, p := range testPackets() {
+			raw, _, err := server.Recv()
+			if err != nil {
+				t.Fatalf("%s: Recv failed: %v", s, err)
+			}
+			if !bytes.Equal(raw, p) {
+				t.Errorf("%s: proxy received packet %d as %x, expected %x", s, i, raw, p)
+			}
+		}
+		go server.Send(testPackets()[1])
+		if raw, _, err := client.Recv(); err != nil || !bytes.Equal(raw, testPackets()[1]) {
+			t.Errorf("%s: client received %x, %v", s, raw, err)
+		}
+		client.Close()
+	}
+}
+
+func TestFakeTLSWrongSecret(t *testing.T) {
+	domain := hex.EncodeToString([]byte("example.com"))
+	secret, _ := ParseProxySecret("ee" + testProxyKey + domain)
+	other, _ := ParseProxySecret("ee" + "ff" + testProxyKey[2:] + domain)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go NewTCPTransport(clientConn, TCPTransportOptions{ProxySecret: other})
+	if _, err := AcceptTCP(serverConn, TCPTransportOptions{ProxySecret: secret}); err != ErrFakeTLSHandshake {
+		t.Errorf("AcceptTCP returned %v, expected %v", err, ErrFakeTLSHandshake)
+	}
+}
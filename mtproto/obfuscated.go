@@ -0,0 +1,136 @@
+package mtproto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/PROger4ever/telegramapi/binints"
+)
+
+const obfuscatedHeaderLen = 64
+
+var ErrObfuscatedFull = errors.New("the full TCP mode cannot be obfuscated")
+
+// values of the first 4 bytes of the obfuscation header that would make the
+// connection look like another protocol
+var forbiddenObfuscatedPrefixes = map[uint32]bool{
+	0x44414548: true, // HEAD
+	0x54534f50: true, // POST
+	0x20544547: true, // GET
+	0x4954504f: true, // OPTI
+	0xeeeeeeee: true,
+	0xdddddddd: true,
+	0x02010316: true, // TLS handshake
+}
+
+// obfuscator applies the AES-256-CTR streams of an obfuscated2 connection.
+type obfuscator struct {
+	enc cipher.Stream
+	dec cipher.Stream
+}
+
+func obfuscatedTag(mode TCPMode) ([]byte, error) {
+	switch mode {
+	case TCPAbridged:
+		return []byte{0xef, 0xef, 0xef, 0xef}, nil
+	case TCPIntermediate:
+		return intermediateTag, nil
+	case TCPPaddedIntermediate:
+		return paddedIntermediateTag, nil
+	default:
+		return nil, ErrObfuscatedFull
+	}
+}
+
+func obfuscatedMode(tag []byte) (TCPMode, error) {
+	for _, mode := range []TCPMode{TCPAbridged, TCPIntermediate, TCPPaddedIntermediate} {
+		if t, _ := obfuscatedTag(mode); string(t) == string(tag) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown obfuscated protocol tag %x", tag)
+}
+
+// newObfuscatedStream derives an AES-256-CTR stream from 48 bytes of the
+// header, mixing in the proxy secret, if any.
+func newObfuscatedStream(keyIV []byte, secret []byte) cipher.Stream {
+	key := keyIV[:32]
+	if len(secret) > 0 {
+		h := sha256.New()
+		h.Write(key)
+		h.Write(secret)
+		key = h.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return cipher.NewCTR(block, keyIV[32:48])
+}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, v := range b {
+		r[len(b)-1-i] = v
+	}
+	return r
+}
+
+// newObfuscatedHeader generates the 64 byte header a client sends to start
+// an obfuscated2 connection. dc is only used by proxies and may be 0.
+func newObfuscatedHeader(mode TCPMode, dc int, secret []byte, random io.Reader) ([]byte, *obfuscator, error) {
+	tag, err := obfuscatedTag(mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, obfuscatedHeaderLen)
+	for {
+		if _, err := io.ReadFull(random, header); err != nil {
+			return nil, nil, err
+		}
+		if header[0] == 0xef || forbiddenObfuscatedPrefixes[binints.DecodeUint32LE(header[0:4])] {
+			continue
+		}
+		if binints.DecodeUint32LE(header[4:8]) == 0 {
+			continue
+		}
+		break
+	}
+	copy(header[56:60], tag)
+	header[60], header[61] = byte(dc), byte(dc>>8)
+
+	ob := &obfuscator{
+		enc: newObfuscatedStream(header[8:56], secret),
+		dec: newObfuscatedStream(reversed(header[8:56]), secret),
+	}
+
+	encrypted := make([]byte, obfuscatedHeaderLen)
+	ob.enc.XORKeyStream(encrypted, header)
+	copy(header[56:], encrypted[56:])
+
+	return header, ob, nil
+}
+
+// acceptObfuscatedHeader is the server side of newObfuscatedHeader.
+func acceptObfuscatedHeader(header []byte, secret []byte) (TCPMode, int, *obfuscator, error) {
+	ob := &obfuscator{
+		enc: newObfuscatedStream(reversed(header[8:56]), secret),
+		dec: newObfuscatedStream(header[8:56], secret),
+	}
+
+	decrypted := make([]byte, obfuscatedHeaderLen)
+	ob.dec.XORKeyStream(decrypted, header)
+
+	mode, err := obfuscatedMode(decrypted[56:60])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	dc := int(int16(uint16(decrypted[60]) | uint16(decrypted[61])<<8))
+	return mode, dc, ob, nil
+}
@@ -0,0 +1,82 @@
+package mtproto
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+var ErrTempKeyNotBound = errors.New("the server refused to bind the temporary auth key")
+
+// newBindTempAuthKey builds the auth.bindTempAuthKey request binding temp to
+// perm. It must be sent with msgID, which the binding message repeats.
+func newBindTempAuthKey(perm, temp *AuthResult, msgID uint64, random io.Reader) (*TLAuthBindTempAuthKey, error) {
+	var nonce [8]byte
+	if _, err := io.ReadFull(random, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	inner := &TLBindAuthKeyInner{
+		Nonce:         binints.DecodeUint64LE(nonce[:]),
+		TempAuthKeyID: temp.KeyID,
+		PermAuthKeyID: perm.KeyID,
+		TempSessionID: binints.DecodeUint64LE(temp.SessionID[:]),
+		ExpiresAt:     temp.ExpiresAt,
+	}
+	encrypted, err := encryptBindMessage(perm, msgID, tl.Bytes(inner), random)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLAuthBindTempAuthKey{
+		PermAuthKeyID:    perm.KeyID,
+		Nonce:            inner.Nonce,
+		ExpiresAt:        temp.ExpiresAt,
+		EncryptedMessage: encrypted,
+	}, nil
+}
+
+// encryptBindMessage encrypts the binding message with the permanent key the
+// MTProto 1.0 way, with random bytes in place of the salt and the session ID,
+// and a zero seqno.
+func encryptBindMessage(perm *AuthResult, msgID uint64, payload []byte, random io.Reader) ([]byte, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(random, header[:]); err != nil {
+		return nil, err
+	}
+
+	w := tl.NewWriter()
+	w.Write(header[:])
+	w.WriteUint64(msgID)
+	w.WriteUint32(0)
+	w.WriteInt(len(payload))
+	w.Write(payload)
+
+	var msgKey [16]byte
+	hash := sha1.Sum(w.Bytes())
+	copy(msgKey[:], hash[4:20])
+
+	if pad := w.PaddingTo(16); pad > 0 {
+		padding := make([]byte, pad)
+		if _, err := io.ReadFull(random, padding); err != nil {
+			return nil, err
+		}
+		w.Write(padding)
+	}
+
+	var key, iv [32]byte
+	deriveAESKey(perm.Key, msgKey[:], key[:], iv[:], true)
+	encrypted, err := AESIGEPadEncrypt(nil, w.Bytes(), key[:], iv[:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Clear()
+	w.WriteUint64(perm.KeyID)
+	w.Write(msgKey[:])
+	w.Write(encrypted)
+	return w.Bytes(), nil
+}
@@ -0,0 +1,277 @@
+package mtproto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+func newTestTempAuth() *AuthResult {
+	auth := &AuthResult{
+		Key:       make([]byte, 256),
+		KeyID:     0x8877665544332211,
+		ExpiresAt: int(time.Now().Unix()) + 3600,
+	}
+	for i := range auth.Key {
+		auth.Key[i] = byte(255 - i)
+	}
+	return auth
+}
+
+// decryptBindMessage decrypts the encrypted_message of auth.bindTempAuthKey
+// the way the server would.
+func decryptBindMessage(t *testing.T, perm *AuthResult, raw []byte) (uint64, *TLBindAuthKeyInner) {
+	if keyID := binints.DecodeUint64LE(raw[:8]); keyID != perm.KeyID {
+		t.Fatalf("binding message encrypted with key %016x", keyID)
+	}
+	msgKey := raw[8:24]
+	var key, iv [32]byte
+	deriveAESKey(perm.Key, msgKey, key[:], iv[:], true)
+	data, err := AESIGEDecrypt(nil, raw[24:], key[:], iv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r tl.Reader
+	r.Reset(data)
+	r.ReadN(16) // random
+	msgID := r.ReadUint64()
+	if seqNo := r.ReadInt(); seqNo != 0 {
+		t.Errorf("binding message seqno == %d", seqNo)
+	}
+	n := r.ReadInt()
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha1.Sum(data[:32+n]); string(hash[4:20]) != string(msgKey) {
+		t.Errorf("binding message msg_key mismatch")
+	}
+
+	o, err := Schema.ReadBoxedObject(data[32 : 32+n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, ok := o.(*TLBindAuthKeyInner)
+	if !ok {
+		t.Fatalf("binding message contains %s", tl.Name(o))
+	}
+	return msgID, inner
+}
+
+func TestBindTempAuthKey(t *testing.T) {
+	perm, temp := newTestAuth(), newTestTempAuth()
+	temp.SessionID = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	req, err := newBindTempAuthKey(perm, temp, 0x5e0b800e12345678, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.PermAuthKeyID != perm.KeyID || req.ExpiresAt != temp.ExpiresAt {
+		t.Errorf("request == %v", req)
+	}
+
+	msgID, inner := decryptBindMessage(t, perm, req.EncryptedMessage)
+	if msgID != 0x5e0b800e12345678 {
+		t.Errorf("binding message msg_id == %08x", msgID)
+	}
+	expected := TLBindAuthKeyInner{
+		Nonce:         req.Nonce,
+		TempAuthKeyID: temp.KeyID,
+		PermAuthKeyID: perm.KeyID,
+		TempSessionID: binints.DecodeUint64LE(temp.SessionID[:]),
+		ExpiresAt:     temp.ExpiresAt,
+	}
+	if *inner != expected {
+		t.Errorf("binding message == %v, expected %v", inner, &expected)
+	}
+}
+
+func TestSessionBindsTempKey(t *testing.T) {
+	tr := newFakeTransport()
+	sess := NewSession(tr, SessionOptions{TempKeyTTL: time.Hour, BatchWindow: -1})
+	perm, temp := newTestAuth(), newTestTempAuth()
+	sess.RestoreAuthState(perm, FramerState{})
+
+	sess.bindTempKey(temp)
+	go sess.Run()
+	defer sess.Shutdown()
+
+	sent := waitSent(t, tr, 1)
+	bindMsgID, payload := decryptClientFrameWith(t, temp, sent[0])
+	o, err := Schema.ReadBoxedObject(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := o.(*TLAuthBindTempAuthKey)
+	if !ok {
+		t.Fatalf("sent %s, expected auth.bindTempAuthKey", tl.Name(o))
+	}
+	if msgID, _ := decryptBindMessage(t, perm, req.EncryptedMessage); msgID != bindMsgID {
+		t.Errorf("binding message msg_id %08x, request sent as %08x", msgID, bindMsgID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sess.WaitReadyContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("session ready before the key is bound: %v", err)
+	}
+
+	reply := &TLRPCResult{ReqMsgID: bindMsgID, Result: &TLBoolTrue{}}
+	tr.recvc <- formatServerMsg(temp, serverMsgID(time.Now()), 1, tl.Bytes(reply))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sess.WaitReadyContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if auth, _ := sess.AuthState(); auth != perm {
+		t.Errorf("AuthState returned key %016x, expected the permanent key", auth.KeyID)
+	}
+
+	go sess.Send(&TLHelpGetConfig{})
+	for n := 2; ; n++ {
+		sent := waitSent(t, tr, n)
+		_, payload := decryptClientFrameWith(t, temp, sent[n-1])
+		o, err := Schema.ReadBoxedObject(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoke, ok := o.(*TLInvokeWithLayer); ok {
+			if _, ok := invoke.Query.(*TLInitConnection); !ok {
+				t.Errorf("first request after binding not wrapped in initConnection")
+			}
+			break
+		}
+	}
+}
+
+// frameObjects decodes the messages in a frame sent with auth, unpacking
+// containers.
+func frameObjects(t *testing.T, auth *AuthResult, raw []byte) []tl.Object {
+	_, payload := decryptClientFrameWith(t, auth, raw)
+	o, err := Schema.ReadBoxedObject(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, ok := o.(*TLMsgContainer)
+	if !ok {
+		return []tl.Object{o}
+	}
+	var objs []tl.Object
+	for _, m := range container.Messages {
+		objs = append(objs, m.Body)
+	}
+	return objs
+}
+
+func TestSessionRenewalHoldsRequests(t *testing.T) {
+	for _, window := range []time.Duration{0, -1} {
+		// the session has been using a temporary key, and has just made
+		// a new one
+		tr := newFakeTransport()
+		sess := newTestSessionWithOptions(tr, SessionOptions{BatchWindow: window})
+		sess.options.TempKeyTTL = time.Hour
+		sess.permAuth = newTestAuth()
+		temp := newTestTempAuth()
+		sess.bindTempKey(temp)
+		go sess.Run()
+
+		sent := waitSent(t, tr, 1)
+		bindMsgID, _ := decryptClientFrameWith(t, temp, sent[0])
+		go sess.Send(&TLHelpGetConfig{})
+		time.Sleep(50 * time.Millisecond)
+		if n := len(waitSent(t, tr, 1)); n != 1 {
+			t.Fatalf("batch window %v: %d frames sent before the key is bound", window, n)
+		}
+
+		reply := &TLRPCResult{ReqMsgID: bindMsgID, Result: &TLBoolTrue{}}
+		tr.recvc <- formatServerMsg(temp, serverMsgID(time.Now()), 1, tl.Bytes(reply))
+
+		var objs []tl.Object
+	frames:
+		for n := 2; ; n++ {
+			sent := waitSent(t, tr, n)
+			for _, o := range frameObjects(t, temp, sent[n-1]) {
+				if _, ok := o.(*TLMsgsAck); ok {
+					continue
+				}
+				objs = append(objs, o)
+				if invoke, ok := o.(*TLInvokeWithLayer); ok {
+					o = invoke.Query.(*TLInitConnection).Query
+				}
+				if _, ok := o.(*TLHelpGetConfig); ok {
+					break frames
+				}
+			}
+		}
+		if invoke, ok := objs[0].(*TLInvokeWithLayer); !ok {
+			t.Errorf("batch window %v: first request after binding is %s, not wrapped in initConnection", window, tl.Name(objs[0]))
+		} else if _, ok := invoke.Query.(*TLInitConnection); !ok {
+			t.Errorf("batch window %v: first request after binding wraps %s", window, tl.Name(invoke.Query))
+		}
+		sess.Shutdown()
+	}
+}
+
+func TestSessionBindResyncsTime(t *testing.T) {
+	tr := newFakeTransport()
+	sess := NewSession(tr, SessionOptions{TempKeyTTL: time.Hour, BatchWindow: -1})
+	perm, temp := newTestAuth(), newTestTempAuth()
+	sess.RestoreAuthState(perm, FramerState{})
+	sess.bindTempKey(temp)
+	runDone := make(chan struct{})
+	go func() {
+		sess.Run()
+		close(runDone)
+	}()
+	defer sess.Shutdown()
+
+	// the first message from the server syncs the clock, and then the
+	// server clock turns out to be ahead
+	sent := waitSent(t, tr, 1)
+	bindMsgID, _ := decryptClientFrameWith(t, temp, sent[0])
+	serverNow := time.Now()
+	tr.recvc <- formatServerMsg(temp, serverMsgID(serverNow), 0, tl.Bytes(&TLMsgsAck{MsgIDs: []uint64{bindMsgID}}))
+	skewed := serverNow.Add(20 * time.Second)
+
+	for i := 0; i <= maxMsgResends; i++ {
+		bad := &TLBadMsgNotification{BadMsgID: bindMsgID, ErrorCode: 16}
+		tr.recvc <- formatServerMsg(temp, serverMsgID(skewed.Add(time.Duration(i)*time.Millisecond)), 0, tl.Bytes(bad))
+		if i == maxMsgResends {
+			break
+		}
+
+		sent := waitSent(t, tr, i+2)
+		var payload []byte
+		bindMsgID, payload = decryptClientFrameWith(t, temp, sent[i+1])
+		o, err := Schema.ReadBoxedObject(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, ok := o.(*TLAuthBindTempAuthKey)
+		if !ok {
+			t.Fatalf("sent %s, expected auth.bindTempAuthKey", tl.Name(o))
+		}
+		if msgID, _ := decryptBindMessage(t, perm, req.EncryptedMessage); msgID != bindMsgID {
+			t.Errorf("binding message msg_id %08x, request sent as %08x", msgID, bindMsgID)
+		}
+		if msgIDTime(bindMsgID).Before(skewed.Add(-time.Second)) {
+			t.Fatalf("bind request resent at %v, server time is %v", msgIDTime(bindMsgID), skewed)
+		}
+	}
+
+	select {
+	case <-runDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session still binding after the resends ran out")
+	}
+	if err := sess.Err(); !errors.Is(err, ErrTempKeyNotBound) {
+		t.Errorf("session failed with %v, expected ErrTempKeyNotBound", err)
+	}
+}
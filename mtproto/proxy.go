@@ -0,0 +1,212 @@
+package mtproto
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DialFunc opens a network connection, like net.Dial.
+type DialFunc func(network, address string) (net.Conn, error)
+
+var (
+	ErrProxyAuth        = errors.New("proxy authentication failed")
+	ErrProxyUnsupported = errors.New("unsupported proxy")
+)
+
+// ProxyDialer returns a DialFunc that connects through the proxy described by
+// proxyURL, either socks5://[user:password@]host:port or
+// http://[user:password@]host:port for HTTP CONNECT. The connection to the
+// proxy itself is made with forward, which defaults to net.Dial.
+func ProxyDialer(proxyURL string, forward DialFunc) (DialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if forward == nil {
+		forward = net.Dial
+	}
+
+	var dial func(c net.Conn, u *url.URL, address string) error
+	switch u.Scheme {
+	case "socks5":
+		dial = socks5Connect
+	case "http":
+		dial = httpConnect
+	default:
+		return nil, fmt.Errorf("%w scheme %q", ErrProxyUnsupported, u.Scheme)
+	}
+
+	return func(network, address string) (net.Conn, error) {
+		c, err := forward(network, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if err := dial(c, u, address); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+		}
+		return c, nil
+	}, nil
+}
+
+const (
+	socks5Version    = 5
+	socks5NoAuth     = 0
+	socks5UserPass   = 2
+	socks5CmdConnect = 1
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+)
+
+// socks5Connect performs the RFC 1928 handshake, with RFC 1929 username and
+// password authentication if u has them.
+func socks5Connect(c net.Conn, u *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socks5NoAuth}
+	if u.User != nil {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := c.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+	switch resp[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if u.User == nil {
+			return ErrProxyAuth
+		}
+		password, _ := u.User.Password()
+		username := u.User.Username()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		req := []byte{1, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return ErrProxyAuth
+		}
+	default:
+		return ErrProxyAuth
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		return fmt.Errorf("SOCKS5 connect failed with code %d", hdr[1])
+	}
+
+	// skip the bound address
+	var n int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		n = 4
+	case socks5AddrIPv6:
+		n = 16
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", hdr[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request, using basic
+// authentication if u has credentials.
+func httpConnect(c net.Conn, u *url.URL, address string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(c); err != nil {
+		return err
+	}
+
+	// the response is read byte by byte, so that no tunnel data gets buffered
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{c}, 16), req)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return ErrProxyAuth
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("HTTP CONNECT failed: %s", resp.Status)
+	}
+	return nil
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.r.Read(b)
+}
@@ -0,0 +1,155 @@
+package mtproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// listen accepts connections on a local port, handling each with handle.
+func listen(t *testing.T, handle func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func tunnel(c net.Conn, address string) {
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, c)
+	io.Copy(c, target)
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy accepting only user:secret.
+func fakeSOCKS5(c net.Conn) {
+	var buf [262]byte
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	io.ReadFull(c, buf[:buf[1]])
+	c.Write([]byte{5, socks5UserPass})
+
+	io.ReadFull(c, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(c, password)
+	if string(user) != "user" || string(password) != "secret" {
+		c.Write([]byte{1, 1})
+		return
+	}
+	c.Write([]byte{1, 0})
+
+	io.ReadFull(c, buf[:4])
+	if buf[3] != socks5AddrIPv4 {
+		c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	io.ReadFull(c, buf[:6])
+	address := net.JoinHostPort(net.IP(buf[:4]).String(), strconv.Itoa(int(buf[4])<<8|int(buf[5])))
+	c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	tunnel(c, address)
+}
+
+// fakeHTTPProxy is an HTTP CONNECT proxy accepting only user:secret.
+func fakeHTTPProxy(c net.Conn) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	tunnel(c, req.Host)
+}
+
+func TestProxyDialer(t *testing.T) {
+	echo := listen(t, func(c net.Conn) { io.Copy(c, c) })
+	socks := listen(t, fakeSOCKS5)
+	httpProxy := listen(t, fakeHTTPProxy)
+
+	for _, proxyURL := range []string{"socks5://user:secret@" + socks, "http://user:secret@" + httpProxy} {
+		dial, err := ProxyDialer(proxyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("%s: dial failed: %v", proxyURL, err)
+		}
+		c.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, []byte("hello")) {
+			t.Errorf("%s: read %q, %v through the tunnel", proxyURL, buf, err)
+		}
+		c.Close()
+	}
+
+	for _, proxyURL := range []string{"socks5://user:wrong@" + socks, "http://user:wrong@" + httpProxy} {
+		dial, _ := ProxyDialer(proxyURL, nil)
+		if _, err := dial("tcp", echo); !errors.Is(err, ErrProxyAuth) {
+			t.Errorf("%s: dial returned %v, expected %v", proxyURL, err, ErrProxyAuth)
+		}
+	}
+
+	if _, err := ProxyDialer("ftp://"+socks, nil); !errors.Is(err, ErrProxyUnsupported) {
+		t.Errorf("ProxyDialer with an ftp URL returned %v", err)
+	}
+}
+
+func TestDialTCPThroughProxy(t *testing.T) {
+	accepted := make(chan []byte, 1)
+	server := listen(t, func(c net.Conn) {
+		tr, err := AcceptTCP(c, TCPTransportOptions{})
+		if err != nil {
+			return
+		}
+		raw, _, _ := tr.Recv()
+		accepted <- raw
+	})
+	dial, err := ProxyDialer("socks5://user:secret@"+listen(t, fakeSOCKS5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := DialTCP(server, TCPTransportOptions{Mode: TCPIntermediate, Dial: dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	data := testPackets()[0]
+	if err := tr.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	if raw := <-accepted; !bytes.Equal(raw, data) {
+		t.Errorf("server received %x, expected %x", raw, data)
+	}
+}
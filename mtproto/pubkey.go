@@ -19,7 +19,10 @@ func ParsePublicKey(s string) (*rsa.PublicKey, error) {
 	if block == nil {
 		return nil, errors.New("failed to parse PEM block containing the public key")
 	}
+	return parsePublicKeyBlock(block)
+}
 
+func parsePublicKeyBlock(block *pem.Block) (*rsa.PublicKey, error) {
 	key := new(rsa.PublicKey)
 	_, err := asn1.Unmarshal(block.Bytes, key)
 	if err != nil {
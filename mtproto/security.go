@@ -0,0 +1,139 @@
+package mtproto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// Reasons for rejecting incoming messages, wrapped in a *SecurityError.
+var (
+	ErrMsgKeyMismatch    = errors.New("msg_key does not match the decrypted data")
+	ErrSessionIDMismatch = errors.New("session ID does not match")
+	ErrMsgIDParity       = errors.New("server msg_id is not odd")
+	ErrClientMsgIDParity = errors.New("client msg_id is not divisible by 4")
+	ErrMsgIDTooOld       = errors.New("msg_id is too old")
+	ErrMsgIDTooNew       = errors.New("msg_id is too far in the future")
+	ErrMsgIDReplay       = errors.New("msg_id has already been received")
+	ErrSeqNoParity       = errors.New("content message has an even seqno")
+	ErrInvalidLength     = errors.New("invalid message length")
+)
+
+// SecurityError is returned for incoming messages that fail the MTProto
+// security checks. Such messages must be ignored.
+type SecurityError struct {
+	MsgID  uint64
+	Reason error
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("rejected incoming message %08x: %v", e.MsgID, e.Reason)
+}
+
+func (e *SecurityError) Unwrap() error {
+	return e.Reason
+}
+
+// incoming msg_ids must be within this window around the server time
+const (
+	maxMsgIDAge    = 300 * time.Second
+	maxMsgIDFuture = 30 * time.Second
+)
+
+// number of recent msg_ids remembered to detect replays
+const replayWindowSize = 512
+
+// replayWindow remembers the largest recently received msg_ids. Messages
+// that have been seen before, or that are older than everything in a full
+// window, are considered replays.
+type replayWindow struct {
+	ids []uint64 // sorted
+}
+
+func (w *replayWindow) check(msgID uint64) error {
+	i := sort.Search(len(w.ids), func(i int) bool { return w.ids[i] >= msgID })
+	if i < len(w.ids) && w.ids[i] == msgID {
+		return ErrMsgIDReplay
+	}
+	if len(w.ids) >= replayWindowSize && i == 0 {
+		return ErrMsgIDReplay
+	}
+	return nil
+}
+
+func (w *replayWindow) add(msgID uint64) {
+	i := sort.Search(len(w.ids), func(i int) bool { return w.ids[i] >= msgID })
+	w.ids = append(w.ids, 0)
+	copy(w.ids[i+1:], w.ids[i:])
+	w.ids[i] = msgID
+	if len(w.ids) > replayWindowSize {
+		w.ids = w.ids[1:]
+	}
+}
+
+func msgIDTime(msgID uint64) time.Time {
+	return time.Unix(int64(msgID>>32), int64((msgID&0xFFFFFFFF)*1000000000>>32))
+}
+
+// checkMsgID validates the msg_id of a message received from the peer and
+// remembers it. On the client, the first message synchronizes the local clock
+// with the server's.
+func (fr *Framer) checkMsgID(msgID uint64) error {
+	if fr.Server {
+		if msgID&3 != 0 {
+			return ErrClientMsgIDParity
+		}
+	} else if msgID&1 == 0 {
+		return ErrMsgIDParity
+	}
+
+	now := fr.now()
+	t := msgIDTime(msgID)
+	if !fr.timeSynced && !fr.Server {
+		fr.timeOffset = t.Sub(now)
+		fr.timeSynced = true
+	} else if d := now.Add(fr.timeOffset).Sub(t); d > maxMsgIDAge {
+		return ErrMsgIDTooOld
+	} else if d < -maxMsgIDFuture {
+		return ErrMsgIDTooNew
+	}
+
+	if err := fr.seen.check(msgID); err != nil {
+		return err
+	}
+	fr.seen.add(msgID)
+	return nil
+}
+
+// CheckContainedMsg validates the msg_id and the seqno of a message unpacked
+// from a container.
+func (fr *Framer) CheckContainedMsg(msg *TLProtoMessage) error {
+	if isServerContentMsg(msg.Body) && msg.Seqno&1 == 0 {
+		return &SecurityError{msg.MsgID, ErrSeqNoParity}
+	}
+	if err := fr.checkMsgID(msg.MsgID); err != nil {
+		return &SecurityError{msg.MsgID, err}
+	}
+	return nil
+}
+
+// isServerContentMsg reports whether a message from the server is known to
+// require an acknowledgement, and so must have an odd seqno.
+func isServerContentMsg(o tl.Object) bool {
+	switch o.(type) {
+	case *TLRPCResult, *TLUpdates, *TLUpdatesCombined, *TLUpdateShort, *TLUpdateShortMessage, *TLUpdateShortChatMessage, *TLUpdateShortSentMessage, *TLUpdatesTooLong:
+		return true
+	default:
+		return false
+	}
+}
+
+func (fr *Framer) now() time.Time {
+	if fr.Now != nil {
+		return fr.Now()
+	}
+	return time.Now()
+}
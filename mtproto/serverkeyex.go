@@ -0,0 +1,336 @@
+package mtproto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// DefaultDHG is the generator ServerKeyEx uses with the Telegram prime.
+const DefaultDHG = 3
+
+var ErrUnknownPublicKey = errors.New("client chose a public key the server does not have")
+
+// ServerKeyEx is the server side of the auth key exchange. It answers
+// req_pq, req_DH_params and set_client_DH_params, in that order, until
+// Result returns the new key.
+type ServerKeyEx struct {
+	RandomReader io.Reader
+
+	// PrivateKeys are offered to the client by their fingerprints.
+	PrivateKeys []*rsa.PrivateKey
+
+	// G and DHPrime are the DH group; default to DefaultDHG and the prime
+	// Telegram servers use.
+	G       int
+	DHPrime *big.Int
+
+	// Now returns the server time; defaults to time.Now
+	Now func() time.Time
+
+	state keyExState
+	err   error
+
+	privKey     *rsa.PrivateKey
+	nonce       [16]byte
+	serverNonce [16]byte
+	newNonce    [32]byte
+	p, q        uint64
+	expiresIn   int
+
+	tmpAESKey [32]byte
+	tmpAESIV  [32]byte
+
+	a    *big.Int
+	auth AuthResult
+}
+
+func (kex *ServerKeyEx) Result() (*AuthResult, error) {
+	switch kex.state {
+	case KeyExDone:
+		return &kex.auth, nil
+	case KeyExFailed:
+		return nil, kex.err
+	default:
+		return nil, ErrKeyExchangeNotFinished
+	}
+}
+
+func (kex *ServerKeyEx) IsFinished() bool {
+	switch kex.state {
+	case KeyExDone, KeyExFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handle processes a message of the client and returns the reply to send.
+func (kex *ServerKeyEx) Handle(o tl.Object) (tl.Object, error) {
+	omsg, err := kex.handle(o)
+	if err != nil {
+		kex.state = KeyExFailed
+		kex.err = err
+	}
+	return omsg, err
+}
+
+func (kex *ServerKeyEx) handle(o tl.Object) (tl.Object, error) {
+	if kex.RandomReader == nil {
+		kex.RandomReader = rand.Reader
+	}
+
+	switch kex.state {
+	case KeyExInit:
+		switch o := o.(type) {
+		case *TLReqPQ:
+			return kex.handleReqPQ(o)
+		default:
+			return nil, ErrUnexpectedCommand
+		}
+
+	case KeyExReqPQ:
+		switch o := o.(type) {
+		case *TLReqDHParams:
+			return kex.handleReqDHParams(o)
+		default:
+			return nil, ErrUnexpectedCommand
+		}
+
+	case KeyExReqDHParams:
+		switch o := o.(type) {
+		case *TLSetClientDHParams:
+			return kex.handleSetClientDHParams(o)
+		default:
+			return nil, ErrUnexpectedCommand
+		}
+
+	case KeyExFailed:
+		return nil, ErrAfterKeyExchangeFailed
+
+	default:
+		return nil, ErrUnexpectedCommand
+	}
+}
+
+func (kex *ServerKeyEx) now() time.Time {
+	if kex.Now != nil {
+		return kex.Now()
+	}
+	return time.Now()
+}
+
+func (kex *ServerKeyEx) dhParams() (int, *big.Int) {
+	if kex.DHPrime != nil {
+		return kex.G, kex.DHPrime
+	}
+	return DefaultDHG, mustParseHexInt(telegramDHPrime)
+}
+
+func (kex *ServerKeyEx) handleReqPQ(in *TLReqPQ) (tl.Object, error) {
+	if len(kex.PrivateKeys) == 0 {
+		return nil, errors.New("no server private keys configured")
+	}
+
+	kex.nonce = in.Nonce
+	if _, err := io.ReadFull(kex.RandomReader, kex.serverNonce[:]); err != nil {
+		return nil, err
+	}
+
+	for kex.p == kex.q {
+		p, err := rand.Prime(kex.RandomReader, 31)
+		if err != nil {
+			return nil, err
+		}
+		q, err := rand.Prime(kex.RandomReader, 31)
+		if err != nil {
+			return nil, err
+		}
+		kex.p, kex.q = p.Uint64(), q.Uint64()
+	}
+	if kex.p > kex.q {
+		kex.p, kex.q = kex.q, kex.p
+	}
+
+	reply := &TLResPQ{
+		Nonce:       kex.nonce,
+		ServerNonce: kex.serverNonce,
+		PQ:          new(big.Int).SetUint64(kex.p * kex.q),
+	}
+	for _, key := range kex.PrivateKeys {
+		reply.ServerPublicKeyFingerprints = append(reply.ServerPublicKeyFingerprints, ComputePubKeyFingerprint(&key.PublicKey))
+	}
+
+	kex.state = KeyExReqPQ
+	return reply, nil
+}
+
+func (kex *ServerKeyEx) checkNonces(nonce, serverNonce []byte) error {
+	if 1 != subtle.ConstantTimeCompare(nonce, kex.nonce[:]) {
+		return errors.New("bad nonce")
+	}
+	if 1 != subtle.ConstantTimeCompare(serverNonce, kex.serverNonce[:]) {
+		return errors.New("bad server nonce")
+	}
+	return nil
+}
+
+func (kex *ServerKeyEx) handleReqDHParams(in *TLReqDHParams) (tl.Object, error) {
+	if err := kex.checkNonces(in.Nonce[:], in.ServerNonce[:]); err != nil {
+		return nil, err
+	}
+	for _, key := range kex.PrivateKeys {
+		if ComputePubKeyFingerprint(&key.PublicKey) == in.PublicKeyFingerprint {
+			kex.privKey = key
+		}
+	}
+	if kex.privKey == nil {
+		return nil, ErrUnknownPublicKey
+	}
+
+	inner, err := decryptRSAWithHash(in.EncryptedData, kex.privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var p, q *big.Int
+	var nonce, serverNonce [16]byte
+	switch inner := inner.(type) {
+	case *TLPQInnerData:
+		p, q, nonce, serverNonce, kex.newNonce = inner.P, inner.Q, inner.Nonce, inner.ServerNonce, inner.NewNonce
+	case *TLPQInnerDataTemp:
+		p, q, nonce, serverNonce, kex.newNonce = inner.P, inner.Q, inner.Nonce, inner.ServerNonce, inner.NewNonce
+		kex.expiresIn = inner.ExpiresIn
+	}
+	if err := kex.checkNonces(nonce[:], serverNonce[:]); err != nil {
+		return nil, err
+	}
+	if !p.IsUint64() || !q.IsUint64() || p.Uint64() != kex.p || q.Uint64() != kex.q || in.P.Cmp(p) != 0 || in.Q.Cmp(q) != 0 {
+		return nil, errors.New("wrong factorization of pq")
+	}
+
+	g, dhPrime := kex.dhParams()
+	ga := new(big.Int)
+	for {
+		var abytes [256]byte
+		if _, err := io.ReadFull(kex.RandomReader, abytes[:]); err != nil {
+			return nil, err
+		}
+		kex.a = new(big.Int).SetBytes(abytes[:])
+		ga.Exp(big.NewInt(int64(g)), kex.a, dhPrime)
+		if checkDHValue(ga, dhPrime) == nil {
+			break
+		}
+	}
+
+	now := kex.now()
+	answer := &TLServerDHInnerData{
+		Nonce:       kex.nonce,
+		ServerNonce: kex.serverNonce,
+		G:           g,
+		DHPrime:     dhPrime,
+		GA:          ga,
+		ServerTime:  now,
+	}
+	if kex.expiresIn > 0 {
+		kex.auth.ExpiresAt = int(now.Unix()) + kex.expiresIn
+	}
+
+	deriveTempAESKey(kex.serverNonce[:], kex.newNonce[:], kex.tmpAESKey[:], kex.tmpAESIV[:])
+	encrypted, err := AESIGEPadEncryptWithHash(nil, tl.Bytes(answer), kex.tmpAESKey[:], kex.tmpAESIV[:], kex.RandomReader)
+	if err != nil {
+		return nil, err
+	}
+
+	kex.state = KeyExReqDHParams
+	return &TLServerDHParamsOK{
+		Nonce:           kex.nonce,
+		ServerNonce:     kex.serverNonce,
+		EncryptedAnswer: encrypted,
+	}, nil
+}
+
+// decryptRSAWithHash reverses EncryptRSAWithHash and decodes the
+// p_q_inner_data it contains.
+func decryptRSAWithHash(data []byte, key *rsa.PrivateKey) (tl.Object, error) {
+	c := new(big.Int).SetBytes(data)
+	if c.Cmp(key.N) >= 0 {
+		return nil, errors.New("invalid RSA encrypted data")
+	}
+	m := new(big.Int).Exp(c, key.D, key.N).Bytes()
+	if len(m) > rsaBlockLen-1 {
+		return nil, errors.New("invalid RSA encrypted data")
+	}
+	m = leftZeroPad(m, rsaBlockLen-1)
+
+	r := tl.NewReader(m[sha1.Size:])
+	inner := Schema.ReadLimitedBoxedObjectFrom(r, TagPQInnerData, TagPQInnerDataTemp)
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	innerLen := len(m) - sha1.Size - len(r.ReadToEnd())
+	if h := sha1.Sum(m[sha1.Size : sha1.Size+innerLen]); 1 != subtle.ConstantTimeCompare(h[:], m[:sha1.Size]) {
+		return nil, ErrHashMismatch
+	}
+	return inner, nil
+}
+
+func (kex *ServerKeyEx) handleSetClientDHParams(in *TLSetClientDHParams) (tl.Object, error) {
+	if err := kex.checkNonces(in.Nonce[:], in.ServerNonce[:]); err != nil {
+		return nil, err
+	}
+
+	data, hash, err := AESIGEDecryptWithHash(nil, in.EncryptedData, kex.tmpAESKey[:], kex.tmpAESIV[:])
+	if err != nil {
+		return nil, err
+	}
+	r := tl.NewReader(data)
+	o := Schema.ReadLimitedBoxedObjectFrom(r, TagClientDHInnerData)
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	padding := r.ReadToEnd()
+	if len(padding) >= 16 {
+		return nil, ErrHashMismatch
+	}
+	if h := sha1.Sum(data[:len(data)-len(padding)]); 1 != subtle.ConstantTimeCompare(h[:], hash) {
+		return nil, ErrHashMismatch
+	}
+	inner := o.(*TLClientDHInnerData)
+	if err := kex.checkNonces(inner.Nonce[:], inner.ServerNonce[:]); err != nil {
+		return nil, err
+	}
+	// dh_gen_retry is never sent, so the client has nothing to retry
+	if inner.RetryID != 0 {
+		return nil, errors.New("bad retry_id")
+	}
+
+	_, dhPrime := kex.dhParams()
+	if err := checkDHValue(inner.GB, dhPrime); err != nil {
+		return nil, err
+	}
+
+	gab := new(big.Int).Exp(inner.GB, kex.a, dhPrime)
+	kex.auth.Key = leftZeroPad(gab.Bytes(), 256)
+	authKeyHash := sha1.Sum(kex.auth.Key)
+	kex.auth.KeyID = binints.DecodeUint64LE(authKeyHash[12:])
+	authKeyAuxHash := binints.DecodeUint64LE(authKeyHash[:8])
+	for i := 0; i < 8; i++ {
+		kex.auth.ServerSalt[i] = kex.newNonce[i] ^ kex.serverNonce[i]
+	}
+
+	kex.state = KeyExDone
+	return &TLDHGenOK{
+		Nonce:         kex.nonce,
+		ServerNonce:   kex.serverNonce,
+		NewNonceHash1: newNonceHash(kex.newNonce[:], 1, authKeyAuxHash),
+	}, nil
+}
@@ -0,0 +1,73 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// runKeyExchange passes the messages of a client and a server key exchange
+// to each other until both are done.
+func runKeyExchange(t *testing.T, client *KeyEx, server *ServerKeyEx) {
+	var o tl.Object = client.Start()
+	for !client.IsFinished() {
+		reply, err := server.Handle(o)
+		if err != nil {
+			t.Fatalf("server failed to handle %T: %v", o, err)
+		}
+		o, err = client.Handle(reply)
+		if err != nil {
+			t.Fatalf("client failed to handle %T: %v", reply, err)
+		}
+	}
+	if !server.IsFinished() {
+		t.Fatal("client finished before the server")
+	}
+}
+
+func TestServerKeyExchange(t *testing.T) {
+	keys := make([]*rsa.PrivateKey, 2)
+	for i := range keys {
+		var err error
+		keys[i], err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Unix(1500000000, 0)
+
+	for _, expiresIn := range []int{0, 3600} {
+		client := &KeyEx{PubKey: &keys[1].PublicKey, ExpiresIn: expiresIn}
+		server := &ServerKeyEx{PrivateKeys: keys, Now: func() time.Time { return now }}
+		runKeyExchange(t, client, server)
+
+		cauth, err := client.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sauth, err := server.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cauth.Key, sauth.Key) || cauth.KeyID != sauth.KeyID || cauth.ServerSalt != sauth.ServerSalt {
+			t.Errorf("client and server disagree on the key: %x/%x", cauth.KeyID, sauth.KeyID)
+		}
+		if expected := int(now.Unix()) + expiresIn; expiresIn != 0 && (sauth.ExpiresAt != expected || cauth.ExpiresAt != expected) {
+			t.Errorf("temporary key expires at %d (client %d), expected %d", sauth.ExpiresAt, cauth.ExpiresAt, expected)
+		}
+	}
+}
+
+func TestServerKeyExchangeOrder(t *testing.T) {
+	server := &ServerKeyEx{}
+	if _, err := server.Handle(&TLSetClientDHParams{}); err != ErrUnexpectedCommand {
+		t.Errorf("set_client_DH_params before req_pq: %v", err)
+	}
+	if _, err := server.Handle(&TLReqPQ{}); err != ErrAfterKeyExchangeFailed {
+		t.Errorf("req_pq after a failure: %v", err)
+	}
+}
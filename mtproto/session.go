@@ -2,6 +2,7 @@ package mtproto
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
@@ -11,7 +12,9 @@ import (
 	"github.com/PROger4ever/telegramapi/tl/knownschemas"
 	"io"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/PROger4ever/telegramapi/tl"
 )
@@ -30,8 +33,93 @@ type SessionOptions struct {
 	AppID   string
 	APIHash string
 	Verbose int
+
+	// PublicKeys are server keys to pick from, in addition to PubKey, by the
+	// fingerprints the server offers.
+	PublicKeys *PublicKeyRing
+
+	// Dial, if set, is used to reconnect when the transport fails. The auth
+	// key and the session ID are kept, and unacknowledged requests are resent
+	// over the new connection.
+	Dial func() (Transport, error)
+
+	// MaxReconnectAttempts is the number of consecutive reconnect attempts
+	// after which the session fails; defaults to DefaultMaxReconnectAttempts.
+	MaxReconnectAttempts int
+
+	// PingInterval is how often ping_delay_disconnect is sent to keep the
+	// connection alive; defaults to DefaultPingInterval. A negative value
+	// disables keepalive.
+	PingInterval time.Duration
+
+	// IdleTimeout is how long the connection may stay silent before it is
+	// considered dead and, if Dial is set, reestablished; defaults to
+	// DefaultIdleTimeout. The server is asked to drop the connection after
+	// the same delay without pings.
+	IdleTimeout time.Duration
+
+	// ProtocolVersion is the MTProto version used for encrypted messages;
+	// defaults to DefaultProtocolVersion.
+	ProtocolVersion ProtocolVersion
+
+	// BatchWindow is how long outgoing messages and acks are held back to be
+	// packed into a single container; defaults to DefaultBatchWindow. A
+	// negative value disables batching.
+	BatchWindow time.Duration
+
+	// TempKeyTTL enables perfect forward secrecy: messages are encrypted with
+	// temporary auth keys of this lifetime, which are bound to the permanent
+	// key with auth.bindTempAuthKey and replaced before they expire. The
+	// permanent key is then only used for binding.
+	TempKeyTTL time.Duration
 }
 
+const DefaultBatchWindow = 5 * time.Millisecond
+
+const (
+	DefaultPingInterval = 60 * time.Second
+	DefaultIdleTimeout  = 75 * time.Second
+)
+
+// ErrConnectionDead is reported when nothing has been received for longer
+// than SessionOptions.IdleTimeout.
+var ErrConnectionDead = errors.New("connection is dead: no data received within idle timeout")
+
+// future salts are requested when the cached ones run out within
+// saltRefreshMargin; this is checked every saltCheckInterval
+const (
+	futureSaltsCount  = 32
+	saltRefreshMargin = time.Hour
+	saltCheckInterval = 10 * time.Minute
+)
+
+// limits on the number and the total size of messages in a msg_container
+const (
+	maxContainerMessages = 1020
+	maxContainerSize     = 1 << 20
+	maxAcksPerMsg        = 8192
+
+	// msg_id, seqno and bytes fields of a message in a container
+	protoMessageOverhead = 16
+)
+
+const DefaultMaxReconnectAttempts = 5
+
+// how many times a request is resent after the server rejects it for a bad
+// salt, msg_id or seqno, before the caller gets ErrInvalidMsg
+const maxMsgResends = 5
+
+// a new temporary key is created when this fraction of the lifetime of the
+// current one is left
+const tempKeyRenewFraction = 4
+
+// the delay before the 2nd reconnect attempt; it doubles with every further
+// attempt, up to reconnectMaxDelay
+const (
+	reconnectMinDelay = 250 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
 type Handler func(msgID uint64, o tl.Object) ([]tl.Object, error)
 
 var ErrCmdNotHandled = errors.New("not handled")
@@ -40,6 +128,24 @@ var ErrReconnectRequired = errors.New("reconnect required")
 
 var ErrInvalidMsg = errors.New("invalid message")
 
+// SessionClosedError is returned to pending RPC calls when Session.Run exits
+// before a reply has been received. Err is the error the session failed with,
+// or nil if the session has been shut down.
+type SessionClosedError struct {
+	Err error
+}
+
+func (e *SessionClosedError) Error() string {
+	if e.Err == nil {
+		return "session closed"
+	}
+	return fmt.Sprintf("session closed: %v", e.Err)
+}
+
+func (e *SessionClosedError) Unwrap() error {
+	return e.Err
+}
+
 type Session struct {
 	options   SessionOptions
 	transport Transport
@@ -51,9 +157,43 @@ type Session struct {
 	connInitSent  bool
 	inFlight      map[uint64]*rpcInFlight
 
+	// consecutive reconnect attempts without receiving anything
+	reconnectAttempts int
+	// set when sending fails, until the listener notices the broken connection
+	broken bool
+
+	// when get_future_salts has last been sent, if the reply is still awaited
+	saltsRequested time.Time
+
+	// keepalive state
+	lastRecv   time.Time
+	lastPing   time.Time
+	pingID     uint64
+	pingSentAt time.Time
+	rtt        time.Duration // guarded by stateMut
+
+	// messages and acks waiting to be sent in the next batch
+	outbox      []queuedMsg
+	outboxSize  int
+	pendingAcks []uint64
+	flushTimer  *time.Timer
+	flushc      <-chan time.Time
+
+	// perfect forward secrecy: the permanent key, the temporary key being
+	// bound, the msg_id of the bind request and how many times the server
+	// has rejected it, and when to replace the key
+	permAuth    *AuthResult // guarded by stateMut
+	bindAuth    *AuthResult
+	bindMsgID   uint64
+	bindResends int
+	renewTimer  *time.Timer
+	renewc      <-chan time.Time
+
 	failc  chan error
 	sendc  chan outgoingMsg
 	closec chan struct{}
+	donec  chan struct{}
+	readyc chan struct{}
 	// eventc chan uint32
 	closing bool
 
@@ -64,6 +204,7 @@ type Session struct {
 	dc int
 
 	onstatechanged func()
+	onupdates      func(o tl.Object)
 
 	err error
 }
@@ -71,6 +212,9 @@ type Session struct {
 type outgoingMsg struct {
 	Obj   tl.Object
 	Reply chan<- reply
+
+	// Cancel asks to forget the pending RPC with this Reply channel
+	Cancel bool
 }
 
 type reply struct {
@@ -80,23 +224,40 @@ type reply struct {
 
 type rpcInFlight struct {
 	MsgID uint64
+	Obj   tl.Object
 	Reply chan<- reply
+
+	// the server has acknowledged receiving the request, so there is no need
+	// to resend it after reconnecting
+	Acked bool
+
+	// msg_id of the container the request has been sent in, if any
+	Container uint64
+
+	// how many times the server has rejected the request
+	Resends int
+}
+
+type queuedMsg struct {
+	Obj     tl.Object
+	Msg     Msg
+	Reply   chan<- reply
+	Resends int
 }
 
 func NewSession(transport Transport, options SessionOptions) *Session {
 	s := &Session{
 		options:   options,
 		transport: transport,
-		framer:    &Framer{},
-		keyex: &KeyEx{
-			PubKey: options.PubKey,
-		},
+		framer:    &Framer{Version: options.ProtocolVersion},
 
 		inFlight: make(map[uint64]*rpcInFlight),
 
 		failc:  make(chan error, 1),
 		sendc:  make(chan outgoingMsg, 1),
 		closec: make(chan struct{}),
+		donec:  make(chan struct{}),
+		readyc: make(chan struct{}),
 		// eventc: make(chan uint32, 10),
 	}
 	s.stateCond = sync.NewCond(&s.stateMut)
@@ -111,6 +272,14 @@ func (sess *Session) OnStateChanged(f func()) {
 	sess.onstatechanged = f
 }
 
+// OnUpdates registers a function to be called for every Updates object pushed
+// by the server. It is invoked on the session goroutine and must not block.
+func (sess *Session) OnUpdates(f func(o tl.Object)) {
+	sess.stateMut.Lock()
+	defer sess.stateMut.Unlock()
+	sess.onupdates = f
+}
+
 func (sess *Session) DC() int {
 	sess.stateMut.Lock()
 	defer sess.stateMut.Unlock()
@@ -141,6 +310,24 @@ func (sess *Session) WaitReady() {
 	}
 }
 
+// WaitReadyContext is like WaitReady, but also returns when ctx is done or
+// the session stops running.
+func (sess *Session) WaitReadyContext(ctx context.Context) error {
+	select {
+	case <-sess.readyc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sess.donec:
+		return &SessionClosedError{sess.err}
+	}
+}
+
+// Done returns a channel that is closed when Run exits.
+func (sess *Session) Done() <-chan struct{} {
+	return sess.donec
+}
+
 func (sess *Session) RunJob(f func() error) {
 	go func() {
 		sess.WaitReady()
@@ -152,10 +339,39 @@ func (sess *Session) RunJob(f func() error) {
 }
 
 func (sess *Session) Send(o tl.Object) (tl.Object, error) {
-	replyc := make(chan reply)
-	sess.sendc <- outgoingMsg{o, replyc}
-	reply := <-replyc
-	return reply.Obj, reply.Err
+	return sess.SendContext(context.Background(), o)
+}
+
+// SendContext sends an RPC call and waits for the reply. It gives up when ctx
+// is done, returning ctx.Err(), and returns a *SessionClosedError if the
+// session stops running before the reply arrives.
+func (sess *Session) SendContext(ctx context.Context, o tl.Object) (tl.Object, error) {
+	replyc := make(chan reply, 1)
+	select {
+	case sess.sendc <- outgoingMsg{Obj: o, Reply: replyc}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-sess.donec:
+		return nil, &SessionClosedError{sess.err}
+	}
+
+	select {
+	case reply := <-replyc:
+		return reply.Obj, reply.Err
+	case <-ctx.Done():
+		select {
+		case sess.sendc <- outgoingMsg{Reply: replyc, Cancel: true}:
+		case <-sess.donec:
+		}
+		return nil, ctx.Err()
+	case <-sess.donec:
+		select {
+		case reply := <-replyc:
+			return reply.Obj, reply.Err
+		default:
+			return nil, &SessionClosedError{sess.err}
+		}
+	}
 }
 
 func (sess *Session) Err() error {
@@ -167,17 +383,29 @@ func (sess *Session) Err() error {
 // }
 
 func (sess *Session) Run() {
-	incomingc := make(chan []byte, 1)
-
-	go sess.listen(incomingc)
+	incomingc, connerrc := sess.startListening()
 
 	if sess.options.Verbose >= 3 {
 		log.Printf("mtproto.Session running...")
 	}
 
-	if !sess.connKeyExDone {
+	if sess.connKeyExDone {
+		sess.checkSalts()
+	} else if sess.bindAuth == nil {
 		sess.startKeyEx()
 	}
+	defer sess.stopRenewal()
+
+	saltTicker := time.NewTicker(saltCheckInterval)
+	defer saltTicker.Stop()
+
+	sess.lastRecv = time.Now()
+	var keepalivec <-chan time.Time
+	if tick := sess.keepaliveTick(); tick > 0 {
+		keepaliveTicker := time.NewTicker(tick)
+		defer keepaliveTicker.Stop()
+		keepalivec = keepaliveTicker.C
+	}
 
 loop:
 	for sess.err == nil {
@@ -185,14 +413,49 @@ loop:
 		case raw, ok := <-incomingc:
 			if ok {
 				sess.handle(raw)
-			} else {
-				if sess.options.Verbose >= 3 {
-					log.Printf("mtproto.Session incoming closed")
+				continue
+			}
+			err := <-connerrc
+			if sess.options.Verbose >= 3 {
+				log.Printf("mtproto.Session incoming closed")
+			}
+			if sess.closing || sess.options.Dial == nil {
+				if err != nil && !sess.closing {
+					sess.failInternal(err)
 				}
 				break loop
 			}
+			if err == nil {
+				err = io.EOF
+			}
+			if !sess.reconnect(err) {
+				break loop
+			}
+			incomingc, connerrc = sess.startListening()
+			sess.saltsRequested = time.Time{}
+			sess.lastRecv = time.Now()
+			sess.lastPing = time.Time{}
+			sess.resumeAfterReconnect()
 		case msg := <-sess.sendc:
-			sess.sendInternal(msg.Obj, msg.Reply)
+			if msg.Cancel {
+				sess.cancelPendingRPC(msg.Reply)
+			} else {
+				sess.sendInternal(msg.Obj, msg.Reply)
+			}
+		case <-saltTicker.C:
+			sess.checkSalts()
+		case <-keepalivec:
+			sess.keepalive()
+		case <-sess.pollc():
+			sess.poll()
+		case <-sess.renewc:
+			sess.renewTimer = nil
+			sess.renewc = nil
+			sess.startKeyEx()
+		case <-sess.flushc:
+			sess.flushTimer = nil
+			sess.flushc = nil
+			sess.flush()
 		case err := <-sess.failc:
 			sess.failInternal(err)
 			// case pseudocmd := <-sess.eventc:
@@ -208,14 +471,50 @@ loop:
 	if sess.options.Verbose >= 2 {
 		log.Printf("mtproto.Session quitting, err: %v", sess.err)
 	}
+	if !sess.closing {
+		sess.closing = true
+		sess.transport.Close()
+	}
+
+	sess.releasePendingRPCs()
+	close(sess.donec)
 }
 
-func (sess *Session) listen(incomingc chan<- []byte) {
+// pollc returns the channel signalling that a PollingTransport needs an
+// http_wait, or nil for other transports and during the key exchange.
+func (sess *Session) pollc() <-chan struct{} {
+	if tr, ok := sess.transport.(PollingTransport); ok && sess.connKeyExDone {
+		return tr.Idle()
+	}
+	return nil
+}
+
+// poll gives the server a request to respond to once it has messages for us.
+func (sess *Session) poll() {
+	wait := &TLHttpWait{
+		MaxDelay:  0,
+		WaitAfter: 0,
+		MaxWait:   int(httpWaitMax / time.Millisecond),
+	}
+	sess.transmit(wait, nil)
+}
+
+func (sess *Session) startListening() (<-chan []byte, <-chan error) {
+	incomingc := make(chan []byte, 1)
+	connerrc := make(chan error, 1)
+	go sess.listen(sess.transport, incomingc, connerrc)
+	return incomingc, connerrc
+}
+
+// listen reads from the transport until it fails, then reports the error
+// (nil on EOF) to connerrc and closes incomingc.
+func (sess *Session) listen(tr Transport, incomingc chan<- []byte, connerrc chan<- error) {
 	if sess.options.Verbose >= 3 {
 		log.Printf("mtproto.Session listening...")
 	}
+	var connerr error
 	for {
-		raw, errcode, err := sess.transport.Recv()
+		raw, errcode, err := tr.Recv()
 		if err == io.EOF {
 			if sess.options.Verbose >= 2 {
 				log.Printf("mtproto.Session Recv'd EOF")
@@ -225,13 +524,13 @@ func (sess *Session) listen(incomingc chan<- []byte) {
 			if sess.options.Verbose >= 1 {
 				log.Printf("mtproto.Session Recv failed: %v", err)
 			}
-			sess.failc <- err
+			connerr = err
 			break
 		} else if raw == nil && errcode != 0 {
 			if sess.options.Verbose >= 1 {
 				log.Printf("mtproto.Session Recv returned error code %v", errcode)
 			}
-			sess.failc <- fmt.Errorf("error code %v", errcode)
+			connerr = fmt.Errorf("error code %v", errcode)
 			break
 		}
 		// if sess.options.Verbose >= 2 {
@@ -240,14 +539,136 @@ func (sess *Session) listen(incomingc chan<- []byte) {
 
 		incomingc <- raw
 	}
+	connerrc <- connerr
 	close(incomingc)
 }
 
+// reconnect dials a new transport, waiting between attempts. It returns false
+// if the session has been shut down or has run out of attempts meanwhile.
+func (sess *Session) reconnect(cause error) bool {
+	max := sess.options.MaxReconnectAttempts
+	if max <= 0 {
+		max = DefaultMaxReconnectAttempts
+	}
+
+	for {
+		if sess.reconnectAttempts >= max {
+			sess.failInternal(fmt.Errorf("giving up after %d reconnect attempts: %w", sess.reconnectAttempts, cause))
+			return false
+		}
+
+		if delay := reconnectDelay(sess.reconnectAttempts); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-sess.closec:
+				timer.Stop()
+				sess.closing = true
+				return false
+			}
+		}
+
+		sess.reconnectAttempts++
+		if sess.options.Verbose >= 1 {
+			log.Printf("mtproto.Session reconnecting (attempt %d) after: %v", sess.reconnectAttempts, cause)
+		}
+		tr, err := sess.options.Dial()
+		if err != nil {
+			cause = err
+			continue
+		}
+
+		sess.transport = tr
+		sess.broken = false
+		return true
+	}
+}
+
+func reconnectDelay(attempt int) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+	delay := reconnectMinDelay
+	for i := 1; i < attempt && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return delay
+}
+
+// resumeAfterReconnect restarts an interrupted key exchange or binding, and
+// resends the requests that the server might not have received.
+func (sess *Session) resumeAfterReconnect() {
+	switch {
+	case sess.bindAuth != nil:
+		sess.sendBind()
+	case sess.keyex != nil:
+		sess.startKeyEx()
+	}
+	if !sess.connKeyExDone {
+		return
+	}
+
+	var pending []*rpcInFlight
+	for _, infl := range sess.inFlight {
+		if !infl.Acked {
+			pending = append(pending, infl)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].MsgID < pending[j].MsgID
+	})
+	for _, infl := range pending {
+		sess.resend(infl)
+	}
+}
+
+// resendMsg resends the pending request with the given msg_id, or all the
+// pending requests sent in the container with this msg_id, after the server
+// has rejected it. Requests rejected too many times fail with ErrInvalidMsg.
+func (sess *Session) resendMsg(msgID uint64) {
+	var pending []*rpcInFlight
+	if infl := sess.inFlight[msgID]; infl != nil {
+		pending = append(pending, infl)
+	} else {
+		for _, infl := range sess.inFlight {
+			if infl.Container == msgID {
+				pending = append(pending, infl)
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].MsgID < pending[j].MsgID
+	})
+	for _, infl := range pending {
+		if infl.Resends >= maxMsgResends {
+			sess.finishPendingRPC(infl.MsgID, nil, ErrInvalidMsg)
+			continue
+		}
+		infl.Resends++
+		sess.resend(infl)
+	}
+}
+
+// resend sends a pending request again under a new msg_id.
+func (sess *Session) resend(infl *rpcInFlight) {
+	delete(sess.inFlight, infl.MsgID)
+	if sess.options.Verbose >= 2 {
+		log.Printf("mtproto.Session resending %s (was msgID %08x)", tl.Name(infl.Obj), infl.MsgID)
+	}
+	sess.transmitMsg(queuedMsg{Obj: infl.Obj, Msg: MsgFromObj(infl.Obj), Reply: infl.Reply, Resends: infl.Resends})
+}
+
 func (sess *Session) Fail(err error) {
 	if err == nil {
 		panic("Fail(nil)")
 	}
-	sess.failc <- err
+	select {
+	case sess.failc <- err:
+	case <-sess.donec:
+	}
 }
 
 func (sess *Session) failInternal(err error) {
@@ -265,34 +686,185 @@ func (sess *Session) failInternal(err error) {
 
 func (sess *Session) sendInternal(o tl.Object, replyc chan<- reply) {
 	if sess.err != nil {
+		if replyc != nil {
+			replyc <- reply{nil, &SessionClosedError{sess.err}}
+		}
 		return
 	}
 
-	if sess.connKeyExDone && !sess.connInitSent {
-		o = &TLInvokeWithLayer{
-			Layer: knownschemas.TelegramLayer,
-			Query: &TLInitConnection{
-				APIID:         88766,
-				DeviceModel:   "Mac",
-				SystemVersion: "10.11",
-				AppVersion:    "0.1",
-				LangCode:      "en",
-				Query:         o,
-			},
+	if sess.connKeyExDone && !sess.connInitSent && !IsKeyExMsg(o) {
+		o = sess.initConnection(o)
+	}
+
+	sess.transmit(o, replyc)
+}
+
+// initConnection wraps the first request sent with a key, which has to
+// introduce the client.
+func (sess *Session) initConnection(o tl.Object) tl.Object {
+	sess.connInitSent = true
+	return &TLInvokeWithLayer{
+		Layer: knownschemas.TelegramLayer,
+		Query: &TLInitConnection{
+			APIID:         88766,
+			DeviceModel:   "Mac",
+			SystemVersion: "10.11",
+			AppVersion:    "0.1",
+			LangCode:      "en",
+			Query:         o,
+		},
+	}
+}
+
+// transmit queues a message to be sent with the next batch, registering a
+// pending RPC if replyc is not nil. Messages are sent right away during the
+// key exchange, or if batching is disabled, but are held while a new
+// temporary key is being bound.
+func (sess *Session) transmit(o tl.Object, replyc chan<- reply) {
+	sess.transmitMsg(queuedMsg{Obj: o, Msg: MsgFromObj(o), Reply: replyc})
+}
+
+// transmitMsg is transmit for a message that may have been sent before.
+func (sess *Session) transmitMsg(m queuedMsg) {
+	if IsKeyExMsg(m.Obj) {
+		sess.transmitNow(m)
+		return
+	}
+	if sess.bindAuth != nil {
+		sess.outbox = append(sess.outbox, m)
+		sess.outboxSize += len(m.Msg.Payload) + protoMessageOverhead
+		return
+	}
+	if !sess.connKeyExDone || sess.options.BatchWindow < 0 {
+		sess.transmitNow(m)
+		return
+	}
+
+	sess.outbox = append(sess.outbox, m)
+	sess.outboxSize += len(m.Msg.Payload) + protoMessageOverhead
+	if len(sess.outbox) >= maxContainerMessages || sess.outboxSize >= maxContainerSize {
+		sess.flush()
+	} else {
+		sess.scheduleFlush()
+	}
+}
+
+func (sess *Session) scheduleFlush() {
+	if sess.flushTimer != nil {
+		return
+	}
+	window := sess.options.BatchWindow
+	if window == 0 {
+		window = DefaultBatchWindow
+	}
+	sess.flushTimer = time.NewTimer(window)
+	sess.flushc = sess.flushTimer.C
+}
+
+// flush sends the queued messages and acks, packing them into containers
+// when there is more than one.
+func (sess *Session) flush() {
+	if sess.flushTimer != nil {
+		sess.flushTimer.Stop()
+		sess.flushTimer = nil
+		sess.flushc = nil
+	}
+
+	var msgs []queuedMsg
+	binding := sess.bindAuth != nil
+	for len(sess.pendingAcks) > 0 {
+		n := len(sess.pendingAcks)
+		if n > maxAcksPerMsg {
+			n = maxAcksPerMsg
 		}
-		sess.connInitSent = true
+		ack := &TLMsgsAck{MsgIDs: sess.pendingAcks[:n]}
+		msgs = append(msgs, queuedMsg{Obj: ack, Msg: MsgFromObj(ack)})
+		sess.pendingAcks = sess.pendingAcks[n:]
+	}
+	sess.pendingAcks = nil
+	// requests wait until the new temporary key is bound
+	if !binding {
+		msgs = append(msgs, sess.outbox...)
+		sess.outbox = nil
+		sess.outboxSize = 0
 	}
 
-	msg := MsgFromObj(o)
+	for len(msgs) > 0 {
+		n, size := 0, 0
+		for n < len(msgs) && n < maxContainerMessages {
+			size += len(msgs[n].Msg.Payload) + protoMessageOverhead
+			if n > 0 && size > maxContainerSize {
+				break
+			}
+			n++
+		}
+
+		if n == 1 {
+			sess.transmitNow(msgs[0])
+		} else {
+			sess.transmitContainer(msgs[:n])
+		}
+		if sess.err != nil {
+			return
+		}
+		msgs = msgs[n:]
+	}
+}
 
-	// if sess.options.Verbose >= 2 {
-	// 	log.Printf("mtproto.Session sending %s (%v bytes, %v)", o, len(msg.Payload), msg.Type)
-	// } else if sess.options.Verbose >= 1 {
-	// 	log.Printf("mtproto.Session sending %s (%v bytes, %v)", tl.Name(o), len(msg.Payload), msg.Type)
-	// }
+// transmitContainer sends several messages packed into a msg_container.
+func (sess *Session) transmitContainer(msgs []queuedMsg) {
+	container := &TLMsgContainer{
+		Messages: make([]*TLProtoMessage, len(msgs)),
+	}
 
 	sess.stateMut.Lock()
-	raw, msgID, err := sess.framer.Format(msg)
+	for i, m := range msgs {
+		container.Messages[i] = &TLProtoMessage{
+			MsgID: sess.framer.NextMsgID(),
+			Seqno: int(sess.framer.NextSeqNo(m.Msg.Type)),
+			Bytes: len(m.Msg.Payload),
+			Body:  m.Obj,
+		}
+	}
+	raw, containerID, err := sess.framer.Format(MsgFromObj(container))
+	sess.stateMut.Unlock()
+	if err != nil {
+		sess.failInternal(err)
+		return
+	}
+
+	if sess.options.Verbose >= 1 {
+		log.Printf("mtproto.Session sending container of %d messages (msgID %08x)", len(msgs), containerID)
+	}
+	for i, m := range msgs {
+		msgID := container.Messages[i].MsgID
+		if sess.options.Verbose >= 2 {
+			log.Printf("mtproto.Session sending %s (%v bytes, %v, msgID %08x)", m.Obj, len(m.Msg.Payload), m.Msg.Type, msgID)
+		} else if sess.options.Verbose >= 1 {
+			log.Printf("mtproto.Session sending %s (%v bytes, %v, msgID %08x)", tl.Name(m.Obj), len(m.Msg.Payload), m.Msg.Type, msgID)
+		}
+		if m.Reply != nil {
+			sess.startPendingRPC(msgID, m)
+			sess.inFlight[msgID].Container = containerID
+		}
+	}
+
+	sess.send(raw)
+}
+
+// transmitNow formats and sends a single message.
+func (sess *Session) transmitNow(m queuedMsg) {
+	o, msg, replyc := m.Obj, m.Msg, m.Reply
+
+	sess.stateMut.Lock()
+	var raw []byte
+	var msgID uint64
+	var err error
+	if IsKeyExMsg(o) {
+		raw, msgID, err = sess.framer.FormatUnencrypted(msg)
+	} else {
+		raw, msgID, err = sess.framer.Format(msg)
+	}
 	sess.stateMut.Unlock()
 	if err != nil {
 		sess.failInternal(err)
@@ -306,22 +878,43 @@ func (sess *Session) sendInternal(o tl.Object, replyc chan<- reply) {
 	}
 
 	if replyc != nil {
-		sess.startPendingRPC(msgID, replyc)
+		sess.startPendingRPC(msgID, m)
 	}
 
-	err = sess.transport.Send(raw)
+	sess.send(raw)
+}
+
+func (sess *Session) send(raw []byte) {
+	if sess.broken {
+		return
+	}
+	err := sess.transport.Send(raw)
 	if err != nil {
+		sess.connectionFailed(err)
+	}
+}
+
+// connectionFailed handles a failure to write to the transport. If the
+// session can reconnect, the transport is closed so that the listener
+// notices, and the message is resent after reconnecting.
+func (sess *Session) connectionFailed(err error) {
+	if sess.options.Dial == nil {
 		sess.failInternal(err)
 		return
 	}
+	if sess.options.Verbose >= 1 {
+		log.Printf("mtproto.Session Send failed: %v", err)
+	}
+	sess.broken = true
+	sess.transport.Close()
 }
 
-func (sess *Session) startPendingRPC(msgID uint64, replyc chan<- reply) {
+func (sess *Session) startPendingRPC(msgID uint64, m queuedMsg) {
 	if sess.inFlight[msgID] != nil {
 		panic("duplicate msgID")
 	}
 
-	infl := &rpcInFlight{msgID, replyc}
+	infl := &rpcInFlight{MsgID: msgID, Obj: m.Obj, Reply: m.Reply, Resends: m.Resends}
 	sess.inFlight[msgID] = infl
 }
 
@@ -336,14 +929,45 @@ func (sess *Session) finishPendingRPC(msgID uint64, obj tl.Object, err error) {
 	infl.Reply <- reply{obj, err}
 }
 
+func (sess *Session) cancelPendingRPC(replyc chan<- reply) {
+	for i, m := range sess.outbox {
+		if m.Reply == replyc {
+			sess.outbox = append(sess.outbox[:i], sess.outbox[i+1:]...)
+			sess.outboxSize -= len(m.Msg.Payload) + protoMessageOverhead
+			return
+		}
+	}
+	for msgID, infl := range sess.inFlight {
+		if infl.Reply == replyc {
+			delete(sess.inFlight, msgID)
+			// the server need not send the answer anymore
+			sess.transmit(&TLRPCDropAnswer{ReqMsgID: msgID}, nil)
+			return
+		}
+	}
+}
+
+func (sess *Session) releasePendingRPCs() {
+	for _, m := range sess.outbox {
+		if m.Reply != nil {
+			m.Reply <- reply{nil, &SessionClosedError{sess.err}}
+		}
+	}
+	sess.outbox = nil
+	for msgID, infl := range sess.inFlight {
+		delete(sess.inFlight, msgID)
+		infl.Reply <- reply{nil, &SessionClosedError{sess.err}}
+	}
+}
+
+// ack schedules an acknowledgement to be sent with the next batch.
 func (sess *Session) ack(msgID uint64) {
-	// TODO: batch these messages
-	sess.sendInternal(&TLMsgsAck{
-		MsgIDs: []uint64{msgID},
-	}, nil)
+	sess.pendingAcks = append(sess.pendingAcks, msgID)
+	sess.scheduleFlush()
 }
 
 func (sess *Session) handle(msg []byte) {
+	sess.lastRecv = time.Now()
 	err := sess.doHandle(msg)
 	if err != nil {
 		sess.failInternal(err)
@@ -354,7 +978,12 @@ func (sess *Session) doHandle(raw []byte) error {
 	sess.stateMut.Lock()
 	msg, err := sess.framer.Parse(raw)
 	sess.stateMut.Unlock()
-	if err != nil {
+	if secErr, ok := err.(*SecurityError); ok {
+		if sess.options.Verbose >= 1 {
+			log.Printf("mtproto.Session dropping incoming message: %v", secErr)
+		}
+		return nil
+	} else if err != nil {
 		if sess.options.Verbose >= 2 {
 			log.Printf("mtproto.Session failed to parse incoming data (%v bytes): %v - error: %v", len(raw), hex.EncodeToString(raw), err)
 		} else if sess.options.Verbose >= 1 {
@@ -372,6 +1001,7 @@ func (sess *Session) doHandle(raw []byte) error {
 		}
 		return err
 	}
+	sess.reconnectAttempts = 0
 
 	if sess.options.Verbose >= 2 {
 		log.Printf("mtproto.Session received %v (%v bytes, %v)", o, len(msg.Payload), msg.Type)
@@ -438,13 +1068,27 @@ func (sess *Session) processResult(msgs []tl.Object, err error) {
 	}
 }
 
+// startKeyEx starts creating the permanent auth key, or a temporary one if
+// the session uses perfect forward secrecy and has a permanent key already.
 func (sess *Session) startKeyEx() {
+	sess.keyex = &KeyEx{
+		PubKey:     sess.options.PubKey,
+		PublicKeys: sess.options.PublicKeys,
+	}
+	sess.stateMut.Lock()
+	if sess.options.TempKeyTTL > 0 && sess.permAuth != nil {
+		sess.keyex.ExpiresIn = int(sess.options.TempKeyTTL / time.Second)
+	}
+	sess.stateMut.Unlock()
+
 	omsg := sess.keyex.Start()
 	sess.processResult([]tl.Object{omsg}, nil)
 }
 
 func (sess *Session) handleKeyEx(msgID uint64, o tl.Object) ([]tl.Object, error) {
-	if sess.connKeyExDone {
+	// once there is a key, only the messages of a new temporary key
+	// exchange are handled here
+	if sess.keyex == nil || (sess.connKeyExDone && !IsKeyExMsg(o)) {
 		return nil, ErrCmdNotHandled
 	}
 
@@ -459,22 +1103,156 @@ func (sess *Session) handleKeyEx(msgID uint64, o tl.Object) ([]tl.Object, error)
 		if err != nil {
 			return nil, err
 		}
-		sess.applyAuth(auth)
+		temp := sess.keyex.ExpiresIn > 0
+		sess.keyex = nil
+
+		switch {
+		case temp:
+			sess.bindTempKey(auth)
+		case sess.options.TempKeyTTL > 0:
+			sess.stateMut.Lock()
+			sess.permAuth = auth
+			sess.stateMut.Unlock()
+			sess.notifyStateChanged()
+			sess.startKeyEx()
+		default:
+			sess.applyAuth(auth)
+			sess.checkSalts()
+		}
 		return []tl.Object{}, nil
 	}
 }
 
+// bindTempKey switches to a new temporary key and asks the server to bind
+// it to the permanent one. Until the server confirms, requests are held back.
+func (sess *Session) bindTempKey(temp *AuthResult) {
+	_, err := io.ReadFull(rand.Reader, temp.SessionID[:])
+	if err != nil {
+		panic(err)
+	}
+
+	sess.stateMut.Lock()
+	sess.framer.RotateAuth(temp)
+	sess.stateMut.Unlock()
+
+	sess.bindAuth = temp
+	sess.bindResends = 0
+	sess.sendBind()
+}
+
+// resendBind sends the bind request again after the server has rejected
+// it, giving up after maxMsgResends attempts.
+func (sess *Session) resendBind() {
+	if sess.bindResends >= maxMsgResends {
+		sess.failInternal(fmt.Errorf("%w: bind request rejected %d times", ErrTempKeyNotBound, sess.bindResends+1))
+		return
+	}
+	sess.bindResends++
+	sess.sendBind()
+}
+
+// sendBind sends auth.bindTempAuthKey for bindAuth; the encrypted binding
+// message must carry the msg_id of the request itself.
+func (sess *Session) sendBind() {
+	sess.stateMut.Lock()
+	msgID := sess.framer.NextMsgID()
+	req, err := newBindTempAuthKey(sess.permAuth, sess.bindAuth, msgID, rand.Reader)
+	var raw []byte
+	if err == nil {
+		sess.framer.MsgIDOverride = msgID
+		raw, _, err = sess.framer.Format(MsgFromObj(req))
+	}
+	sess.stateMut.Unlock()
+	if err != nil {
+		sess.failInternal(err)
+		return
+	}
+
+	if sess.options.Verbose >= 1 {
+		log.Printf("mtproto.Session binding temporary key %016x (msgID %08x)", sess.bindAuth.KeyID, msgID)
+	}
+	sess.bindMsgID = msgID
+	sess.send(raw)
+}
+
+func (sess *Session) handleBindResult(o tl.Object) error {
+	switch o := o.(type) {
+	case *TLBoolTrue:
+	case *TLRPCError:
+		return fmt.Errorf("%w: %d %s", ErrTempKeyNotBound, o.ErrorCode, o.ErrorMessage)
+	default:
+		return ErrTempKeyNotBound
+	}
+
+	if sess.options.Verbose >= 2 {
+		log.Printf("mtproto.Session temporary key %016x bound, expires at %v", sess.bindAuth.KeyID, time.Unix(int64(sess.bindAuth.ExpiresAt), 0))
+	}
+	sess.bindAuth = nil
+	sess.bindMsgID = 0
+	sess.scheduleRenewal()
+
+	// initConnection must be repeated for every new key; the held requests
+	// were queued before the key changed, so the first of them carries it
+	sess.connInitSent = false
+	if len(sess.outbox) > 0 {
+		first := &sess.outbox[0]
+		sess.outboxSize -= len(first.Msg.Payload)
+		first.Obj = sess.initConnection(first.Obj)
+		first.Msg = MsgFromObj(first.Obj)
+		sess.outboxSize += len(first.Msg.Payload)
+	}
+
+	if !sess.connKeyExDone {
+		sess.setReady()
+	}
+	sess.flush()
+	sess.checkSalts()
+	return nil
+}
+
+// scheduleRenewal arranges for the temporary key to be replaced before it
+// expires.
+func (sess *Session) scheduleRenewal() {
+	sess.stopRenewal()
+	ttl := sess.options.TempKeyTTL
+	sess.renewTimer = time.NewTimer(ttl - ttl/tempKeyRenewFraction)
+	sess.renewc = sess.renewTimer.C
+}
+
+func (sess *Session) stopRenewal() {
+	if sess.renewTimer != nil {
+		sess.renewTimer.Stop()
+		sess.renewTimer = nil
+		sess.renewc = nil
+	}
+}
+
 func (sess *Session) handleRPCResult(msgID uint64, o tl.Object) ([]tl.Object, error) {
 	switch o := o.(type) {
 	case *TLRPCResult:
-		sess.finishPendingRPC(o.ReqMsgID, o.Result, nil)
 		sess.ack(msgID)
+		if sess.bindAuth != nil && o.ReqMsgID == sess.bindMsgID {
+			return nil, sess.handleBindResult(o.Result)
+		}
+		if _, ok := o.Result.(TLRPCDropAnswerType); ok {
+			// answers rpc_drop_answer, which nobody waits for
+			return nil, nil
+		}
+		sess.finishPendingRPC(o.ReqMsgID, o.Result, nil)
 		return nil, nil
 	case *TLMsgContainer:
 		var replies []tl.Object
 		for _, msg := range o.Messages {
-			// TODO: verify msg.MsgId
-			// TODO: verify msg.Seqno
+			sess.stateMut.Lock()
+			err := sess.framer.CheckContainedMsg(msg)
+			sess.stateMut.Unlock()
+			if err != nil {
+				if sess.options.Verbose >= 1 {
+					log.Printf("mtproto.Session dropping message from container: %v", err)
+				}
+				continue
+			}
+
 			r, err := sess.invokeHandlersInternalReturnCmds(msg.MsgID, msg.Body)
 			if err == ErrCmdNotHandled {
 				sess.logDroppedIncomingMsg(msg.Body)
@@ -492,28 +1270,81 @@ func (sess *Session) handleRPCResult(msgID uint64, o tl.Object) ([]tl.Object, er
 		return nil, nil
 	case *TLMsgsAck:
 		for _, msgID := range o.MsgIDs {
-			// TODO: ack
-			if sess.options.Verbose >= 2 {
-				log.Printf("TODO: ack'ed %08x", msgID)
+			if infl := sess.inFlight[msgID]; infl != nil {
+				infl.Acked = true
 			}
 		}
 		return nil, nil
 	case *TLBadServerSalt:
 		sess.stateMut.Lock()
 		auth, _ := sess.framer.State()
-		sess.stateMut.Unlock()
 		binints.EncodeUint64LE(o.NewServerSalt, auth.ServerSalt[:])
-		sess.applyAuth(auth)
-		return nil, ErrReconnectRequired
+		// the cached salts are apparently no good
+		sess.framer.FutureSalts = nil
+		sess.stateMut.Unlock()
+		sess.notifyStateChanged()
+		if sess.bindAuth != nil && o.BadMsgID == sess.bindMsgID {
+			sess.resendBind()
+		} else {
+			sess.resendMsg(o.BadMsgID)
+		}
+		sess.saltsRequested = time.Time{}
+		sess.checkSalts()
+		return nil, nil
+	case *TLPong:
+		if o.PingID == sess.pingID && !sess.pingSentAt.IsZero() {
+			sess.stateMut.Lock()
+			sess.rtt = time.Since(sess.pingSentAt)
+			sess.stateMut.Unlock()
+			sess.pingSentAt = time.Time{}
+		}
+		if sess.inFlight[o.MsgID] != nil {
+			sess.finishPendingRPC(o.MsgID, o, nil)
+		}
+		return nil, nil
+	case *TLFutureSalts:
+		salts := make([]FutureSalt, len(o.Salts))
+		for i, salt := range o.Salts {
+			salts[i] = FutureSalt{salt.Salt, salt.ValidSince, salt.ValidUntil}
+		}
+		sess.stateMut.Lock()
+		sess.framer.AddFutureSalts(salts)
+		sess.stateMut.Unlock()
+		sess.saltsRequested = time.Time{}
+		if sess.options.Verbose >= 2 {
+			log.Printf("mtproto.Session received %d future salts", len(salts))
+		}
+		sess.notifyStateChanged()
+		return nil, nil
 	case *TLBadMsgNotification:
 		log.Printf("WARNING: bad msg %08x: err code %d, seq no %d", o.BadMsgID, o.ErrorCode, o.BadMsgSeqno)
-		sess.finishPendingRPC(o.BadMsgID, nil, ErrInvalidMsg)
-		return nil, nil
-	case *TLUpdates:
-		sess.ack(msgID)
+		if sess.bindAuth != nil && o.BadMsgID == sess.bindMsgID {
+			sess.correctBadMsg(msgID, o)
+			sess.resendBind()
+			return nil, nil
+		}
+		if sess.correctBadMsg(msgID, o) {
+			sess.resendMsg(o.BadMsgID)
+			return nil, nil
+		}
+		if sess.inFlight[o.BadMsgID] != nil {
+			sess.finishPendingRPC(o.BadMsgID, nil, ErrInvalidMsg)
+			return nil, nil
+		}
+		for msgID, infl := range sess.inFlight {
+			if infl.Container == o.BadMsgID {
+				sess.finishPendingRPC(msgID, nil, ErrInvalidMsg)
+			}
+		}
 		return nil, nil
-	case *TLUpdateShort:
+	case *TLUpdates, *TLUpdatesCombined, *TLUpdateShort, *TLUpdateShortMessage, *TLUpdateShortChatMessage, *TLUpdateShortSentMessage, *TLUpdatesTooLong:
 		sess.ack(msgID)
+		sess.stateMut.Lock()
+		f := sess.onupdates
+		sess.stateMut.Unlock()
+		if f != nil {
+			f(o)
+		}
 		return nil, nil
 	case *TLMsgDetailedInfo:
 		sess.ack(o.AnswerMsgID)
@@ -526,15 +1357,58 @@ func (sess *Session) handleRPCResult(msgID uint64, o tl.Object) ([]tl.Object, er
 	}
 }
 
+// correctBadMsg fixes the clock or the seqno counter after the server has
+// complained about them in a bad_msg_notification sent with msgID, and
+// reports whether the rejected message is worth resending.
+func (sess *Session) correctBadMsg(msgID uint64, o *TLBadMsgNotification) bool {
+	sess.stateMut.Lock()
+	defer sess.stateMut.Unlock()
+
+	switch o.ErrorCode {
+	case 16, 17: // msg_id too low or too high
+		sess.framer.SyncTime(msgID)
+	case 32: // seqno too low
+		sess.framer.SeqNo += 64
+	case 33: // seqno too high
+		if sess.framer.SeqNo >= 16 {
+			sess.framer.SeqNo -= 16
+		} else {
+			sess.framer.SeqNo = 0
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// AuthState returns the auth key to save, along with the state of the framer.
+// With perfect forward secrecy, this is the permanent key; temporary keys and
+// their framer state are never saved. The framer keeps updating its key, so
+// a copy of it is returned, safe to use while the session runs.
 func (sess *Session) AuthState() (*AuthResult, FramerState) {
 	sess.stateMut.Lock()
 	defer sess.stateMut.Unlock()
 
-	return sess.framer.State()
+	if sess.options.TempKeyTTL > 0 {
+		return sess.permAuth, FramerState{}
+	}
+	auth, fs := sess.framer.State()
+	if auth != nil {
+		copied := *auth
+		auth = &copied
+	}
+	fs.FutureSalts = append([]FutureSalt(nil), fs.FutureSalts...)
+	return auth, fs
 }
 
 func (sess *Session) RestoreAuthState(auth *AuthResult, fs FramerState) {
 	sess.stateMut.Lock()
+	if sess.options.TempKeyTTL > 0 {
+		// a temporary key is created when the session starts running
+		sess.permAuth = auth
+		sess.stateMut.Unlock()
+		return
+	}
 	sess.framer.Restore(fs)
 	sess.stateMut.Unlock()
 
@@ -551,12 +1425,28 @@ func (sess *Session) applyAuth(auth *AuthResult) {
 	}
 
 	sess.stateMut.Lock()
-
 	sess.framer.SetAuth(auth)
+	sess.stateMut.Unlock()
+
+	sess.setReady()
+	sess.notifyStateChanged()
+}
+
+// setReady marks the connection as able to send encrypted requests.
+func (sess *Session) setReady() {
+	sess.stateMut.Lock()
+	defer sess.stateMut.Unlock()
 
 	sess.connKeyExDone = true
+	if !sess.isReady {
+		close(sess.readyc)
+	}
 	sess.isReady = true
 	sess.stateCond.Broadcast()
+}
+
+func (sess *Session) notifyStateChanged() {
+	sess.stateMut.Lock()
 	f := sess.onstatechanged
 	sess.stateMut.Unlock()
 
@@ -565,8 +1455,94 @@ func (sess *Session) applyAuth(auth *AuthResult) {
 	}
 }
 
+func (sess *Session) pingInterval() time.Duration {
+	if sess.options.PingInterval == 0 {
+		return DefaultPingInterval
+	}
+	return sess.options.PingInterval
+}
+
+func (sess *Session) idleTimeout() time.Duration {
+	if sess.options.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return sess.options.IdleTimeout
+}
+
+// keepaliveTick returns how often keepalive should run, or 0 if disabled.
+func (sess *Session) keepaliveTick() time.Duration {
+	interval := sess.pingInterval()
+	if interval < 0 {
+		return 0
+	}
+	if timeout := sess.idleTimeout(); timeout < interval {
+		interval = timeout
+	}
+	return interval / 4
+}
+
+// keepalive declares the connection dead if it has been silent for too
+// long, and sends a ping when one is due.
+func (sess *Session) keepalive() {
+	if time.Since(sess.lastRecv) > sess.idleTimeout() {
+		if sess.options.Verbose >= 1 {
+			log.Printf("mtproto.Session: nothing received for %v", time.Since(sess.lastRecv))
+		}
+		sess.lastRecv = time.Now()
+		sess.connectionFailed(ErrConnectionDead)
+		return
+	}
+
+	if !sess.connKeyExDone || sess.broken || time.Since(sess.lastPing) < sess.pingInterval() {
+		return
+	}
+	sess.lastPing = time.Now()
+	sess.pingID++
+	sess.pingSentAt = sess.lastPing
+	delay := int(sess.idleTimeout() / time.Second)
+	if delay < 1 {
+		delay = 1
+	}
+	sess.transmit(&TLPingDelayDisconnect{
+		PingID:          sess.pingID,
+		DisconnectDelay: delay,
+	}, nil)
+}
+
+// RTT returns the round-trip time measured by the last keepalive ping.
+func (sess *Session) RTT() time.Duration {
+	sess.stateMut.Lock()
+	defer sess.stateMut.Unlock()
+	return sess.rtt
+}
+
+// checkSalts requests more future salts when the cached ones are about to
+// run out. The framer switches to them as they become valid.
+func (sess *Session) checkSalts() {
+	if !sess.connKeyExDone {
+		return
+	}
+	if !sess.saltsRequested.IsZero() && time.Since(sess.saltsRequested) < saltCheckInterval {
+		return
+	}
+
+	sess.stateMut.Lock()
+	until := sess.framer.SaltsValidUntil()
+	now := sess.framer.ServerTime()
+	sess.stateMut.Unlock()
+	if time.Unix(int64(until), 0).Sub(now) > saltRefreshMargin {
+		return
+	}
+
+	sess.saltsRequested = time.Now()
+	sess.transmit(&TLGetFutureSalts{Num: futureSaltsCount}, nil)
+}
+
 func (sess *Session) Shutdown() {
-	sess.closec <- struct{}{}
+	select {
+	case sess.closec <- struct{}{}:
+	case <-sess.donec:
+	}
 }
 
 func (sess *Session) Wait() {
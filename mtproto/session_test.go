@@ -0,0 +1,570 @@
+package mtproto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// fakeTransport records outgoing frames and delivers frames pushed by the test.
+type fakeTransport struct {
+	mut  sync.Mutex
+	sent [][]byte
+
+	// onSend, if set, is called by the session goroutine for every frame
+	onSend func(data []byte)
+
+	recvc  chan []byte
+	closec chan struct{}
+	once   sync.Once
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		recvc:  make(chan []byte, 16),
+		closec: make(chan struct{}),
+	}
+}
+
+func (tr *fakeTransport) Send(data []byte) error {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	tr.sent = append(tr.sent, data)
+	if tr.onSend != nil {
+		tr.onSend(data)
+	}
+	return nil
+}
+
+func (tr *fakeTransport) Recv() ([]byte, int, error) {
+	select {
+	case raw := <-tr.recvc:
+		return raw, 0, nil
+	case <-tr.closec:
+		return nil, 0, io.EOF
+	}
+}
+
+func (tr *fakeTransport) Close() {
+	tr.once.Do(func() {
+		close(tr.closec)
+	})
+}
+
+func newTestAuth() *AuthResult {
+	auth := &AuthResult{
+		Key:   make([]byte, 256),
+		KeyID: 0x1122334455667788,
+	}
+	for i := range auth.Key {
+		auth.Key[i] = byte(i)
+	}
+	return auth
+}
+
+func newTestSession(tr Transport) *Session {
+	return newTestSessionWithOptions(tr, SessionOptions{})
+}
+
+func newTestSessionWithOptions(tr Transport, options SessionOptions) *Session {
+	sess := NewSession(tr, options)
+	// a day worth of salts, so that the session does not ask for more
+	now := int(time.Now().Unix())
+	salts := []FutureSalt{{Salt: 42, ValidSince: now - 3600, ValidUntil: now + 86400}}
+	sess.RestoreAuthState(newTestAuth(), FramerState{FutureSalts: salts})
+	sess.connInitSent = true
+	return sess
+}
+
+// waitSent waits until at least n frames have been sent over tr and returns them.
+func waitSent(t *testing.T, tr *fakeTransport, n int) [][]byte {
+	for i := 0; i < 200; i++ {
+		tr.mut.Lock()
+		sent := append([][]byte(nil), tr.sent...)
+		tr.mut.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d frames to be sent", n)
+	return nil
+}
+
+// decryptClientFrame returns the msg_id and the payload of a message sent by
+// a session using newTestAuth.
+func decryptClientFrame(t *testing.T, raw []byte) (uint64, []byte) {
+	return decryptClientFrameWith(t, newTestAuth(), raw)
+}
+
+func decryptClientFrameWith(t *testing.T, auth *AuthResult, raw []byte) (uint64, []byte) {
+	msgKey := raw[8:24]
+	var key, iv [32]byte
+	deriveAESKeyV2(auth.Key, msgKey, key[:], iv[:], true)
+	data, err := AESIGEDecrypt(nil, raw[24:], key[:], iv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r tl.Reader
+	r.Reset(data)
+	r.ReadUint64() // salt
+	r.ReadUint64() // session ID
+	msgID := r.ReadUint64()
+	r.ReadInt() // seq_no
+	payload := r.ReadN(r.ReadInt())
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return msgID, payload
+}
+
+func TestSendContextCancel(t *testing.T) {
+	tr := newFakeTransport()
+	sess := newTestSession(tr)
+	// the number of RPCs in flight as each frame is sent, read by the
+	// session goroutine itself
+	var inFlight []int
+	tr.onSend = func(data []byte) {
+		inFlight = append(inFlight, len(sess.inFlight))
+	}
+
+	runDone := make(chan struct{})
+	go func() {
+		sess.Run()
+		close(runDone)
+	}()
+	defer func() {
+		sess.Shutdown()
+		<-runDone
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := sess.SendContext(ctx, &TLHelpGetConfig{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("SendContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	sent := waitSent(t, tr, 2)
+	reqMsgID, _ := decryptClientFrame(t, sent[0])
+	_, payload := decryptClientFrame(t, sent[1])
+	o, err := Schema.ReadBoxedObject(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drop, ok := o.(*TLRPCDropAnswer); !ok || drop.ReqMsgID != reqMsgID {
+		t.Errorf("sent %v after cancellation, expected rpc_drop_answer for %08x", o, reqMsgID)
+	}
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	if n := inFlight[1]; n != 0 {
+		t.Errorf("%d RPCs still in flight after cancellation", n)
+	}
+}
+
+func TestPendingRPCsReleasedOnExit(t *testing.T) {
+	tr := newFakeTransport()
+	sess := newTestSession(tr)
+
+	runDone := make(chan struct{})
+	go func() {
+		sess.Run()
+		close(runDone)
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sess.Send(&TLHelpGetConfig{})
+		errc <- err
+	}()
+
+	// wait for the request to hit the wire
+	waitSent(t, tr, 1)
+
+	sess.Fail(errors.New("boom"))
+
+	select {
+	case err := <-errc:
+		var closed *SessionClosedError
+		if !errors.As(err, &closed) {
+			t.Fatalf("Send returned %v, expected *SessionClosedError", err)
+		}
+		if closed.Err == nil || closed.Err.Error() != "boom" {
+			t.Errorf("SessionClosedError.Err == %v, expected boom", closed.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send did not return after the session failed")
+	}
+	<-runDone
+
+	_, err := sess.Send(&TLHelpGetConfig{})
+	if _, ok := err.(*SessionClosedError); !ok {
+		t.Errorf("Send after exit returned %v, expected *SessionClosedError", err)
+	}
+}
+
+func TestReconnectResendsPending(t *testing.T) {
+	tr1 := newFakeTransport()
+	tr2 := newFakeTransport()
+	sess := newTestSessionWithOptions(tr1, SessionOptions{
+		Dial: func() (Transport, error) {
+			return tr2, nil
+		},
+	})
+
+	runDone := make(chan struct{})
+	go func() {
+		sess.Run()
+		close(runDone)
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sess.Send(&TLHelpGetConfig{})
+		errc <- err
+	}()
+
+	sent1 := waitSent(t, tr1, 1)
+	tr1.Close()
+	sent2 := waitSent(t, tr2, 1)
+
+	msgID1, payload1 := decryptClientFrame(t, sent1[0])
+	msgID2, payload2 := decryptClientFrame(t, sent2[0])
+	if msgID1 == msgID2 {
+		t.Errorf("request resent with the same msg_id %08x", msgID1)
+	}
+	if !bytes.Equal(payload1, payload2) {
+		t.Errorf("resent payload %x, expected %x", payload2, payload1)
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("Send returned %v while reconnecting", err)
+	default:
+	}
+
+	sess.Shutdown()
+	<-runDone
+	if err := <-errc; err == nil {
+		t.Errorf("Send returned nil error after shutdown")
+	}
+	if err := sess.Err(); err != nil {
+		t.Errorf("session failed with %v, expected a clean shutdown", err)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	dialErr := errors.New("network is unreachable")
+	tr := newFakeTransport()
+	sess := newTestSessionWithOptions(tr, SessionOptions{
+		Dial: func() (Transport, error) {
+			return nil, dialErr
+		},
+		MaxReconnectAttempts: 2,
+	})
+
+	go sess.Run()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sess.Send(&TLHelpGetConfig{})
+		errc <- err
+	}()
+
+	waitSent(t, tr, 1)
+	tr.Close()
+
+	select {
+	case err := <-errc:
+		var closed *SessionClosedError
+		if !errors.As(err, &closed) || !errors.Is(err, dialErr) {
+			t.Errorf("Send returned %v, expected *SessionClosedError wrapping %v", err, dialErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send did not return after running out of reconnect attempts")
+	}
+}
+
+func TestBatchingPacksContainer(t *testing.T) {
+	tr := newFakeTransport()
+	sess := newTestSessionWithOptions(tr, SessionOptions{
+		BatchWindow: 50 * time.Millisecond,
+	})
+	go sess.Run()
+	defer sess.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		go sess.Send(&TLHelpGetConfig{})
+	}
+
+	sent := waitSent(t, tr, 1)
+	time.Sleep(20 * time.Millisecond)
+	if n := len(waitSent(t, tr, 1)); n != 1 {
+		t.Fatalf("sent %d frames, expected 1", n)
+	}
+
+	_, payload := decryptClientFrame(t, sent[0])
+	o, err := Schema.ReadBoxedObject(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, ok := o.(*TLMsgContainer)
+	if !ok {
+		t.Fatalf("sent %s, expected msg_container", tl.Name(o))
+	}
+	if len(container.Messages) != 2 {
+		t.Fatalf("container has %d messages, expected 2", len(container.Messages))
+	}
+	for _, m := range container.Messages {
+		if _, ok := m.Body.(*TLHelpGetConfig); !ok {
+			t.Errorf("container message is %s, expected help.getConfig", tl.Name(m.Body))
+		}
+		if m.Seqno&1 == 0 {
+			t.Errorf("content message sent with even seqno %d", m.Seqno)
+		}
+	}
+	if container.Messages[0].MsgID >= container.Messages[1].MsgID {
+		t.Errorf("msg_ids in container are not increasing")
+	}
+}
+
+func TestSessionFetchesFutureSalts(t *testing.T) {
+	tr := newFakeTransport()
+	sess := NewSession(tr, SessionOptions{})
+	auth := newTestAuth()
+	sess.RestoreAuthState(auth, FramerState{})
+	sess.connInitSent = true
+
+	changed := make(chan struct{}, 1)
+	sess.OnStateChanged(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	go sess.Run()
+	defer sess.Shutdown()
+
+	sent := waitSent(t, tr, 1)
+	reqMsgID, payload := decryptClientFrame(t, sent[0])
+	o, err := Schema.ReadBoxedObject(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.(*TLGetFutureSalts); !ok {
+		t.Fatalf("sent %s, expected get_future_salts", tl.Name(o))
+	}
+
+	now := time.Now()
+	unix := int(now.Unix())
+	reply := &TLFutureSalts{
+		ReqMsgID: reqMsgID,
+		Now:      unix,
+		Salts: []*TLFutureSalt{
+			{ValidSince: unix - 60, ValidUntil: unix + 3600, Salt: 7},
+			{ValidSince: unix + 3000, ValidUntil: unix + 7200, Salt: 8},
+		},
+	}
+	tr.recvc <- formatServerMsg(auth, serverMsgID(now), 0, tl.Bytes(reply))
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("state not changed after receiving future salts")
+	}
+	_, fs := sess.AuthState()
+	if len(fs.FutureSalts) != 2 {
+		t.Errorf("%d future salts cached, expected 2", len(fs.FutureSalts))
+	}
+}
+
+func TestBadMsgNotificationResends(t *testing.T) {
+	tr := newFakeTransport()
+	sess := NewSession(tr, SessionOptions{BatchWindow: -1})
+	auth := newTestAuth()
+	now := int(time.Now().Unix())
+	salts := []FutureSalt{{Salt: 42, ValidSince: now - 3600, ValidUntil: now + 86400}}
+	sess.RestoreAuthState(auth, FramerState{FutureSalts: salts})
+	sess.connInitSent = true
+	go sess.Run()
+	defer sess.Shutdown()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sess.Send(&TLHelpGetConfig{})
+		errc <- err
+	}()
+
+	// the first message from the server syncs the clock, and then the
+	// server clock turns out to be ahead
+	sent := waitSent(t, tr, 1)
+	msgID, _ := decryptClientFrame(t, sent[0])
+	serverNow := time.Now()
+	tr.recvc <- formatServerMsg(auth, serverMsgID(serverNow), 0, tl.Bytes(&TLMsgsAck{MsgIDs: []uint64{msgID}}))
+	skewed := serverNow.Add(20 * time.Second)
+
+	for i := 0; i <= maxMsgResends; i++ {
+		code := 16
+		if i > 0 {
+			code = 32
+		}
+		bad := &TLBadMsgNotification{BadMsgID: msgID, ErrorCode: code}
+		tr.recvc <- formatServerMsg(auth, serverMsgID(skewed.Add(time.Duration(i)*time.Millisecond)), 0, tl.Bytes(bad))
+		if i == maxMsgResends {
+			break
+		}
+
+		sent := waitSent(t, tr, i+2)
+		var payload []byte
+		msgID, payload = decryptClientFrame(t, sent[i+1])
+		if o, err := Schema.ReadBoxedObject(payload); err != nil {
+			t.Fatal(err)
+		} else if _, ok := o.(*TLHelpGetConfig); !ok {
+			t.Fatalf("sent %s, expected help.getConfig to be resent", tl.Name(o))
+		}
+		if msgIDTime(msgID).Before(skewed.Add(-time.Second)) {
+			t.Fatalf("request resent at %v, server time is %v", msgIDTime(msgID), skewed)
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("Send returned %v after %d resends", err, i+1)
+		default:
+		}
+	}
+
+	select {
+	case err := <-errc:
+		if err != ErrInvalidMsg {
+			t.Errorf("Send returned %v, expected ErrInvalidMsg", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send did not fail after the resends ran out")
+	}
+}
+
+func TestBadServerSaltResends(t *testing.T) {
+	tr := newFakeTransport()
+	sess := NewSession(tr, SessionOptions{BatchWindow: -1})
+	auth := newTestAuth()
+	now := int(time.Now().Unix())
+	salts := []FutureSalt{{Salt: 42, ValidSince: now - 3600, ValidUntil: now + 86400}}
+	sess.RestoreAuthState(auth, FramerState{FutureSalts: salts})
+	sess.connInitSent = true
+	go sess.Run()
+	defer sess.Shutdown()
+
+	// the salt is saved by other goroutines meanwhile
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sess.AuthState()
+			}
+		}
+	}()
+
+	go sess.Send(&TLHelpGetConfig{})
+	sent := waitSent(t, tr, 1)
+	msgID, _ := decryptClientFrame(t, sent[0])
+	bad := &TLBadServerSalt{BadMsgID: msgID, ErrorCode: 48, NewServerSalt: 77}
+	tr.recvc <- formatServerMsg(auth, serverMsgID(time.Now()), 0, tl.Bytes(bad))
+
+	sent = waitSent(t, tr, 2)
+	_, payload := decryptClientFrame(t, sent[1])
+	if o, err := Schema.ReadBoxedObject(payload); err != nil {
+		t.Fatal(err)
+	} else if _, ok := o.(*TLHelpGetConfig); !ok {
+		t.Fatalf("sent %s, expected help.getConfig to be resent", tl.Name(o))
+	}
+	if auth, _ := sess.AuthState(); binints.DecodeUint64LE(auth.ServerSalt[:]) != 77 {
+		t.Errorf("salt is %x, expected the new one", auth.ServerSalt)
+	}
+}
+
+// sentObjects decrypts the frames sent over tr, unpacking containers.
+func sentObjects(t *testing.T, tr *fakeTransport) map[uint64]tl.Object {
+	tr.mut.Lock()
+	sent := append([][]byte(nil), tr.sent...)
+	tr.mut.Unlock()
+
+	result := make(map[uint64]tl.Object)
+	for _, raw := range sent {
+		msgID, payload := decryptClientFrame(t, raw)
+		o, err := Schema.ReadBoxedObject(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if container, ok := o.(*TLMsgContainer); ok {
+			for _, m := range container.Messages {
+				result[m.MsgID] = m.Body
+			}
+		} else {
+			result[msgID] = o
+		}
+	}
+	return result
+}
+
+func TestKeepalivePing(t *testing.T) {
+	tr := newFakeTransport()
+	sess := newTestSessionWithOptions(tr, SessionOptions{
+		PingInterval: 40 * time.Millisecond,
+		IdleTimeout:  time.Second,
+	})
+	go sess.Run()
+	defer sess.Shutdown()
+
+	var pingMsgID uint64
+	var ping *TLPingDelayDisconnect
+	for i := 0; i < 100 && ping == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for msgID, o := range sentObjects(t, tr) {
+			if p, ok := o.(*TLPingDelayDisconnect); ok {
+				pingMsgID, ping = msgID, p
+			}
+		}
+	}
+	if ping == nil {
+		t.Fatal("no ping_delay_disconnect sent")
+	}
+	if ping.DisconnectDelay != 1 {
+		t.Errorf("disconnect_delay = %d, expected 1", ping.DisconnectDelay)
+	}
+
+	auth, _ := sess.AuthState()
+	pong := &TLPong{MsgID: pingMsgID, PingID: ping.PingID}
+	tr.recvc <- formatServerMsg(auth, serverMsgID(time.Now()), 1, tl.Bytes(pong))
+	for i := 0; i < 100 && sess.RTT() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sess.RTT() == 0 {
+		t.Error("RTT not measured after pong")
+	}
+}
+
+func TestKeepaliveDetectsDeadConnection(t *testing.T) {
+	tr := newFakeTransport()
+	sess := newTestSessionWithOptions(tr, SessionOptions{
+		PingInterval: 20 * time.Millisecond,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	go sess.Run()
+
+	_, err := sess.Send(&TLHelpGetConfig{})
+	if !errors.Is(err, ErrConnectionDead) {
+		t.Errorf("Send returned %v, expected %v", err, ErrConnectionDead)
+	}
+}
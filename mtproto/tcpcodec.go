@@ -0,0 +1,251 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/PROger4ever/telegramapi/binints"
+)
+
+// TCPMode selects the framing of packets sent over a TCP connection.
+type TCPMode int
+
+const (
+	// TCPAbridged prefixes packets with a 1 or 4 byte length in 4-byte units.
+	TCPAbridged TCPMode = iota
+	// TCPIntermediate prefixes packets with a 4 byte length.
+	TCPIntermediate
+	// TCPPaddedIntermediate is like TCPIntermediate, but appends 0-15 random
+	// bytes to every packet.
+	TCPPaddedIntermediate
+	// TCPFull adds a sequence number and a CRC32 to every packet.
+	TCPFull
+)
+
+var (
+	ErrTCPPacketTooLarge = errors.New("TCP packet too large")
+	ErrTCPChecksum       = errors.New("TCP packet checksum mismatch")
+	ErrTCPSeqNo          = errors.New("unexpected TCP packet sequence number")
+)
+
+// tags sent by the client before the first packet to choose the mode
+var (
+	abridgedTag           = []byte{0xef}
+	intermediateTag       = []byte{0xee, 0xee, 0xee, 0xee}
+	paddedIntermediateTag = []byte{0xdd, 0xdd, 0xdd, 0xdd}
+)
+
+func (m TCPMode) String() string {
+	switch m {
+	case TCPAbridged:
+		return "abridged"
+	case TCPIntermediate:
+		return "intermediate"
+	case TCPPaddedIntermediate:
+		return "padded intermediate"
+	case TCPFull:
+		return "full"
+	default:
+		return fmt.Sprintf("TCPMode(%d)", int(m))
+	}
+}
+
+// tcpCodec formats and reads the packets of one TCP connection.
+type tcpCodec interface {
+	// tag returns the bytes the client sends first, if any
+	tag() []byte
+	encode(data []byte) []byte
+	decode(r io.Reader, maxLen int) ([]byte, error)
+}
+
+func newTCPCodec(mode TCPMode) tcpCodec {
+	switch mode {
+	case TCPAbridged:
+		return abridgedCodec{}
+	case TCPIntermediate:
+		return intermediateCodec{}
+	case TCPPaddedIntermediate:
+		return intermediateCodec{padded: true}
+	case TCPFull:
+		return &fullCodec{}
+	default:
+		panic(fmt.Sprintf("unknown TCP mode %d", int(mode)))
+	}
+}
+
+type abridgedCodec struct{}
+
+func (abridgedCodec) tag() []byte {
+	return abridgedTag
+}
+
+func (abridgedCodec) encode(data []byte) []byte {
+	return formatTCPMessage(data, false)
+}
+
+func (abridgedCodec) decode(r io.Reader, maxLen int) ([]byte, error) {
+	msglen, err := ReadAbridgedTCPMessageLen(r)
+	if err != nil {
+		return nil, err
+	}
+	return readTCPPacket(r, msglen, maxLen)
+}
+
+type intermediateCodec struct {
+	padded bool
+}
+
+func (c intermediateCodec) tag() []byte {
+	if c.padded {
+		return paddedIntermediateTag
+	}
+	return intermediateTag
+}
+
+func (c intermediateCodec) encode(data []byte) []byte {
+	var padding []byte
+	if c.padded {
+		var n [1]byte
+		if _, err := io.ReadFull(rand.Reader, n[:]); err != nil {
+			panic(err)
+		}
+		padding = make([]byte, n[0]%16)
+		if _, err := io.ReadFull(rand.Reader, padding); err != nil {
+			panic(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	binints.WriteUint32LE(&buf, uint32(len(data)+len(padding)))
+	buf.Write(data)
+	buf.Write(padding)
+	return buf.Bytes()
+}
+
+func (c intermediateCodec) decode(r io.Reader, maxLen int) ([]byte, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	data, err := readTCPPacket(r, int(binints.DecodeUint32LE(lenbuf[:])), maxLen)
+	if err != nil {
+		return nil, err
+	}
+	if c.padded {
+		data = trimTCPPadding(data)
+	}
+	return data, nil
+}
+
+// trimTCPPadding strips the random padding of padded intermediate packets,
+// relying on the structure of MTProto messages to find their actual length.
+func trimTCPPadding(data []byte) []byte {
+	switch {
+	case len(data) < 20:
+		// a 4 byte error code; shorter than any message
+		if len(data) >= 4 {
+			return data[:4]
+		}
+		return data
+	case binints.DecodeUint64LE(data[:8]) == 0:
+		// unencrypted: auth_key_id, msg_id, message_data_length, message_data
+		if n := 20 + int(binints.DecodeUint32LE(data[16:20])); n >= 20 && n <= len(data) {
+			return data[:n]
+		}
+		return data
+	case len(data) >= 24:
+		// encrypted: auth_key_id, msg_key, 16-byte blocks of encrypted data
+		return data[:len(data)-(len(data)-24)%16]
+	default:
+		return data[:4]
+	}
+}
+
+// fullCodec frames packets as length, sequence number, data and CRC32. The
+// sequence numbers of both directions are counted separately.
+type fullCodec struct {
+	sendSeqNo uint32
+	recvSeqNo uint32
+}
+
+func (c *fullCodec) tag() []byte {
+	return nil
+}
+
+func (c *fullCodec) encode(data []byte) []byte {
+	var buf bytes.Buffer
+	binints.WriteUint32LE(&buf, uint32(len(data)+12))
+	binints.WriteUint32LE(&buf, c.sendSeqNo)
+	buf.Write(data)
+	binints.WriteUint32LE(&buf, crc32.ChecksumIEEE(buf.Bytes()))
+	c.sendSeqNo++
+	return buf.Bytes()
+}
+
+func (c *fullCodec) decode(r io.Reader, maxLen int) ([]byte, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	n := int(binints.DecodeUint32LE(lenbuf[:]))
+	if n < 12 {
+		return nil, fmt.Errorf("invalid full TCP packet length %d", n)
+	}
+	rest, err := readTCPPacket(r, n-4, maxLen+8)
+	if err != nil {
+		return nil, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(lenbuf[:])
+	crc.Write(rest[:len(rest)-4])
+	if crc.Sum32() != binints.DecodeUint32LE(rest[len(rest)-4:]) {
+		return nil, ErrTCPChecksum
+	}
+	if seqNo := binints.DecodeUint32LE(rest[:4]); seqNo != c.recvSeqNo {
+		return nil, ErrTCPSeqNo
+	}
+	c.recvSeqNo++
+
+	return rest[4 : len(rest)-4], nil
+}
+
+func readTCPPacket(r io.Reader, n int, maxLen int) ([]byte, error) {
+	if n < 0 || n > maxLen {
+		return nil, ErrTCPPacketTooLarge
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// detectTCPMode reads the tag sent by a client at the start of a connection.
+// For the full mode, which has no tag, the bytes read are returned as prefix
+// and belong to the first packet.
+func detectTCPMode(r io.Reader) (mode TCPMode, prefix []byte, err error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] == abridgedTag[0] {
+		return TCPAbridged, nil, nil
+	}
+
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case bytes.Equal(buf[:], intermediateTag):
+		return TCPIntermediate, nil, nil
+	case bytes.Equal(buf[:], paddedIntermediateTag):
+		return TCPPaddedIntermediate, nil, nil
+	default:
+		return TCPFull, buf[:], nil
+	}
+}
@@ -2,7 +2,10 @@ package mtproto
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -101,21 +104,193 @@ func formatTCPMessage(data []byte, isFirst bool) []byte {
 
 type TCPTransportOptions struct {
 	MaxMsgLen int
+
+	// Mode is the packet framing; defaults to TCPAbridged.
+	Mode TCPMode
+
+	// Obfuscated wraps the framing in the obfuscated2 protocol, which hides
+	// the mode tag and encrypts the stream with AES-256-CTR. TCPFull cannot
+	// be obfuscated. On the server side, AcceptTCP then expects every client
+	// to be obfuscated.
+	Obfuscated bool
+
+	// Dial opens the connection, e.g. through a proxy (see ProxyDialer);
+	// defaults to net.Dial.
+	Dial DialFunc
+
+	// ProxySecret connects through the MTProto proxy at the dialed endpoint,
+	// obfuscating the connection with its secret. For dd and ee secrets, Mode
+	// is always TCPPaddedIntermediate. AcceptTCP then acts as the proxy.
+	ProxySecret *ProxySecret
+
+	// DC is the DC the proxy should forward the connection to; negative for
+	// media DCs.
+	DC int
+
+	// FallbackDelay is how long DialTCPAny waits for an endpoint before also
+	// trying the next one; defaults to DefaultFallbackDelay.
+	FallbackDelay time.Duration
 }
 
+// DefaultFallbackDelay is the Happy Eyeballs connection attempt delay
+// recommended by RFC 8305.
+const DefaultFallbackDelay = 250 * time.Millisecond
+
 type TCPTransport struct {
 	options TCPTransportOptions
 	Conn    net.Conn
 
+	codec    tcpCodec
+	r        io.Reader
+	isServer bool
+
+	// obfuscation header sent before the first packet, and the streams
+	// applied to everything after it
+	header []byte
+	ob     *obfuscator
+
 	firstSent bool
 }
 
 func DialTCP(endpoint string, options TCPTransportOptions) (*TCPTransport, error) {
-	c, err := net.Dial("tcp", endpoint)
+	c, err := options.dial("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := NewTCPTransport(c, options)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+// DialTCPAny connects to the first of the endpoints that answers, in the
+// order given. Like Happy Eyeballs (RFC 8305), the next endpoint is tried
+// as soon as the previous attempt fails or FallbackDelay passes, without
+// abandoning the attempts in progress.
+func DialTCPAny(endpoints []string, options TCPTransportOptions) (*TCPTransport, error) {
+	delay := options.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+	c, err := dialAny(options.dial, endpoints, delay)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := NewTCPTransport(c, options)
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
+	return tr, nil
+}
+
+func dialAny(dial DialFunc, endpoints []string, delay time.Duration) (net.Conn, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints to connect to")
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(endpoints))
+	next, pending := 0, 0
+	start := func() {
+		endpoint := endpoints[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial("tcp", endpoint)
+			results <- result{c, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	restartTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of the attempts that lost
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(endpoints) {
+				start()
+				restartTimer()
+			}
+		case <-timer.C:
+			if next < len(endpoints) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
 
+func (options TCPTransportOptions) dial(network, address string) (net.Conn, error) {
+	if options.Dial != nil {
+		return options.Dial(network, address)
+	}
+	return net.Dial(network, address)
+}
+
+// NewTCPTransport returns a client transport over an established connection.
+func NewTCPTransport(c net.Conn, options TCPTransportOptions) (*TCPTransport, error) {
+	var key []byte
+	if secret := options.ProxySecret; secret != nil {
+		key = secret.Key
+		options.Mode = secret.mode(options.Mode)
+		options.Obfuscated = true
+		if secret.FakeTLS() {
+			var err error
+			c, err = fakeTLSClientHandshake(c, secret)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tr := newTCPTransport(c, options)
+	if options.Obfuscated {
+		header, ob, err := newObfuscatedHeader(options.Mode, options.DC, key, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		tr.obfuscate(ob)
+		tr.header = header
+	}
+	return tr, nil
+}
+
+func newTCPTransport(c net.Conn, options TCPTransportOptions) *TCPTransport {
 	if options.MaxMsgLen == 0 {
 		options.MaxMsgLen = 1024 * 1024 * 10
 	}
@@ -123,7 +298,75 @@ func DialTCP(endpoint string, options TCPTransportOptions) (*TCPTransport, error
 	return &TCPTransport{
 		options: options,
 		Conn:    c,
-	}, nil
+		codec:   newTCPCodec(options.Mode),
+		r:       c,
+	}
+}
+
+// AcceptTCP returns a server transport over an incoming connection, using
+// whatever mode the client has chosen. options.Mode is ignored.
+func AcceptTCP(c net.Conn, options TCPTransportOptions) (*TCPTransport, error) {
+	var key []byte
+	if secret := options.ProxySecret; secret != nil {
+		key = secret.Key
+		options.Obfuscated = true
+		if secret.FakeTLS() {
+			var err error
+			c, err = fakeTLSServerHandshake(c, secret, time.Now())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if options.Obfuscated {
+		header := make([]byte, obfuscatedHeaderLen)
+		if _, err := io.ReadFull(c, header); err != nil {
+			return nil, err
+		}
+		mode, dc, ob, err := acceptObfuscatedHeader(header, key)
+		if err != nil {
+			return nil, err
+		}
+		if secret := options.ProxySecret; secret != nil && secret.mode(mode) != mode {
+			return nil, fmt.Errorf("MTProxy client chose %v mode", mode)
+		}
+
+		options.Mode = mode
+		options.DC = dc
+		tr := newTCPTransport(c, options)
+		tr.isServer = true
+		tr.obfuscate(ob)
+		return tr, nil
+	}
+
+	mode, prefix, err := detectTCPMode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Mode = mode
+	tr := newTCPTransport(c, options)
+	tr.isServer = true
+	if prefix != nil {
+		tr.r = io.MultiReader(bytes.NewReader(prefix), c)
+	}
+	return tr, nil
+}
+
+func (tr *TCPTransport) obfuscate(ob *obfuscator) {
+	tr.ob = ob
+	tr.r = cipher.StreamReader{S: ob.dec, R: tr.r}
+}
+
+// DC returns the DC requested by an obfuscated client.
+func (tr *TCPTransport) DC() int {
+	return tr.options.DC
+}
+
+// Mode returns the packet framing used by the transport.
+func (tr *TCPTransport) Mode() TCPMode {
+	return tr.options.Mode
 }
 
 func (tr *TCPTransport) Close() {
@@ -131,20 +374,29 @@ func (tr *TCPTransport) Close() {
 }
 
 func (tr *TCPTransport) Send(data []byte) error {
-	data = formatTCPMessage(data, !tr.firstSent)
+	packet := tr.codec.encode(data)
+	if tr.ob != nil {
+		tr.ob.enc.XORKeyStream(packet, packet)
+	}
+	if !tr.firstSent && !tr.isServer {
+		prefix := tr.codec.tag()
+		if tr.ob != nil {
+			prefix = tr.header
+		}
+		packet = append(append([]byte(nil), prefix...), packet...)
+	}
 	tr.firstSent = true
 	// log.Printf("mtproto.TCPTransport: sending %d bytes", len(data))
-	_, err := tr.Conn.Write(data)
+	_, err := tr.Conn.Write(packet)
 	return err
 }
 
 func (tr *TCPTransport) Recv() ([]byte, int, error) {
-	raw, err := ReadAbridgedTCPMessage(tr.Conn, tr.options.MaxMsgLen, 0, 0)
-	if err != nil {
-		return nil, 0, err
-	}
-	if raw == nil {
+	raw, err := tr.codec.decode(tr.r, tr.options.MaxMsgLen)
+	if _, ok := err.(net.Error); ok || err == io.ErrUnexpectedEOF {
 		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, err
 	}
 
 	if len(raw) == 4 {
@@ -0,0 +1,245 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+)
+
+func testPackets() [][]byte {
+	// unencrypted: auth_key_id 0, msg_id, length, 20 bytes of data
+	plain := make([]byte, 40)
+	binints.EncodeUint64LE(0x51e57ac42770964a, plain[8:16])
+	binints.EncodeUint32LE(20, plain[16:20])
+	for i := 20; i < 40; i++ {
+		plain[i] = byte(i)
+	}
+
+	// encrypted: auth_key_id, msg_key, 3 blocks
+	encrypted := make([]byte, 24+48)
+	for i := range encrypted {
+		encrypted[i] = byte(i + 1)
+	}
+
+	// too long for the short abridged length
+	large := make([]byte, 24+16*40)
+	for i := range large {
+		large[i] = byte(i*3 + 1)
+	}
+
+	return [][]byte{plain, encrypted, large}
+}
+
+func TestTCPModesRoundTrip(t *testing.T) {
+	for _, mode := range []TCPMode{TCPAbridged, TCPIntermediate, TCPPaddedIntermediate, TCPFull} {
+		testTCPRoundTrip(t, TCPTransportOptions{Mode: mode})
+	}
+}
+
+func TestTCPObfuscatedRoundTrip(t *testing.T) {
+	for _, mode := range []TCPMode{TCPAbridged, TCPIntermediate, TCPPaddedIntermediate} {
+		testTCPRoundTrip(t, TCPTransportOptions{Mode: mode, Obfuscated: true})
+	}
+}
+
+func testTCPRoundTrip(t *testing.T, options TCPTransportOptions) {
+	mode := options.Mode
+	clientConn, serverConn := net.Pipe()
+	client, err := NewTCPTransport(clientConn, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		for _, p := range testPackets() {
+			if err := client.Send(p); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	server, err := AcceptTCP(serverConn, TCPTransportOptions{Obfuscated: options.Obfuscated})
+	if err != nil {
+		t.Fatalf("%v: AcceptTCP failed: %v", mode, err)
+	}
+	if server.Mode() != mode {
+		t.Errorf("%v: server detected mode %v", mode, server.Mode())
+	}
+	for i, p := range testPackets() {
+		raw, _, err := server.Recv()
+		if err != nil {
+			t.Fatalf("%v: server Recv failed: %v", mode, err)
+		}
+		if !bytes.Equal(raw, p) {
+			t.Errorf("%v: server received packet %d as %x, expected %x", mode, i, raw, p)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("%v: client Send failed: %v", mode, err)
+	}
+
+	go func() {
+		for _, p := range testPackets() {
+			server.Send(p)
+		}
+		server.Send([]byte{0x6c, 0xfe, 0xff, 0xff}) // -404
+	}()
+	for i, p := range testPackets() {
+		raw, _, err := client.Recv()
+		if err != nil {
+			t.Fatalf("%v: client Recv failed: %v", mode, err)
+		}
+		if !bytes.Equal(raw, p) {
+			t.Errorf("%v: client received packet %d as %x, expected %x", mode, i, raw, p)
+		}
+	}
+	if raw, code, err := client.Recv(); raw != nil || code != -404 || err != nil {
+		t.Errorf("%v: client Recv of error code == %x, %d, %v, expected -404", mode, raw, code, err)
+	}
+
+	client.Close()
+	if _, _, err := server.Recv(); err != io.EOF {
+		t.Errorf("%v: server Recv after close == %v, expected EOF", mode, err)
+	}
+}
+
+func TestTCPWireFormat(t *testing.T) {
+	data := testPackets()[1]
+	tests := []struct {
+		mode   TCPMode
+		header []byte
+	}{
+		{TCPAbridged, []byte{0xef, byte(len(data) / 4)}},
+		{TCPIntermediate, []byte{0xee, 0xee, 0xee, 0xee, byte(len(data)), 0, 0, 0}},
+		{TCPFull, []byte{byte(len(data) + 12), 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		clientConn, serverConn := net.Pipe()
+		client, err := NewTCPTransport(clientConn, TCPTransportOptions{Mode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Send(data)
+
+		wire := make([]byte, len(tt.header)+len(data))
+		if _, err := io.ReadFull(serverConn, wire); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wire[:len(tt.header)], tt.header) || !bytes.Equal(wire[len(tt.header):], data) {
+			t.Errorf("%v: sent %x, expected %x followed by the data", tt.mode, wire, tt.header)
+		}
+
+		if tt.mode == TCPFull {
+			var crc [4]byte
+			if _, err := io.ReadFull(serverConn, crc[:]); err != nil {
+				t.Fatal(err)
+			}
+			if a, e := binints.DecodeUint32LE(crc[:]), crc32.ChecksumIEEE(wire); a != e {
+				t.Errorf("full: CRC32 is %08x, expected %08x", a, e)
+			}
+		}
+		clientConn.Close()
+	}
+}
+
+func TestTCPFullChecksum(t *testing.T) {
+	var c fullCodec
+	packet := c.encode(testPackets()[1])
+	packet[10] ^= 1
+
+	var d fullCodec
+	if _, err := d.decode(bytes.NewReader(packet), 1024); err != ErrTCPChecksum {
+		t.Errorf("decode of a corrupted packet returned %v, expected %v", err, ErrTCPChecksum)
+	}
+}
+
+func TestObfuscatedHeader(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		header, _, err := newObfuscatedHeader(TCPIntermediate, -2, nil, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header[0] == 0xef || forbiddenObfuscatedPrefixes[binints.DecodeUint32LE(header[:4])] || binints.DecodeUint32LE(header[4:8]) == 0 {
+			t.Fatalf("header %x looks like another protocol", header)
+		}
+
+		mode, dc, _, err := acceptObfuscatedHeader(header, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != TCPIntermediate || dc != -2 {
+			t.Fatalf("header decoded as mode %v, DC %d, expected intermediate, -2", mode, dc)
+		}
+	}
+
+	if _, _, err := newObfuscatedHeader(TCPFull, 0, nil, rand.Reader); err != ErrObfuscatedFull {
+		t.Errorf("obfuscating the full mode returned %v, expected %v", err, ErrObfuscatedFull)
+	}
+}
+
+func TestObfuscatedWireFormat(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	client, err := NewTCPTransport(clientConn, TCPTransportOptions{Obfuscated: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testPackets()[1]
+	go client.Send(data)
+
+	wire := make([]byte, obfuscatedHeaderLen+1+len(data))
+	if _, err := io.ReadFull(serverConn, wire); err != nil {
+		t.Fatal(err)
+	}
+	if wire[0] == 0xef || bytes.Contains(wire, data[8:24]) {
+		t.Errorf("sent %x, expected the packet to be obfuscated", wire)
+	}
+}
+
+func TestDialAnyFallsBack(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	var winner net.Conn
+	dial := func(network, address string) (net.Conn, error) {
+		switch address {
+		case "hanging:443":
+			<-hang
+			return nil, errors.New("timeout")
+		case "failing:443":
+			return nil, errors.New("connection refused")
+		default:
+			c, _ := net.Pipe()
+			winner = c
+			return c, nil
+		}
+	}
+
+	start := time.Now()
+	c, err := dialAny(dial, []string{"hanging:443", "failing:443", "working:443"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c != winner {
+		t.Errorf("got a connection other than the working endpoint's")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fallback took %v", elapsed)
+	}
+
+	_, err = dialAny(dial, []string{"failing:443", "failing:443"}, time.Hour)
+	if err == nil || err.Error() != "connection refused" {
+		t.Errorf("dialAny of failing endpoints returned %v", err)
+	}
+}
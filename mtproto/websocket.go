@@ -0,0 +1,336 @@
+package mtproto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var ErrWebSocketHandshake = errors.New("WebSocket handshake failed")
+
+// DialWebSocket connects to a ws:// or wss:// URL, like
+// wss://venus.web.telegram.org/apiws, and returns a transport sending the
+// packets of options.Mode in binary WebSocket messages. Telegram servers only
+// accept obfuscated connections over WebSocket.
+func DialWebSocket(rawurl string, options TCPTransportOptions) (*TCPTransport, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	var c net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "80")
+		}
+		c, err = options.dial("tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "443")
+		}
+		c, err = options.dial("tcp", host)
+		if err == nil {
+			c = tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := clientWebSocketHandshake(c, u)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	tr, err := NewTCPTransport(ws, options)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+// AcceptWebSocket upgrades an HTTP request to a WebSocket connection and
+// returns a server transport over it, as AcceptTCP would.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request, options TCPTransportOptions) (*TCPTransport, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("cannot hijack the HTTP connection")
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n", webSocketAccept(key))
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", "binary") {
+		brw.WriteString("Sec-WebSocket-Protocol: binary\r\n")
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	tr, err := AcceptTCP(newWebSocketConn(c, brw.Reader, false), options)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+func clientWebSocketHandshake(c net.Conn, u *url.URL) (*webSocketConn, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {"binary"},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, fmt.Errorf("%v: HTTP %s", ErrWebSocketHandshake, resp.Status)
+	}
+	return newWebSocketConn(c, br, true), nil
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn turns the binary messages of a WebSocket connection into a
+// byte stream. Every Write is sent as one message.
+type webSocketConn struct {
+	net.Conn
+	r        *bufio.Reader
+	isClient bool
+
+	// remaining payload of the current frame
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	writeMut sync.Mutex
+}
+
+func newWebSocketConn(c net.Conn, r *bufio.Reader, isClient bool) *webSocketConn {
+	return &webSocketConn{Conn: c, r: r, isClient: isClient}
+}
+
+func (ws *webSocketConn) Read(b []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.readFrameHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > ws.remaining {
+		b = b[:ws.remaining]
+	}
+	n, err := ws.r.Read(b)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= ws.mask[ws.maskPos%4]
+			ws.maskPos++
+		}
+	}
+	ws.remaining -= uint64(n)
+	return n, err
+}
+
+// readFrameHeader reads frame headers until one starting data arrives,
+// handling control frames on the way.
+func (ws *webSocketConn) readFrameHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		ws.remaining = length
+		ws.mask = mask
+		ws.masked = masked
+		ws.maskPos = 0
+		return nil
+	case wsPing, wsPong, wsClose:
+		if length > 125 {
+			return errors.New("WebSocket control frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case wsPing:
+			return ws.writeFrame(wsPong, payload)
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return io.EOF
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected WebSocket opcode %d", opcode)
+	}
+}
+
+func (ws *webSocketConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if ws.isClient {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	if ws.isClient {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, v := range payload {
+			frame = append(frame, v^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	ws.writeMut.Lock()
+	defer ws.writeMut.Unlock()
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+func (ws *webSocketConn) Close() error {
+	ws.writeMut.Lock()
+	ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	ws.writeMut.Unlock()
+	ws.writeFrame(wsClose, nil)
+	return ws.Conn.Close()
+}
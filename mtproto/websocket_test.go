@@ -0,0 +1,96 @@
+package mtproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apiws" {
+			http.NotFound(w, r)
+			return
+		}
+		tr, err := AcceptWebSocket(w, r, TCPTransportOptions{Obfuscated: r.URL.Query().Get("obfuscated") != ""})
+		if err != nil {
+			t.Errorf("AcceptWebSocket failed: %v", err)
+			return
+		}
+		defer tr.Close()
+
+		// echo the packets back
+		for {
+			raw, _, err := tr.Recv()
+			if err != nil {
+				return
+			}
+			if err := tr.Send(raw); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/apiws"
+	tests := []struct {
+		url     string
+		options TCPTransportOptions
+	}{
+		{wsURL, TCPTransportOptions{Mode: TCPIntermediate}},
+		{wsURL, TCPTransportOptions{Mode: TCPAbridged}},
+		{wsURL + "?obfuscated=1", TCPTransportOptions{Mode: TCPPaddedIntermediate, Obfuscated: true}},
+	}
+	for _, tt := range tests {
+		client, err := DialWebSocket(tt.url, tt.options)
+		if err != nil {
+			t.Fatalf("%v: DialWebSocket failed: %v", tt.options.Mode, err)
+		}
+
+		for i, p := range testPackets() {
+			if err := client.Send(p); err != nil {
+				t.Fatalf("%v: Send failed: %v", tt.options.Mode, err)
+			}
+			raw, _, err := client.Recv()
+			if err != nil {
+				t.Fatalf("%v: Recv failed: %v", tt.options.Mode, err)
+			}
+			if !bytes.Equal(raw, p) {
+				t.Errorf("%v: packet %d echoed as %x, expected %x", tt.options.Mode, i, raw, p)
+			}
+		}
+		client.Close()
+	}
+
+	if _, err := DialWebSocket("ws"+strings.TrimPrefix(srv.URL, "http")+"/other", TCPTransportOptions{}); err == nil {
+		t.Errorf("DialWebSocket succeeded without an upgrade")
+	}
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	client := newWebSocketConn(clientConn, bufio.NewReader(clientConn), true)
+	server := newWebSocketConn(serverConn, bufio.NewReader(serverConn), false)
+
+	// short, 16-bit and 64-bit payload lengths, in both directions
+	for _, n := range []int{5, 300, 70000} {
+		for _, pair := range [][2]*webSocketConn{{client, server}, {server, client}} {
+			payload := bytes.Repeat([]byte{0xab, 0xcd, 0xef}, n/3)
+			go pair[0].Write(payload)
+
+			received := make([]byte, len(payload))
+			if _, err := io.ReadFull(pair[1], received); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, payload) {
+				t.Errorf("%d byte message (client sending: %v) read back incorrectly", len(payload), pair[0].isClient)
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package telegramapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// how many *_MIGRATE_X redirects SendToDC follows before giving up
+const maxMigrateHops = 3
+
+var errPoolClosed = errors.New("connection is shutting down")
+
+// dcSession is a connection to a DC other than the home one, or a media
+// connection to any DC.
+type dcSession struct {
+	id      int
+	media   bool
+	session *mtproto.Session
+
+	// closed once the session is ready for use or has failed to start
+	readyc chan struct{}
+	err    error
+}
+
+// dcPool keeps sessions to the non-home DCs and media sessions, opened on
+// demand, e.g. to download files stored elsewhere.
+type dcPool struct {
+	conn *Conn
+
+	mut      sync.Mutex
+	sessions map[int]*dcSession
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newDCPool(c *Conn) *dcPool {
+	return &dcPool{
+		conn:     c,
+		sessions: make(map[int]*dcSession),
+	}
+}
+
+// poolKey returns the key of a session in dcPool.sessions; media sessions
+// use the negated DC ID, like MTProto proxies do.
+func poolKey(id int, media bool) int {
+	if media {
+		return -id
+	}
+	return id
+}
+
+func (e *dcSession) key() int {
+	return poolKey(e.id, e.media)
+}
+
+// get returns a ready session to the given DC, connecting and importing the
+// login into it if needed. Media sessions connect to the media addresses of
+// the DC and share the auth key of the main one.
+func (p *dcPool) get(ctx context.Context, id int, media bool) (*mtproto.Session, error) {
+	p.mut.Lock()
+	if p.closed {
+		p.mut.Unlock()
+		return nil, errPoolClosed
+	}
+	e := p.sessions[poolKey(id, media)]
+	if e == nil {
+		e = &dcSession{id: id, media: media, readyc: make(chan struct{})}
+		p.sessions[e.key()] = e
+		p.wg.Add(1)
+		go p.run(e)
+	}
+	p.mut.Unlock()
+
+	select {
+	case <-e.readyc:
+		if e.err != nil {
+			return nil, e.err
+		}
+		return e.session, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reset drops the sessions to the given DC, so that the next get reconnects
+// and imports the login again.
+func (p *dcPool) reset(id int) {
+	p.conn.updateState(func(state *State) {
+		if dc := state.DCs[id]; dc != nil {
+			dc.Authorized = false
+		}
+	})
+
+	p.mut.Lock()
+	var dropped []*dcSession
+	for _, media := range []bool{false, true} {
+		if e := p.sessions[poolKey(id, media)]; e != nil {
+			dropped = append(dropped, e)
+			delete(p.sessions, e.key())
+		}
+	}
+	p.mut.Unlock()
+
+	for _, e := range dropped {
+		<-e.readyc
+		if e.session != nil {
+			e.session.Shutdown()
+		}
+	}
+}
+
+func (p *dcPool) remove(e *dcSession) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.sessions[e.key()] == e {
+		delete(p.sessions, e.key())
+	}
+}
+
+func (p *dcPool) run(e *dcSession) {
+	defer p.wg.Done()
+	defer p.remove(e)
+
+	c := p.conn
+	if e.media && e.id != c.homeDC() {
+		// make sure the DC has an auth key for both sessions to use
+		if _, err := p.get(context.Background(), e.id, false); err != nil {
+			e.err = err
+			close(e.readyc)
+			return
+		}
+	}
+
+	c.stateMut.Lock()
+	dc := c.state.DCs[e.id]
+	_, haveCDNKey := c.state.CDNPublicKeys[e.id]
+	if dc != nil {
+		dc = dc.Clone()
+	}
+	c.stateMut.Unlock()
+	if dc == nil {
+		e.err = fmt.Errorf("unknown DC %d", e.id)
+		close(e.readyc)
+		return
+	}
+
+	if dc.IsCDN() && !haveCDNKey {
+		if err := c.LoadCDNConfig(context.Background()); err != nil {
+			e.err = err
+			close(e.readyc)
+			return
+		}
+	}
+
+	sess, err := c.newSession(dc, e.media)
+	if err != nil {
+		e.err = err
+		close(e.readyc)
+		return
+	}
+	sess.OnStateChanged(func() {
+		p.saveSessionState(e, sess)
+	})
+
+	p.mut.Lock()
+	e.session = sess
+	if p.closed {
+		go sess.Shutdown()
+	}
+	p.mut.Unlock()
+
+	go func() {
+		e.err = p.setup(sess, dc)
+		if e.err != nil {
+			sess.Shutdown()
+		}
+		close(e.readyc)
+	}()
+
+	sess.Run()
+	p.saveSessionState(e, sess)
+}
+
+// setup waits for the session to become ready and makes sure it is logged in.
+func (p *dcPool) setup(sess *mtproto.Session, dc *DCState) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sess.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := sess.WaitReadyContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// while the home DC is unknown, the authorization is not imported, and
+	// an AUTH_KEY_UNREGISTERED error later makes sendToDC try again
+	c := p.conn
+	home := c.homeDC()
+	if dc.Authorized || dc.IsCDN() || home == 0 || dc.ID == home || c.LoginState() != LoggedIn {
+		return nil
+	}
+
+	r, err := c.SendContext(ctx, &mtproto.TLAuthExportAuthorization{DCID: dc.ID})
+	if err != nil {
+		return err
+	}
+	exported, ok := r.(*mtproto.TLAuthExportedAuthorization)
+	if !ok {
+		return c.HandleUnknownReply(r)
+	}
+
+	r, err = sess.SendContext(ctx, &mtproto.TLAuthImportAuthorization{ID: exported.ID, Bytes: exported.Bytes})
+	if err != nil {
+		return err
+	}
+	switch r := r.(type) {
+	case *mtproto.TLAuthAuthorization:
+	case *mtproto.TLRPCError:
+		return NewRPCError(r)
+	default:
+		return c.HandleUnknownReply(r)
+	}
+
+	c.updateState(func(state *State) {
+		if dc := state.DCs[dc.ID]; dc != nil {
+			dc.Authorized = true
+		}
+	})
+	return nil
+}
+
+// saveSessionState saves the auth key of a session. The framer state is only
+// saved for main sessions, as media ones run sessions of their own.
+func (p *dcPool) saveSessionState(e *dcSession, sess *mtproto.Session) {
+	auth, fs := sess.AuthState()
+	if auth == nil || auth.KeyID == 0 {
+		return
+	}
+	p.conn.updateState(func(state *State) {
+		dc := state.DCs[e.id]
+		if dc == nil {
+			return
+		}
+		if dc.Auth.KeyID != auth.KeyID {
+			if e.media && dc.Auth.KeyID != 0 {
+				return
+			}
+			dc.Auth = *auth
+			if e.media {
+				dc.Auth.SessionID = [8]byte{}
+			}
+			dc.FramerState = mtproto.FramerState{}
+			dc.Authorized = false
+		}
+		if !e.media {
+			dc.FramerState = fs
+		}
+	})
+}
+
+// closeAll shuts down all sessions and waits for them to exit.
+func (p *dcPool) closeAll() {
+	p.mut.Lock()
+	p.closed = true
+	var sessions []*mtproto.Session
+	for _, e := range p.sessions {
+		if e.session != nil {
+			sessions = append(sessions, e.session)
+		}
+	}
+	p.mut.Unlock()
+
+	for _, sess := range sessions {
+		sess.Shutdown()
+	}
+	p.wg.Wait()
+}
+
+// SendToDC sends a request to the given DC, connecting to it and importing
+// the current login if needed. DC 0 means the home DC. FILE_MIGRATE_X
+// errors are followed by resending the request to DC X.
+func (c *Conn) SendToDC(ctx context.Context, dc int, o tl.Object) (tl.Object, error) {
+	return c.sendToDC(ctx, dc, false, o)
+}
+
+// SendToMediaDC is like SendToDC, but uses a separate connection to the
+// media addresses of the DC, so that file transfers do not hold up other
+// requests.
+func (c *Conn) SendToMediaDC(ctx context.Context, dc int, o tl.Object) (tl.Object, error) {
+	return c.sendToDC(ctx, dc, true, o)
+}
+
+func (c *Conn) sendToDC(ctx context.Context, dc int, media bool, o tl.Object) (tl.Object, error) {
+	r, _, err := c.sendToDCFollow(ctx, dc, media, o)
+	return r, err
+}
+
+// sendToDCFollow is sendToDC that also returns the DC which answered, so
+// that further requests for the same file can go there directly.
+func (c *Conn) sendToDCFollow(ctx context.Context, dc int, media bool, o tl.Object) (tl.Object, int, error) {
+	reauthorized := false
+	for hops := 0; ; hops++ {
+		home := c.homeDC()
+		if dc == 0 {
+			dc = home
+		}
+		if dc == 0 && media {
+			return nil, 0, errors.New("home DC is not known yet")
+		}
+
+		var r tl.Object
+		var err error
+		if dc == home && !media {
+			r, err = c.SendContext(ctx, o)
+		} else {
+			r, err = c.scheduler.do(ctx, o, func(ctx context.Context, o tl.Object) (tl.Object, error) {
+				sess, err := c.pool.get(ctx, dc, media)
+				if err != nil {
+					return nil, err
+				}
+				return sess.SendContext(ctx, o)
+			})
+		}
+		if err != nil {
+			return nil, dc, err
+		}
+
+		e, ok := r.(*mtproto.TLRPCError)
+		if !ok {
+			return r, dc, nil
+		}
+		rpcErr := NewRPCError(e)
+		if rpcErr.Type == ErrTypeFileMigrate && hops < maxMigrateHops {
+			dc = rpcErr.Arg
+			continue
+		}
+		if errors.Is(rpcErr, ErrAuthKeyUnregistered) && dc != home && !reauthorized {
+			reauthorized = true
+			c.pool.reset(dc)
+			continue
+		}
+		return r, dc, nil
+	}
+}
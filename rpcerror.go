@@ -0,0 +1,89 @@
+package telegramapi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+)
+
+const (
+	ErrTypeFloodWait             = "FLOOD_WAIT"
+	ErrTypePhoneMigrate          = "PHONE_MIGRATE"
+	ErrTypeFileMigrate           = "FILE_MIGRATE"
+	ErrTypeUserMigrate           = "USER_MIGRATE"
+	ErrTypeNetworkMigrate        = "NETWORK_MIGRATE"
+	ErrTypeSessionPasswordNeeded = "SESSION_PASSWORD_NEEDED"
+	ErrTypeAuthKeyUnregistered   = "AUTH_KEY_UNREGISTERED"
+)
+
+// Sentinel errors to be used with errors.Is.
+var (
+	ErrSessionPasswordNeeded = &RPCError{Code: 401, Type: ErrTypeSessionPasswordNeeded}
+	ErrAuthKeyUnregistered   = &RPCError{Code: 401, Type: ErrTypeAuthKeyUnregistered}
+)
+
+// RPCError is an rpc_error returned by the server. Errors like FLOOD_WAIT_X
+// and PHONE_MIGRATE_X carry a numeric argument, which is split off into Arg,
+// leaving the rest of the message in Type.
+type RPCError struct {
+	Code    int
+	Message string
+	Type    string
+	Arg     int
+}
+
+func NewRPCError(r *mtproto.TLRPCError) *RPCError {
+	e := &RPCError{
+		Code:    r.ErrorCode,
+		Message: r.ErrorMessage,
+		Type:    r.ErrorMessage,
+	}
+
+	if i := strings.LastIndexByte(r.ErrorMessage, '_'); i >= 0 {
+		if n, err := strconv.Atoi(r.ErrorMessage[i+1:]); err == nil {
+			e.Type = r.ErrorMessage[:i]
+			e.Arg = n
+		}
+	}
+
+	return e
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("telegram error %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is an *RPCError of the same type. A zero Code
+// in target matches any code.
+func (e *RPCError) Is(target error) bool {
+	t, ok := target.(*RPCError)
+	if !ok {
+		return false
+	}
+	return t.Type == e.Type && (t.Code == 0 || t.Code == e.Code)
+}
+
+// IsFloodWait returns the time to wait if err is a FLOOD_WAIT_X error.
+func IsFloodWait(err error) (time.Duration, bool) {
+	var e *RPCError
+	if errors.As(err, &e) && e.Type == ErrTypeFloodWait {
+		return time.Duration(e.Arg) * time.Second, true
+	}
+	return 0, false
+}
+
+// IsMigrate returns the target DC if err is one of the *_MIGRATE_X errors.
+func IsMigrate(err error) (int, bool) {
+	var e *RPCError
+	if errors.As(err, &e) && e.Code == 303 {
+		switch e.Type {
+		case ErrTypePhoneMigrate, ErrTypeFileMigrate, ErrTypeUserMigrate, ErrTypeNetworkMigrate:
+			return e.Arg, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package telegramapi
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+)
+
+func TestNewRPCError(t *testing.T) {
+	tests := []struct {
+		code    int
+		message string
+		typ     string
+		arg     int
+	}{
+		{420, "FLOOD_WAIT_30", ErrTypeFloodWait, 30},
+		{303, "FILE_MIGRATE_4", ErrTypeFileMigrate, 4},
+		{401, "SESSION_PASSWORD_NEEDED", ErrTypeSessionPasswordNeeded, 0},
+		{400, "PHONE_NUMBER_INVALID", "PHONE_NUMBER_INVALID", 0},
+	}
+	for _, tt := range tests {
+		e := NewRPCError(&mtproto.TLRPCError{ErrorCode: tt.code, ErrorMessage: tt.message})
+		if e.Code != tt.code || e.Message != tt.message || e.Type != tt.typ || e.Arg != tt.arg {
+			t.Errorf("NewRPCError(%d, %q) == %+v, expected type %q, arg %d", tt.code, tt.message, *e, tt.typ, tt.arg)
+		}
+	}
+}
+
+func TestRPCErrorHelpers(t *testing.T) {
+	flood := fmt.Errorf("loading history: %w", NewRPCError(&mtproto.TLRPCError{ErrorCode: 420, ErrorMessage: "FLOOD_WAIT_7"}))
+	if d, ok := IsFloodWait(flood); !ok || d != 7*time.Second {
+		t.Errorf("IsFloodWait == %v, %v, expected 7s, true", d, ok)
+	}
+	if _, ok := IsMigrate(flood); ok {
+		t.Errorf("IsMigrate(FLOOD_WAIT) == true")
+	}
+
+	migrate := NewRPCError(&mtproto.TLRPCError{ErrorCode: 303, ErrorMessage: "USER_MIGRATE_2"})
+	if dc, ok := IsMigrate(migrate); !ok || dc != 2 {
+		t.Errorf("IsMigrate == %v, %v, expected 2, true", dc, ok)
+	}
+
+	pw := NewRPCError(&mtproto.TLRPCError{ErrorCode: 401, ErrorMessage: "SESSION_PASSWORD_NEEDED"})
+	if !errors.Is(pw, ErrSessionPasswordNeeded) {
+		t.Errorf("errors.Is(%v, ErrSessionPasswordNeeded) == false", pw)
+	}
+	if errors.Is(pw, ErrAuthKeyUnregistered) {
+		t.Errorf("errors.Is(%v, ErrAuthKeyUnregistered) == true", pw)
+	}
+}
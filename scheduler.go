@@ -0,0 +1,329 @@
+package telegramapi
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+const DefaultMaxRetries = 5
+
+// how long to wait before retrying an idempotent call after a transient server error
+const transientErrorDelay = 1 * time.Second
+
+var namespaces = map[string]bool{
+	"auth": true, "account": true, "users": true, "contacts": true,
+	"messages": true, "updates": true, "photos": true, "upload": true,
+	"help": true, "channels": true, "bots": true, "payments": true,
+	"stickers": true, "phone": true, "langpack": true,
+}
+
+// MethodName returns the TL name of a request, e.g. "messages.getHistory" for
+// *mtproto.TLMessagesGetHistory.
+func MethodName(o tl.Object) string {
+	name := strings.TrimPrefix(tl.Name(o), "TL")
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			ns := strings.ToLower(name[:i])
+			if namespaces[ns] {
+				return ns + "." + lowerFirst(name[i:])
+			}
+			break
+		}
+	}
+	return lowerFirst(name)
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// Limiter decides when a request for the given method (see MethodName) may be
+// sent. Pause is called when the server asks to wait before calling the
+// method again.
+type Limiter interface {
+	Wait(ctx context.Context, method string) error
+	Pause(method string, d time.Duration)
+}
+
+// TokenBucket allows Rate requests per second on average, with bursts of up
+// to Burst requests.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	mut         sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: burst}
+}
+
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.last.IsZero() {
+		b.tokens = float64(b.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > float64(b.Burst) {
+			b.tokens = float64(b.Burst)
+		}
+	}
+	b.last = now
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.Rate * float64(time.Second))
+	}
+	if p := b.pausedUntil.Sub(now); p > wait {
+		wait = p
+	}
+	return wait
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *TokenBucket) Pause(d time.Duration) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if until := time.Now().Add(d); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// FamilyLimiter keeps a token bucket per method family (the namespace part of
+// the method name, like "messages"). Methods of other families are not limited.
+type FamilyLimiter struct {
+	Families map[string]*TokenBucket
+}
+
+// NewDefaultLimiter returns the limiter used when Options.Limiter is nil.
+func NewDefaultLimiter() *FamilyLimiter {
+	return &FamilyLimiter{
+		Families: map[string]*TokenBucket{
+			"messages": NewTokenBucket(1, 5),
+			"contacts": NewTokenBucket(0.5, 2),
+			"upload":   NewTokenBucket(10, 10),
+		},
+	}
+}
+
+func (l *FamilyLimiter) bucket(method string) *TokenBucket {
+	i := strings.IndexByte(method, '.')
+	if i < 0 {
+		return nil
+	}
+	return l.Families[method[:i]]
+}
+
+func (l *FamilyLimiter) Wait(ctx context.Context, method string) error {
+	if b := l.bucket(method); b != nil {
+		return b.Wait(ctx)
+	}
+	return nil
+}
+
+func (l *FamilyLimiter) Pause(method string, d time.Duration) {
+	if b := l.bucket(method); b != nil {
+		b.Pause(d)
+	}
+}
+
+// MethodStats are the per-method counters returned by Conn.Stats.
+type MethodStats struct {
+	Calls      int
+	Retries    int
+	Errors     int
+	FloodWaits int
+
+	FloodWaitTime time.Duration
+	Latency       time.Duration
+}
+
+type scheduler struct {
+	limiter      Limiter
+	maxFloodWait time.Duration
+	maxRetries   int
+	verbose      int
+
+	mut   sync.Mutex
+	stats map[string]*MethodStats
+}
+
+func newScheduler(limiter Limiter, maxFloodWait time.Duration, maxRetries int, verbose int) *scheduler {
+	return &scheduler{
+		limiter:      limiter,
+		maxFloodWait: maxFloodWait,
+		maxRetries:   maxRetries,
+		verbose:      verbose,
+		stats:        make(map[string]*MethodStats),
+	}
+}
+
+func (s *scheduler) Stats() map[string]MethodStats {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	result := make(map[string]MethodStats, len(s.stats))
+	for method, st := range s.stats {
+		result[method] = *st
+	}
+	return result
+}
+
+func (s *scheduler) record(method string, f func(st *MethodStats)) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	st := s.stats[method]
+	if st == nil {
+		st = new(MethodStats)
+		s.stats[method] = st
+	}
+	f(st)
+}
+
+// idempotentMethods lists the calls that can safely be repeated after a
+// transient error, when the server might or might not have executed them.
+// Only plain reads and the upload part calls (which overwrite the same part)
+// belong here; calls like auth.checkPassword or messages.getMessagesViews
+// have side effects and must not be retried blindly.
+var idempotentMethods = map[string]bool{
+	"help.getConfig":                    true,
+	"help.getNearestDC":                 true,
+	"help.getCdnConfig":                 true,
+	"help.getSupport":                   true,
+	"help.getInviteText":                true,
+	"help.getTermsOfService":            true,
+	"users.getUsers":                    true,
+	"users.getFullUser":                 true,
+	"contacts.getContacts":              true,
+	"contacts.getStatuses":              true,
+	"contacts.getBlocked":               true,
+	"contacts.getTopPeers":              true,
+	"contacts.search":                   true,
+	"contacts.resolveUsername":          true,
+	"messages.getMessages":              true,
+	"messages.getDialogs":               true,
+	"messages.getPeerDialogs":           true,
+	"messages.getPinnedDialogs":         true,
+	"messages.getHistory":               true,
+	"messages.search":                   true,
+	"messages.searchGlobal":             true,
+	"messages.getChats":                 true,
+	"messages.getAllChats":              true,
+	"messages.getCommonChats":           true,
+	"messages.getFullChat":              true,
+	"messages.getPeerSettings":          true,
+	"messages.getDHConfig":              true,
+	"messages.getWebPage":               true,
+	"messages.getWebPagePreview":        true,
+	"messages.getStickerSet":            true,
+	"messages.getAllStickers":           true,
+	"messages.getDocumentByHash":        true,
+	"updates.getState":                  true,
+	"updates.getDifference":             true,
+	"updates.getChannelDifference":      true,
+	"photos.getUserPhotos":              true,
+	"upload.getFile":                    true,
+	"upload.getWebFile":                 true,
+	"upload.saveFilePart":               true,
+	"upload.saveBigFilePart":            true,
+	"channels.getMessages":              true,
+	"channels.getParticipants":          true,
+	"channels.getParticipant":           true,
+	"channels.getChannels":              true,
+	"channels.getFullChannel":           true,
+	"channels.getAdminedPublicChannels": true,
+}
+
+func isTransient(err *RPCError) bool {
+	return err.Code >= 500 || err.Code < 0
+}
+
+func (s *scheduler) do(ctx context.Context, o tl.Object, send func(ctx context.Context, o tl.Object) (tl.Object, error)) (tl.Object, error) {
+	method := MethodName(o)
+
+	for attempt := 0; ; attempt++ {
+		if err := s.limiter.Wait(ctx, method); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		r, err := send(ctx, o)
+		elapsed := time.Since(start)
+
+		var rpcErr *RPCError
+		if e, ok := r.(*mtproto.TLRPCError); ok && err == nil {
+			rpcErr = NewRPCError(e)
+		}
+		s.record(method, func(st *MethodStats) {
+			st.Calls++
+			st.Latency += elapsed
+			if attempt > 0 {
+				st.Retries++
+			}
+			if err != nil || rpcErr != nil {
+				st.Errors++
+			}
+		})
+		if err != nil || rpcErr == nil || attempt >= s.maxRetries {
+			return r, err
+		}
+
+		var delay time.Duration
+		if d, ok := IsFloodWait(rpcErr); ok && d <= s.maxFloodWait {
+			s.limiter.Pause(method, d)
+			s.record(method, func(st *MethodStats) {
+				st.FloodWaits++
+				st.FloodWaitTime += d
+			})
+			delay = d
+		} else if isTransient(rpcErr) && idempotentMethods[method] {
+			delay = transientErrorDelay
+		} else {
+			return r, err
+		}
+
+		if s.verbose >= 1 {
+			log.Printf("%v, retrying %s in %v", rpcErr, method, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package telegramapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+func TestMethodName(t *testing.T) {
+	tests := []struct {
+		input    tl.Object
+		expected string
+	}{
+		{&mtproto.TLMessagesGetHistory{}, "messages.getHistory"},
+		{&mtproto.TLUploadSaveBigFilePart{}, "upload.saveBigFilePart"},
+		{&mtproto.TLHelpGetConfig{}, "help.getConfig"},
+		{&mtproto.TLInvokeWithLayer{}, "invokeWithLayer"},
+	}
+	for _, tt := range tests {
+		if a := MethodName(tt.input); a != tt.expected {
+			t.Errorf("MethodName(%T) == %q, expected %q", tt.input, a, tt.expected)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(2, 2)
+	now := time.Now()
+	if w := b.reserve(now); w != 0 {
+		t.Errorf("1st reserve waits %v, expected 0", w)
+	}
+	if w := b.reserve(now); w != 0 {
+		t.Errorf("2nd reserve waits %v, expected 0", w)
+	}
+	if w := b.reserve(now); w != 500*time.Millisecond {
+		t.Errorf("3rd reserve waits %v, expected 500ms", w)
+	}
+	if w := b.reserve(now.Add(2 * time.Second)); w != 0 {
+		t.Errorf("reserve after refill waits %v, expected 0", w)
+	}
+}
+
+type nopLimiter struct {
+	paused []time.Duration
+}
+
+func (l *nopLimiter) Wait(ctx context.Context, method string) error {
+	return nil
+}
+
+func (l *nopLimiter) Pause(method string, d time.Duration) {
+	l.paused = append(l.paused, d)
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	limiter := &nopLimiter{}
+	s := newScheduler(limiter, time.Minute, 3, 0)
+
+	replies := []tl.Object{
+		&mtproto.TLRPCError{ErrorCode: 420, ErrorMessage: "FLOOD_WAIT_0"},
+		&mtproto.TLRPCError{ErrorCode: 420, ErrorMessage: "FLOOD_WAIT_0"},
+		&mtproto.TLConfig{},
+	}
+	var calls int
+	r, err := s.do(context.Background(), &mtproto.TLHelpGetConfig{}, func(ctx context.Context, o tl.Object) (tl.Object, error) {
+		calls++
+		return replies[calls-1], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*mtproto.TLConfig); !ok {
+		t.Errorf("do returned %v, expected config", r)
+	}
+	if calls != 3 || len(limiter.paused) != 2 {
+		t.Errorf("calls = %d, pauses = %d, expected 3 and 2", calls, len(limiter.paused))
+	}
+
+	st := s.Stats()["help.getConfig"]
+	if st.Calls != 3 || st.Retries != 2 || st.FloodWaits != 2 || st.Errors != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	// non-idempotent calls are not retried after transient errors
+	calls = 0
+	r, err = s.do(context.Background(), &mtproto.TLMessagesSendMessage{}, func(ctx context.Context, o tl.Object) (tl.Object, error) {
+		calls++
+		return &mtproto.TLRPCError{ErrorCode: 500, ErrorMessage: "INTERNAL"}, nil
+	})
+	if calls != 1 {
+		t.Errorf("messages.sendMessage called %d times, expected 1", calls)
+	}
+
+	// calls that merely look like reads are not retried either
+	for _, o := range []tl.Object{&mtproto.TLAuthCheckPassword{}, &mtproto.TLAccountCheckUsername{}} {
+		calls = 0
+		s.do(context.Background(), o, func(ctx context.Context, o tl.Object) (tl.Object, error) {
+			calls++
+			return &mtproto.TLRPCError{ErrorCode: 500, ErrorMessage: "INTERNAL"}, nil
+		})
+		if calls != 1 {
+			t.Errorf("%s called %d times, expected 1", MethodName(o), calls)
+		}
+	}
+}
+
+func TestIdempotentMethods(t *testing.T) {
+	for _, o := range []tl.Object{
+		&mtproto.TLHelpGetConfig{},
+		&mtproto.TLHelpGetNearestDC{},
+		&mtproto.TLMessagesGetDHConfig{},
+		&mtproto.TLUploadSaveFilePart{},
+		&mtproto.TLUploadSaveBigFilePart{},
+		&mtproto.TLUploadGetFile{},
+	} {
+		if !idempotentMethods[MethodName(o)] {
+			t.Errorf("%s is not in idempotentMethods", MethodName(o))
+		}
+	}
+}
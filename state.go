@@ -2,7 +2,8 @@ package telegramapi
 
 import (
 	"errors"
-	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/PROger4ever/telegramapi/mtproto"
 	"github.com/PROger4ever/telegramapi/tl"
@@ -18,6 +19,16 @@ func readAuth(o *mtproto.AuthResult, fs *mtproto.FramerState, r *tl.Reader, ver
 	}
 
 	fs.SeqNo = r.ReadUint32()
+
+	if ver >= 7 {
+		fs.FutureSalts = make([]mtproto.FutureSalt, r.ReadInt())
+		for i := range fs.FutureSalts {
+			salt := &fs.FutureSalts[i]
+			salt.Salt = r.ReadUint64()
+			salt.ValidSince = r.ReadInt()
+			salt.ValidUntil = r.ReadInt()
+		}
+	}
 }
 
 func writeAuth(o *mtproto.AuthResult, fs *mtproto.FramerState, w *tl.Writer) {
@@ -30,6 +41,13 @@ func writeAuth(o *mtproto.AuthResult, fs *mtproto.FramerState, w *tl.Writer) {
 	}
 
 	w.WriteUint32(fs.SeqNo)
+
+	w.WriteInt(len(fs.FutureSalts))
+	for _, salt := range fs.FutureSalts {
+		w.WriteUint64(salt.Salt)
+		w.WriteInt(salt.ValidSince)
+		w.WriteInt(salt.ValidUntil)
+	}
 }
 
 type Addr struct {
@@ -38,7 +56,7 @@ type Addr struct {
 }
 
 func (o *Addr) Endpoint() string {
-	return fmt.Sprintf("%s:%d", o.IP, o.Port)
+	return net.JoinHostPort(o.IP, strconv.Itoa(o.Port))
 }
 
 func (o *Addr) Read(r *tl.Reader, ver int) {
@@ -51,30 +69,168 @@ func (o *Addr) Write(w *tl.Writer) {
 	w.WriteInt(o.Port)
 }
 
+// DCAddr is one of the addresses advertised for a DC by help.getConfig.
+type DCAddr struct {
+	Addr
+
+	IPv6      bool
+	MediaOnly bool
+	TCPoOnly  bool
+	CDN       bool
+	Static    bool
+}
+
+func (o *DCAddr) Read(r *tl.Reader, ver int) {
+	o.Addr.Read(r, ver)
+	flags := r.ReadUint32()
+	o.IPv6 = flags&1 != 0
+	o.MediaOnly = flags&2 != 0
+	o.TCPoOnly = flags&4 != 0
+	o.CDN = flags&8 != 0
+	o.Static = flags&16 != 0
+}
+
+func (o *DCAddr) Write(w *tl.Writer) {
+	o.Addr.Write(w)
+	var flags uint32
+	for i, f := range []bool{o.IPv6, o.MediaOnly, o.TCPoOnly, o.CDN, o.Static} {
+		if f {
+			flags |= 1 << uint(i)
+		}
+	}
+	w.WriteUint32(flags)
+}
+
 type DCState struct {
 	ID int
 
+	// the IPv4 address used when no better one is known
 	PrimaryAddr Addr
 
+	// all addresses advertised for the DC
+	Addrs []DCAddr
+
 	Auth        mtproto.AuthResult
 	FramerState mtproto.FramerState
+
+	// whether the login has been imported into this DC; only used for DCs
+	// other than the home one
+	Authorized bool
 }
 
 func (o *DCState) Clone() *DCState {
 	c := *o
+	c.FramerState.FutureSalts = append([]mtproto.FutureSalt(nil), o.FramerState.FutureSalts...)
+	c.Addrs = append([]DCAddr(nil), o.Addrs...)
 	return &c
 }
 
 func (o *DCState) Read(r *tl.Reader, ver int) {
 	o.ID = r.ReadInt()
 	o.PrimaryAddr.Read(r, 1)
-	readAuth(&o.Auth, &o.FramerState, r, 1)
+	readAuth(&o.Auth, &o.FramerState, r, ver)
+	if ver >= 6 {
+		o.Authorized = r.ReadBool()
+	}
+	if ver >= 8 {
+		o.Addrs = make([]DCAddr, r.ReadInt())
+		for i := range o.Addrs {
+			o.Addrs[i].Read(r, ver)
+		}
+	}
 }
 
 func (o *DCState) Write(w *tl.Writer) {
 	w.WriteInt(o.ID)
 	o.PrimaryAddr.Write(w)
 	writeAuth(&o.Auth, &o.FramerState, w)
+	w.WriteBool(o.Authorized)
+	w.WriteInt(len(o.Addrs))
+	for i := range o.Addrs {
+		o.Addrs[i].Write(w)
+	}
+}
+
+// IsCDN reports whether the DC is a CDN DC, which only serves file downloads.
+func (o *DCState) IsCDN() bool {
+	for _, addr := range o.Addrs {
+		if addr.CDN {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdatesState struct {
+	Pts  int
+	Qts  int
+	Date int
+	Seq  int
+
+	ChannelPts map[int]int
+
+	// access hashes of the channels seen in updates, needed to get the
+	// difference of a channel after a gap
+	ChannelAccessHashes map[int]uint64
+}
+
+func (o *UpdatesState) IsZero() bool {
+	return o.Pts == 0 && o.Qts == 0 && o.Date == 0 && o.Seq == 0
+}
+
+func (o *UpdatesState) Clone() UpdatesState {
+	c := *o
+	c.ChannelPts = make(map[int]int, len(o.ChannelPts))
+	for id, pts := range o.ChannelPts {
+		c.ChannelPts[id] = pts
+	}
+	c.ChannelAccessHashes = make(map[int]uint64, len(o.ChannelAccessHashes))
+	for id, hash := range o.ChannelAccessHashes {
+		c.ChannelAccessHashes[id] = hash
+	}
+	return c
+}
+
+func (o *UpdatesState) Read(r *tl.Reader, ver int) {
+	o.Pts = r.ReadInt()
+	o.Qts = r.ReadInt()
+	o.Date = r.ReadInt()
+	o.Seq = r.ReadInt()
+
+	o.ChannelPts = make(map[int]int)
+	n := r.ReadInt()
+	for i := 0; i < n; i++ {
+		id := r.ReadInt()
+		o.ChannelPts[id] = r.ReadInt()
+	}
+
+	o.ChannelAccessHashes = make(map[int]uint64)
+	if ver >= 9 {
+		n := r.ReadInt()
+		for i := 0; i < n; i++ {
+			id := r.ReadInt()
+			o.ChannelAccessHashes[id] = r.ReadUint64()
+		}
+	}
+}
+
+func (o *UpdatesState) Write(w *tl.Writer) {
+	w.WriteInt(o.Pts)
+	w.WriteInt(o.Qts)
+	w.WriteInt(o.Date)
+	w.WriteInt(o.Seq)
+
+	w.WriteInt(len(o.ChannelPts))
+	for id, pts := range o.ChannelPts {
+		w.WriteInt(id)
+		w.WriteInt(pts)
+	}
+
+	w.WriteInt(len(o.ChannelAccessHashes))
+	for id, hash := range o.ChannelAccessHashes {
+		w.WriteInt(id)
+		w.WriteUint64(hash)
+	}
 }
 
 type State struct {
@@ -90,13 +246,24 @@ type State struct {
 	FirstName string
 	LastName  string
 	Username  string
+
+	Updates UpdatesState
+
+	// RSA public keys of the CDN DCs, from help.getCdnConfig
+	CDNPublicKeys map[int]string
 }
 
 func (o *State) Clone() *State {
 	c := *o
+	c.DCs = make(map[int]*DCState, len(o.DCs))
 	for id, dc := range o.DCs {
 		c.DCs[id] = dc.Clone()
 	}
+	c.Updates = o.Updates.Clone()
+	c.CDNPublicKeys = make(map[int]string, len(o.CDNPublicKeys))
+	for id, key := range o.CDNPublicKeys {
+		c.CDNPublicKeys[id] = key
+	}
 	return &c
 }
 
@@ -108,6 +275,15 @@ func (o *State) initialize() {
 	if o.DCs == nil {
 		o.DCs = make(map[int]*DCState)
 	}
+	if o.Updates.ChannelPts == nil {
+		o.Updates.ChannelPts = make(map[int]int)
+	}
+	if o.Updates.ChannelAccessHashes == nil {
+		o.Updates.ChannelAccessHashes = make(map[int]uint64)
+	}
+	if o.CDNPublicKeys == nil {
+		o.CDNPublicKeys = make(map[int]string)
+	}
 }
 
 func (o *State) findPreferredDC() *DCState {
@@ -126,7 +302,7 @@ func (o *State) findPreferredDC() *DCState {
 }
 
 func (o *State) WriteBareTo(w *tl.Writer) {
-	w.WriteInt(4)
+	w.WriteInt(9)
 	w.WriteInt(o.PreferredDC)
 
 	w.WriteInt(len(o.DCs))
@@ -141,11 +317,18 @@ func (o *State) WriteBareTo(w *tl.Writer) {
 	w.WriteString(o.FirstName)
 	w.WriteString(o.LastName)
 	w.WriteString(o.Username)
+	o.Updates.Write(w)
+
+	w.WriteInt(len(o.CDNPublicKeys))
+	for id, key := range o.CDNPublicKeys {
+		w.WriteInt(id)
+		w.WriteString(key)
+	}
 }
 
 func (o *State) ReadBareFrom(r *tl.Reader) {
 	ver := r.ReadInt()
-	if ver < 1 || ver > 4 {
+	if ver < 1 || ver > 9 {
 		r.Fail(errors.New("Unsupported version"))
 	}
 
@@ -155,7 +338,7 @@ func (o *State) ReadBareFrom(r *tl.Reader) {
 	n := r.ReadInt()
 	for i := 0; i < n; i++ {
 		dc := new(DCState)
-		dc.Read(r, 1)
+		dc.Read(r, ver)
 		o.DCs[dc.ID] = dc
 	}
 
@@ -172,4 +355,16 @@ func (o *State) ReadBareFrom(r *tl.Reader) {
 		o.LastName = r.ReadString()
 		o.Username = r.ReadString()
 	}
+	if ver >= 5 {
+		o.Updates.Read(r, ver)
+	}
+
+	o.CDNPublicKeys = make(map[int]string)
+	if ver >= 8 {
+		n := r.ReadInt()
+		for i := 0; i < n; i++ {
+			id := r.ReadInt()
+			o.CDNPublicKeys[id] = r.ReadString()
+		}
+	}
 }
@@ -40,6 +40,9 @@ func NewReprMapper(sch *tlschema.Schema) *ReprMapper {
 			"p_q_inner_data:pq":             "bigint_",
 			"p_q_inner_data:p":              "bigint_",
 			"p_q_inner_data:q":              "bigint_",
+			"p_q_inner_data_temp:pq":        "bigint_",
+			"p_q_inner_data_temp:p":         "bigint_",
+			"p_q_inner_data_temp:q":         "bigint_",
 			"req_DH_params:p":               "bigint_",
 			"req_DH_params:q":               "bigint_",
 			"server_DH_inner_data:dh_prime": "bigint_",
@@ -0,0 +1,673 @@
+package telegramapi
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// how long to wait for a missing update before asking the server for the difference
+const updateGapTimeout = 500 * time.Millisecond
+
+const channelDifferenceLimit = 100
+
+// pseudo channel ID used to track qts in the list of pending updates
+const qtsBox = -1
+
+// Update is a single update delivered to UpdatesDelegate, together with the
+// users and chats mentioned by it.
+type Update struct {
+	Update mtproto.TLUpdateType
+	Date   int
+
+	Users []mtproto.TLUserType
+	Chats []mtproto.TLChatType
+}
+
+// UpdatesDelegate can optionally be implemented by a Delegate to receive
+// real-time updates. Updates are delivered in order and without duplicates
+// on the same goroutine as the other delegate calls.
+type UpdatesDelegate interface {
+	HandleUpdate(u *Update)
+}
+
+type pendingUpdate struct {
+	box      int // 0 for the common box, qtsBox for qts, channel ID otherwise
+	pts      int
+	ptsCount int
+
+	// nil for notifications that only move pts, like updateShortSentMessage
+	update *Update
+}
+
+type pendingSeq struct {
+	updates  []mtproto.TLUpdateType
+	users    []mtproto.TLUserType
+	chats    []mtproto.TLChatType
+	date     int
+	seqStart int
+	seq      int
+}
+
+type updateManager struct {
+	conn     *Conn
+	delegate UpdatesDelegate
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mut     sync.Mutex
+	queue   []tl.Object
+	syncReq bool
+	stopped bool
+	signalc chan struct{}
+	donec   chan struct{}
+	wg      sync.WaitGroup
+
+	// owned by the run goroutine
+	state       UpdatesState
+	pending     []*pendingUpdate
+	pendingSeqs []*pendingSeq
+	gapDeadline time.Time
+	out         []*Update
+	dirty       bool
+}
+
+func newUpdateManager(c *Conn, delegate UpdatesDelegate) *updateManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &updateManager{
+		conn:     c,
+		delegate: delegate,
+		ctx:      ctx,
+		cancel:   cancel,
+
+		signalc: make(chan struct{}, 1),
+		donec:   make(chan struct{}),
+	}
+}
+
+func (m *updateManager) start() {
+	m.conn.stateMut.Lock()
+	m.conn.state.initialize()
+	m.state = m.conn.state.Updates.Clone()
+	m.conn.stateMut.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run()
+	}()
+}
+
+// stop makes the run goroutine exit and waits for it, after which no more
+// delegate calls are queued.
+func (m *updateManager) stop() {
+	m.mut.Lock()
+	if !m.stopped {
+		m.stopped = true
+		m.cancel()
+		close(m.donec)
+	}
+	m.mut.Unlock()
+	m.wg.Wait()
+}
+
+// push queues an Updates object received from the server. Safe to call from any goroutine.
+func (m *updateManager) push(o tl.Object) {
+	m.mut.Lock()
+	m.queue = append(m.queue, o)
+	m.mut.Unlock()
+	m.signal()
+}
+
+// sync asks the manager to fetch the current state (or the difference since
+// the last known state) from the server.
+func (m *updateManager) sync() {
+	m.mut.Lock()
+	m.syncReq = true
+	m.mut.Unlock()
+	m.signal()
+}
+
+func (m *updateManager) signal() {
+	select {
+	case m.signalc <- struct{}{}:
+	default:
+	}
+}
+
+func (m *updateManager) run() {
+	for {
+		var timer *time.Timer
+		var timeoutc <-chan time.Time
+		if !m.gapDeadline.IsZero() {
+			timer = time.NewTimer(time.Until(m.gapDeadline))
+			timeoutc = timer.C
+		}
+
+		select {
+		case <-m.signalc:
+			m.processQueue()
+		case <-timeoutc:
+			m.recoverGaps()
+		case <-m.donec:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		m.commit()
+	}
+}
+
+func (m *updateManager) processQueue() {
+	m.mut.Lock()
+	queue, syncReq := m.queue, m.syncReq
+	m.queue, m.syncReq = nil, false
+	m.mut.Unlock()
+
+	if syncReq {
+		m.syncState()
+	}
+	for _, o := range queue {
+		m.handleUpdates(o)
+	}
+}
+
+// commit saves the state and queues the updates for the delegate. It does
+// not hold m.mut meanwhile, as a slow delegate would otherwise block push,
+// and with it the session.
+func (m *updateManager) commit() {
+	out := m.out
+	m.out = nil
+	for _, u := range out {
+		u := u
+		select {
+		case m.conn.delegateQueue <- func() {
+			m.delegate.HandleUpdate(u)
+		}:
+		case <-m.donec:
+			// the state is not saved, so the dropped updates are fetched again
+			return
+		}
+	}
+
+	if m.dirty {
+		m.dirty = false
+		st := m.state.Clone()
+		m.conn.updateState(func(state *State) {
+			state.Updates = st
+		})
+	}
+}
+
+func (m *updateManager) deliver(u *Update) {
+	m.out = append(m.out, u)
+}
+
+func (m *updateManager) syncState() {
+	if !m.state.IsZero() {
+		m.getDifference()
+		return
+	}
+
+	r, err := m.conn.SendContext(m.ctx, &mtproto.TLUpdatesGetState{})
+	if err != nil {
+		log.Printf("WARNING: updates.getState failed: %v", err)
+		return
+	}
+	switch r := r.(type) {
+	case *mtproto.TLUpdatesState:
+		m.setCommonState(r)
+	default:
+		log.Printf("WARNING: updates.getState failed: %v", m.conn.HandleUnknownReply(r))
+	}
+}
+
+func (m *updateManager) setCommonState(st *mtproto.TLUpdatesState) {
+	m.state.Pts = st.Pts
+	m.state.Qts = st.Qts
+	m.state.Date = st.Date
+	m.state.Seq = st.Seq
+	m.dirty = true
+}
+
+func (m *updateManager) handleUpdates(o tl.Object) {
+	switch o := o.(type) {
+	case *mtproto.TLUpdatesTooLong:
+		m.getDifference()
+	case *mtproto.TLUpdateShortMessage:
+		selfID := m.selfUserID()
+		msg := &mtproto.TLMessage{
+			Flags:        o.Flags | (1 << 8), // from_id
+			ID:           o.ID,
+			FwdFrom:      o.FwdFrom,
+			ViaBotID:     o.ViaBotID,
+			ReplyToMsgID: o.ReplyToMsgID,
+			Date:         o.Date,
+			Message:      o.Message,
+			Entities:     o.Entities,
+		}
+		if o.Out() {
+			msg.FromID = selfID
+			msg.ToID = &mtproto.TLPeerUser{UserID: o.UserID}
+		} else {
+			msg.FromID = o.UserID
+			msg.ToID = &mtproto.TLPeerUser{UserID: selfID}
+		}
+		m.handleUpdate(&Update{
+			Update: &mtproto.TLUpdateNewMessage{Message: msg, Pts: o.Pts, PtsCount: o.PtsCount},
+			Date:   o.Date,
+		})
+	case *mtproto.TLUpdateShortChatMessage:
+		msg := &mtproto.TLMessage{
+			Flags:        o.Flags | (1 << 8), // from_id
+			ID:           o.ID,
+			FromID:       o.FromID,
+			ToID:         &mtproto.TLPeerChat{ChatID: o.ChatID},
+			FwdFrom:      o.FwdFrom,
+			ViaBotID:     o.ViaBotID,
+			ReplyToMsgID: o.ReplyToMsgID,
+			Date:         o.Date,
+			Message:      o.Message,
+			Entities:     o.Entities,
+		}
+		m.handleUpdate(&Update{
+			Update: &mtproto.TLUpdateNewMessage{Message: msg, Pts: o.Pts, PtsCount: o.PtsCount},
+			Date:   o.Date,
+		})
+	case *mtproto.TLUpdateShortSentMessage:
+		m.applyPts(&pendingUpdate{pts: o.Pts, ptsCount: o.PtsCount})
+	case *mtproto.TLUpdateShort:
+		m.handleUpdate(&Update{Update: o.Update, Date: o.Date})
+	case *mtproto.TLUpdates:
+		m.handleSeq(&pendingSeq{o.Updates, o.Users, o.Chats, o.Date, o.Seq, o.Seq})
+	case *mtproto.TLUpdatesCombined:
+		m.handleSeq(&pendingSeq{o.Updates, o.Users, o.Chats, o.Date, o.SeqStart, o.Seq})
+	default:
+		log.Printf("WARNING: unexpected updates object: %v", o)
+	}
+}
+
+func (m *updateManager) handleSeq(s *pendingSeq) {
+	if s.seq != 0 && m.state.Seq != 0 {
+		if s.seqStart <= m.state.Seq {
+			// already applied
+			return
+		} else if s.seqStart > m.state.Seq+1 {
+			m.pendingSeqs = append(m.pendingSeqs, s)
+			m.startGapTimer()
+			return
+		}
+	}
+
+	m.applySeq(s)
+	m.flushPending()
+}
+
+func (m *updateManager) applySeq(s *pendingSeq) {
+	m.rememberChats(s.chats)
+	for _, u := range s.updates {
+		m.handleUpdate(&Update{Update: u, Date: s.date, Users: s.users, Chats: s.chats})
+	}
+	if s.seq != 0 {
+		m.state.Seq = s.seq
+		m.state.Date = s.date
+		m.dirty = true
+	}
+}
+
+func (m *updateManager) handleUpdate(u *Update) {
+	if o, ok := u.Update.(*mtproto.TLUpdateChannelTooLong); ok {
+		if o.HasPts() {
+			if _, known := m.state.ChannelPts[o.ChannelID]; !known {
+				m.state.ChannelPts[o.ChannelID] = o.Pts
+				m.dirty = true
+			}
+		}
+		m.getChannelDifference(o.ChannelID)
+		return
+	}
+
+	if p := updatePts(u.Update); p != nil {
+		p.update = u
+		m.applyPts(p)
+	} else {
+		m.deliver(u)
+	}
+}
+
+// updatePts returns the pts (or qts) information carried by the given update, or nil.
+func updatePts(u mtproto.TLUpdateType) *pendingUpdate {
+	switch u := u.(type) {
+	case *mtproto.TLUpdateNewMessage:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateDeleteMessages:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateReadHistoryInbox:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateReadHistoryOutbox:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateWebPage:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateReadMessagesContents:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateEditMessage:
+		return &pendingUpdate{pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateNewEncryptedMessage:
+		return &pendingUpdate{box: qtsBox, pts: u.Qts, ptsCount: 1}
+	case *mtproto.TLUpdateNewChannelMessage:
+		if id := messageChannelID(u.Message); id != 0 {
+			return &pendingUpdate{box: id, pts: u.Pts, ptsCount: u.PtsCount}
+		}
+	case *mtproto.TLUpdateEditChannelMessage:
+		if id := messageChannelID(u.Message); id != 0 {
+			return &pendingUpdate{box: id, pts: u.Pts, ptsCount: u.PtsCount}
+		}
+	case *mtproto.TLUpdateDeleteChannelMessages:
+		return &pendingUpdate{box: u.ChannelID, pts: u.Pts, ptsCount: u.PtsCount}
+	case *mtproto.TLUpdateChannelWebPage:
+		return &pendingUpdate{box: u.ChannelID, pts: u.Pts, ptsCount: u.PtsCount}
+	}
+	return nil
+}
+
+func messageChannelID(msg mtproto.TLMessageType) int {
+	var peer mtproto.TLPeerType
+	switch msg := msg.(type) {
+	case *mtproto.TLMessage:
+		peer = msg.ToID
+	case *mtproto.TLMessageService:
+		peer = msg.ToID
+	}
+	if peer, ok := peer.(*mtproto.TLPeerChannel); ok {
+		return peer.ChannelID
+	}
+	return 0
+}
+
+func (m *updateManager) localPts(box int) (int, bool) {
+	switch box {
+	case 0:
+		return m.state.Pts, m.state.Pts != 0
+	case qtsBox:
+		return m.state.Qts, !m.state.IsZero()
+	default:
+		pts, ok := m.state.ChannelPts[box]
+		return pts, ok
+	}
+}
+
+func (m *updateManager) setLocalPts(box int, pts int) {
+	switch box {
+	case 0:
+		m.state.Pts = pts
+	case qtsBox:
+		m.state.Qts = pts
+	default:
+		m.state.ChannelPts[box] = pts
+	}
+	m.dirty = true
+}
+
+// applyPts applies the update if it is the next one in its box, drops it if
+// it has already been applied, and holds it back otherwise.
+func (m *updateManager) applyPts(p *pendingUpdate) {
+	local, known := m.localPts(p.box)
+	if known && local+p.ptsCount > p.pts {
+		// already applied
+		return
+	} else if known && local+p.ptsCount < p.pts {
+		m.pending = append(m.pending, p)
+		m.startGapTimer()
+		return
+	}
+
+	m.setLocalPts(p.box, p.pts)
+	if p.update != nil {
+		m.deliver(p.update)
+	}
+	m.flushPending()
+}
+
+// flushPending applies any held back updates that are no longer preceded by a gap.
+func (m *updateManager) flushPending() {
+	for progress := true; progress; {
+		progress = false
+
+		for i, p := range m.pending {
+			local, _ := m.localPts(p.box)
+			if local+p.ptsCount > p.pts {
+				m.pending = append(m.pending[:i], m.pending[i+1:]...)
+				progress = true
+				break
+			} else if local+p.ptsCount == p.pts {
+				m.pending = append(m.pending[:i], m.pending[i+1:]...)
+				m.setLocalPts(p.box, p.pts)
+				if p.update != nil {
+					m.deliver(p.update)
+				}
+				progress = true
+				break
+			}
+		}
+
+		for i, s := range m.pendingSeqs {
+			if s.seqStart <= m.state.Seq {
+				m.pendingSeqs = append(m.pendingSeqs[:i], m.pendingSeqs[i+1:]...)
+				progress = true
+				break
+			} else if s.seqStart == m.state.Seq+1 {
+				m.pendingSeqs = append(m.pendingSeqs[:i], m.pendingSeqs[i+1:]...)
+				m.applySeq(s)
+				progress = true
+				break
+			}
+		}
+	}
+
+	if len(m.pending) == 0 && len(m.pendingSeqs) == 0 {
+		m.gapDeadline = time.Time{}
+	}
+}
+
+func (m *updateManager) startGapTimer() {
+	if m.gapDeadline.IsZero() {
+		m.gapDeadline = time.Now().Add(updateGapTimeout)
+	}
+}
+
+// recoverGaps fetches the difference for every box that still has a gap
+// after updateGapTimeout.
+func (m *updateManager) recoverGaps() {
+	m.gapDeadline = time.Time{}
+
+	needCommon := len(m.pendingSeqs) > 0
+	channels := make(map[int]bool)
+	for _, p := range m.pending {
+		if p.box == 0 || p.box == qtsBox {
+			needCommon = true
+		} else {
+			channels[p.box] = true
+		}
+	}
+
+	if needCommon {
+		m.getDifference()
+	}
+	for id := range channels {
+		m.getChannelDifference(id)
+	}
+
+	m.flushPending()
+	if len(m.pending) > 0 || len(m.pendingSeqs) > 0 {
+		m.startGapTimer()
+	}
+}
+
+func (m *updateManager) getDifference() {
+	for {
+		r, err := m.conn.SendContext(m.ctx, &mtproto.TLUpdatesGetDifference{
+			Pts:  m.state.Pts,
+			Date: m.state.Date,
+			Qts:  m.state.Qts,
+		})
+		if err != nil {
+			log.Printf("WARNING: updates.getDifference failed: %v", err)
+			return
+		}
+
+		switch r := r.(type) {
+		case *mtproto.TLUpdatesDifferenceEmpty:
+			m.state.Date = r.Date
+			m.state.Seq = r.Seq
+			m.dirty = true
+			return
+		case *mtproto.TLUpdatesDifference:
+			m.applyDifference(r.NewMessages, r.OtherUpdates, r.Chats, r.Users)
+			m.setCommonState(r.State)
+			return
+		case *mtproto.TLUpdatesDifferenceSlice:
+			m.applyDifference(r.NewMessages, r.OtherUpdates, r.Chats, r.Users)
+			m.setCommonState(r.IntermediateState)
+		case *mtproto.TLUpdatesDifferenceTooLong:
+			m.state.Pts = r.Pts
+			m.dirty = true
+		default:
+			log.Printf("WARNING: updates.getDifference failed: %v", m.conn.HandleUnknownReply(r))
+			return
+		}
+	}
+}
+
+func (m *updateManager) applyDifference(messages []mtproto.TLMessageType, updates []mtproto.TLUpdateType, chats []mtproto.TLChatType, users []mtproto.TLUserType) {
+	m.rememberChats(chats)
+
+	for _, msg := range messages {
+		m.deliver(&Update{
+			Update: &mtproto.TLUpdateNewMessage{Message: msg},
+			Users:  users,
+			Chats:  chats,
+		})
+	}
+
+	for _, u := range updates {
+		up := &Update{Update: u, Users: users, Chats: chats}
+		if p := updatePts(u); p != nil && p.box != 0 && p.box != qtsBox {
+			// channel updates are tracked separately from the common state
+			m.handleUpdate(up)
+		} else if _, ok := u.(*mtproto.TLUpdateChannelTooLong); ok {
+			m.handleUpdate(up)
+		} else {
+			m.deliver(up)
+		}
+	}
+}
+
+func (m *updateManager) getChannelDifference(channelID int) {
+	accessHash, ok := m.state.ChannelAccessHashes[channelID]
+	if !ok {
+		log.Printf("WARNING: cannot get difference of channel %d: unknown access hash, updates may be missing", channelID)
+		m.skipGap(channelID)
+		return
+	}
+	pts, ok := m.state.ChannelPts[channelID]
+	if !ok {
+		log.Printf("WARNING: cannot get difference of channel %d: unknown pts, updates may be missing", channelID)
+		m.skipGap(channelID)
+		return
+	}
+
+	for final := false; !final; {
+		r, err := m.conn.SendContext(m.ctx, &mtproto.TLUpdatesGetChannelDifference{
+			Channel: &mtproto.TLInputChannel{ChannelID: channelID, AccessHash: accessHash},
+			Filter:  &mtproto.TLChannelMessagesFilterEmpty{},
+			Pts:     pts,
+			Limit:   channelDifferenceLimit,
+		})
+		if err != nil {
+			log.Printf("WARNING: updates.getChannelDifference failed: %v", err)
+			return
+		}
+
+		switch r := r.(type) {
+		case *mtproto.TLUpdatesChannelDifferenceEmpty:
+			pts, final = r.Pts, r.Final()
+		case *mtproto.TLUpdatesChannelDifferenceTooLong:
+			m.applyChannelDifference(r.Messages, nil, r.Chats, r.Users)
+			pts, final = r.Pts, r.Final()
+		case *mtproto.TLUpdatesChannelDifference:
+			m.applyChannelDifference(r.NewMessages, r.OtherUpdates, r.Chats, r.Users)
+			pts, final = r.Pts, r.Final()
+		default:
+			log.Printf("WARNING: updates.getChannelDifference failed: %v", m.conn.HandleUnknownReply(r))
+			return
+		}
+
+		m.state.ChannelPts[channelID] = pts
+		m.dirty = true
+	}
+}
+
+func (m *updateManager) applyChannelDifference(messages []mtproto.TLMessageType, updates []mtproto.TLUpdateType, chats []mtproto.TLChatType, users []mtproto.TLUserType) {
+	m.rememberChats(chats)
+
+	for _, msg := range messages {
+		m.deliver(&Update{
+			Update: &mtproto.TLUpdateNewChannelMessage{Message: msg},
+			Users:  users,
+			Chats:  chats,
+		})
+	}
+	for _, u := range updates {
+		m.deliver(&Update{Update: u, Users: users, Chats: chats})
+	}
+}
+
+// skipGap delivers the updates held back in a box whose gap cannot be
+// filled, in pts order, rather than losing them too.
+func (m *updateManager) skipGap(box int) {
+	var held []*pendingUpdate
+	pending := m.pending[:0]
+	for _, p := range m.pending {
+		if p.box == box {
+			held = append(held, p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	m.pending = pending
+
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].pts < held[j].pts
+	})
+	for _, p := range held {
+		if local, _ := m.localPts(box); p.pts <= local {
+			continue
+		}
+		m.setLocalPts(box, p.pts)
+		if p.update != nil {
+			m.deliver(p.update)
+		}
+	}
+}
+
+func (m *updateManager) rememberChats(chats []mtproto.TLChatType) {
+	for _, chat := range chats {
+		if ch, ok := chat.(*mtproto.TLChannel); ok && ch.AccessHash != 0 && m.state.ChannelAccessHashes[ch.ID] != ch.AccessHash {
+			m.state.ChannelAccessHashes[ch.ID] = ch.AccessHash
+			m.dirty = true
+		}
+	}
+}
+
+func (m *updateManager) selfUserID() int {
+	m.conn.stateMut.Lock()
+	defer m.conn.stateMut.Unlock()
+	return m.conn.state.UserID
+}
@@ -0,0 +1,254 @@
+package telegramapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/mtproto/mtprototest"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+func newTestUpdateManager(pts int) *updateManager {
+	c := &Conn{state: &State{}}
+	c.state.initialize()
+	m := newUpdateManager(c, nil)
+	m.state = c.state.Updates.Clone()
+	m.state.Pts = pts
+	m.state.Seq = 1
+	return m
+}
+
+func newMessageUpdate(id, pts int) *mtproto.TLUpdateShort {
+	return &mtproto.TLUpdateShort{
+		Update: &mtproto.TLUpdateNewMessage{
+			Message:  &mtproto.TLMessage{ID: id},
+			Pts:      pts,
+			PtsCount: 1,
+		},
+	}
+}
+
+func deliveredIDs(m *updateManager) []int {
+	var ids []int
+	for _, u := range m.out {
+		msg := u.Update.(*mtproto.TLUpdateNewMessage).Message.(*mtproto.TLMessage)
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestUpdatesPtsOrdering(t *testing.T) {
+	m := newTestUpdateManager(10)
+
+	m.handleUpdates(newMessageUpdate(1, 11))
+	m.handleUpdates(newMessageUpdate(1, 11)) // duplicate
+	m.handleUpdates(newMessageUpdate(3, 13)) // gap
+	if len(m.pending) != 1 {
+		t.Fatalf("pending = %d, expected 1", len(m.pending))
+	}
+	if m.gapDeadline.IsZero() {
+		t.Errorf("gap timer not started")
+	}
+
+	m.handleUpdates(newMessageUpdate(2, 12)) // fills the gap
+
+	a, e := deliveredIDs(m), []int{1, 2, 3}
+	if len(a) != len(e) || a[0] != e[0] || a[1] != e[1] || a[2] != e[2] {
+		t.Errorf("delivered %v, expected %v", a, e)
+	}
+	if m.state.Pts != 13 {
+		t.Errorf("pts = %d, expected 13", m.state.Pts)
+	}
+	if len(m.pending) != 0 || !m.gapDeadline.IsZero() {
+		t.Errorf("gap not cleared: pending = %d, deadline = %v", len(m.pending), m.gapDeadline)
+	}
+}
+
+func TestUpdatesSeqOrdering(t *testing.T) {
+	m := newTestUpdateManager(10)
+
+	m.handleUpdates(&mtproto.TLUpdates{
+		Updates: []mtproto.TLUpdateType{&mtproto.TLUpdateNewMessage{Message: &mtproto.TLMessage{ID: 2}, Pts: 12, PtsCount: 1}},
+		Seq:     3,
+	})
+	if len(m.pendingSeqs) != 1 {
+		t.Fatalf("pendingSeqs = %d, expected 1", len(m.pendingSeqs))
+	}
+
+	m.handleUpdates(&mtproto.TLUpdates{
+		Updates: []mtproto.TLUpdateType{&mtproto.TLUpdateNewMessage{Message: &mtproto.TLMessage{ID: 1}, Pts: 11, PtsCount: 1}},
+		Seq:     2,
+	})
+
+	a := deliveredIDs(m)
+	if len(a) != 2 || a[0] != 1 || a[1] != 2 {
+		t.Errorf("delivered %v, expected [1 2]", a)
+	}
+	if m.state.Seq != 3 {
+		t.Errorf("seq = %d, expected 3", m.state.Seq)
+	}
+}
+
+func TestUpdatesChannelPts(t *testing.T) {
+	m := newTestUpdateManager(10)
+	m.state.ChannelPts[5] = 100
+
+	msg := &mtproto.TLMessage{ID: 1, ToID: &mtproto.TLPeerChannel{ChannelID: 5}}
+	m.handleUpdates(&mtproto.TLUpdateShort{Update: &mtproto.TLUpdateNewChannelMessage{Message: msg, Pts: 101, PtsCount: 1}})
+	m.handleUpdates(&mtproto.TLUpdateShort{Update: &mtproto.TLUpdateNewChannelMessage{Message: msg, Pts: 101, PtsCount: 1}})
+
+	if len(m.out) != 1 {
+		t.Errorf("delivered %d updates, expected 1", len(m.out))
+	}
+	if m.state.ChannelPts[5] != 101 || m.state.Pts != 10 {
+		t.Errorf("channel pts = %d, pts = %d, expected 101 and 10", m.state.ChannelPts[5], m.state.Pts)
+	}
+}
+
+func TestUpdatesChannelGapWithoutAccessHash(t *testing.T) {
+	m := newTestUpdateManager(10)
+	m.state.ChannelPts[5] = 100
+
+	peer := &mtproto.TLPeerChannel{ChannelID: 5}
+	for _, pts := range []int{103, 102} {
+		msg := &mtproto.TLMessage{ID: pts, ToID: peer}
+		m.handleUpdates(&mtproto.TLUpdateShort{Update: &mtproto.TLUpdateNewChannelMessage{Message: msg, Pts: pts, PtsCount: 1}})
+	}
+	if len(m.pending) != 2 {
+		t.Fatalf("pending = %d, expected 2", len(m.pending))
+	}
+
+	// the difference cannot be fetched, so the held updates are delivered
+	m.recoverGaps()
+	if len(m.out) != 2 || len(m.pending) != 0 {
+		t.Fatalf("delivered %d updates, %d still pending", len(m.out), len(m.pending))
+	}
+	for i, u := range m.out {
+		if pts := u.Update.(*mtproto.TLUpdateNewChannelMessage).Pts; pts != 102+i {
+			t.Errorf("update %d has pts %d, expected %d", i, pts, 102+i)
+		}
+	}
+	if m.state.ChannelPts[5] != 103 {
+		t.Errorf("channel pts = %d, expected 103", m.state.ChannelPts[5])
+	}
+}
+
+func TestUpdatesStateKeepsChannelAccessHashes(t *testing.T) {
+	m := newTestUpdateManager(10)
+	m.handleUpdates(&mtproto.TLUpdates{
+		Chats: []mtproto.TLChatType{&mtproto.TLChannel{ID: 5, AccessHash: 7}},
+	})
+	if !m.dirty {
+		t.Error("state not marked dirty after learning an access hash")
+	}
+
+	state := &State{Updates: m.state.Clone()}
+	state.initialize()
+	var w tl.Writer
+	state.WriteBareTo(&w)
+	var restored State
+	r := tl.NewReader(w.Bytes())
+	restored.ReadBareFrom(r)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if hash := restored.Updates.ChannelAccessHashes[5]; hash != 7 {
+		t.Errorf("restored access hash %d, expected 7", hash)
+	}
+}
+
+// updatesDelegate collects the IDs of the messages delivered to it.
+type updatesDelegate struct {
+	*testDelegate
+	conn *Conn
+	ids  chan int
+}
+
+func (d *updatesDelegate) HandleUpdate(u *Update) {
+	// delegates may call into the connection
+	if _, err := d.conn.Send(&mtproto.TLHelpGetConfig{}); err != nil {
+		panic(err)
+	}
+	switch u := u.Update.(type) {
+	case *mtproto.TLUpdateNewMessage:
+		d.ids <- u.Message.(*mtproto.TLMessage).ID
+	case *mtproto.TLUpdateNewChannelMessage:
+		d.ids <- u.Message.(*mtproto.TLMessage).ID
+	}
+}
+
+func startUpdatesTestConn(t *testing.T, srv *mtprototest.Server, updates UpdatesState) (*Conn, *updatesDelegate) {
+	state := &State{Updates: updates}
+	state.initialize()
+	d := &updatesDelegate{testDelegate: &testDelegate{readyc: make(chan struct{})}, ids: make(chan int, 10)}
+	c := startTestConnWith(t, srv, state, d, d.readyc)
+	d.conn = c
+	return c, d
+}
+
+func (d *updatesDelegate) expectIDs(t *testing.T, expected ...int) {
+	t.Helper()
+	for _, e := range expected {
+		select {
+		case id := <-d.ids:
+			if id != e {
+				t.Errorf("delivered message %d, expected %d", id, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not delivered", e)
+		}
+	}
+}
+
+func TestUpdatesGapGetsDifference(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	peer := &mtproto.TLPeerUser{UserID: 1}
+	srv.Handle(mtproto.TagUpdatesGetDifference, func(req *mtprototest.Request) tl.Object {
+		if q := req.Query.(*mtproto.TLUpdatesGetDifference); q.Pts != 10 {
+			return &mtproto.TLRPCError{ErrorCode: 400, ErrorMessage: "PERSISTENT_TIMESTAMP_INVALID"}
+		}
+		return &mtproto.TLUpdatesDifference{
+			NewMessages: []mtproto.TLMessageType{
+				&mtproto.TLMessage{ID: 1, ToID: peer},
+				&mtproto.TLMessage{ID: 2, ToID: peer},
+			},
+			State: &mtproto.TLUpdatesState{Pts: 12, Date: 2, Seq: 1},
+		}
+	})
+	c, d := startUpdatesTestConn(t, srv, UpdatesState{Pts: 10, Date: 1, Seq: 1})
+
+	// pts 11 is missing
+	c.updates.push(newMessageUpdate(2, 12))
+	d.expectIDs(t, 1, 2)
+}
+
+func TestUpdatesChannelGapGetsChannelDifference(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	peer := &mtproto.TLPeerChannel{ChannelID: 5}
+	srv.Handle(mtproto.TagUpdatesGetChannelDifference, func(req *mtprototest.Request) tl.Object {
+		q := req.Query.(*mtproto.TLUpdatesGetChannelDifference)
+		if ch, ok := q.Channel.(*mtproto.TLInputChannel); !ok || ch.ChannelID != 5 || ch.AccessHash != 7 || q.Pts != 100 {
+			return &mtproto.TLRPCError{ErrorCode: 400, ErrorMessage: "CHANNEL_INVALID"}
+		}
+		diff := &mtproto.TLUpdatesChannelDifference{
+			Pts: 102,
+			NewMessages: []mtproto.TLMessageType{
+				&mtproto.TLMessage{ID: 1, ToID: peer},
+				&mtproto.TLMessage{ID: 2, ToID: peer},
+			},
+		}
+		diff.SetFinal(true)
+		return diff
+	})
+	c, d := startUpdatesTestConn(t, srv, UpdatesState{Pts: 10, Date: 1, Seq: 1, ChannelPts: map[int]int{5: 100}})
+
+	// pts 101 of the channel is missing
+	c.updates.push(&mtproto.TLUpdates{
+		Updates: []mtproto.TLUpdateType{&mtproto.TLUpdateNewChannelMessage{Message: &mtproto.TLMessage{ID: 2, ToID: peer}, Pts: 102, PtsCount: 1}},
+		Chats:   []mtproto.TLChatType{&mtproto.TLChannel{ID: 5, AccessHash: 7}},
+	})
+	d.expectIDs(t, 1, 2)
+}
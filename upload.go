@@ -0,0 +1,239 @@
+package telegramapi
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/binints"
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// UploadPartSize is the size of the parts UploadFile sends, the largest the
+// server accepts.
+const UploadPartSize = 512 * 1024
+
+// files larger than this are uploaded with upload.saveBigFilePart
+const bigFileThreshold = 10 * 1024 * 1024
+
+// how many parts a file may have, which limits uploads to 1500 MiB
+const maxUploadParts = 3000
+
+// how many parts UploadFile sends at once
+const uploadWorkers = 4
+
+// how many times a part is resent after failing for reasons other than
+// those the scheduler already retries
+const maxUploadPartRetries = 3
+
+var ErrFileTooBig = errors.New("file is too big to upload")
+
+// UploadProgressFunc is called after each part of a file has been uploaded,
+// with the number of bytes uploaded so far. Calls never overlap, and the
+// count never goes backwards.
+type UploadProgressFunc func(uploaded, size int64)
+
+// UploadFile uploads size bytes read from r, sending parts of them in
+// parallel over a media connection, and returns the file to pass to
+// messages.sendMedia and similar calls.
+func (c *Conn) UploadFile(ctx context.Context, r io.Reader, size int64, name string) (mtproto.TLInputFileType, error) {
+	return c.UploadFileWithProgress(ctx, r, size, name, nil)
+}
+
+// UploadFileWithProgress is like UploadFile, but reports the progress of the
+// upload to progress, which may be nil.
+func (c *Conn) UploadFileWithProgress(ctx context.Context, r io.Reader, size int64, name string, progress UploadProgressFunc) (mtproto.TLInputFileType, error) {
+	if size <= 0 {
+		return nil, errors.New("cannot upload an empty file")
+	}
+	parts := int((size + UploadPartSize - 1) / UploadPartSize)
+	if parts > maxUploadParts {
+		return nil, ErrFileTooBig
+	}
+
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	u := &upload{
+		conn:     c,
+		r:        r,
+		size:     size,
+		fileID:   binints.DecodeUint64LE(id[:]),
+		parts:    parts,
+		big:      size > bigFileThreshold,
+		progress: progress,
+	}
+	if !u.big {
+		u.md5 = md5.New()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < uploadWorkers && i < parts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := u.work(ctx); err != nil {
+				u.fail(err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	if u.big {
+		return &mtproto.TLInputFileBig{ID: u.fileID, Parts: parts, Name: name}, nil
+	}
+	return &mtproto.TLInputFile{
+		ID:          u.fileID,
+		Parts:       parts,
+		Name:        name,
+		Md5Checksum: hex.EncodeToString(u.md5.Sum(nil)),
+	}, nil
+}
+
+// upload is the state shared by the workers of UploadFile.
+type upload struct {
+	conn     *Conn
+	size     int64
+	fileID   uint64
+	parts    int
+	big      bool
+	progress UploadProgressFunc
+
+	// the parts are read in order, so that the checksum can be computed
+	readMut sync.Mutex
+	r       io.Reader
+	md5     hash.Hash
+	next    int
+
+	mut      sync.Mutex
+	uploaded int64
+	err      error
+
+	// serializes the calls of progress, dropping counts older than the last
+	// one reported
+	progressMut sync.Mutex
+	reported    int64
+}
+
+func (u *upload) work(ctx context.Context) error {
+	for {
+		part, data, err := u.nextPart()
+		if err != nil || data == nil {
+			return err
+		}
+		if err := u.sendPart(ctx, part, data); err != nil {
+			return err
+		}
+		u.finishPart(len(data))
+	}
+}
+
+// nextPart reads the next part of the file, returning nil data when all of
+// them have been read.
+func (u *upload) nextPart() (int, []byte, error) {
+	u.readMut.Lock()
+	defer u.readMut.Unlock()
+
+	u.mut.Lock()
+	failed := u.err != nil
+	u.mut.Unlock()
+	if failed || u.next >= u.parts {
+		return 0, nil, nil
+	}
+
+	part := u.next
+	n := u.size - int64(part)*UploadPartSize
+	if n > UploadPartSize {
+		n = UploadPartSize
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(u.r, data); err != nil {
+		return 0, nil, fmt.Errorf("reading part %d of the file: %w", part, err)
+	}
+	if u.md5 != nil {
+		u.md5.Write(data)
+	}
+	u.next++
+	return part, data, nil
+}
+
+func (u *upload) sendPart(ctx context.Context, part int, data []byte) error {
+	var req tl.Object
+	if u.big {
+		req = &mtproto.TLUploadSaveBigFilePart{FileID: u.fileID, FilePart: part, FileTotalParts: u.parts, Bytes: data}
+	} else {
+		req = &mtproto.TLUploadSaveFilePart{FileID: u.fileID, FilePart: part, Bytes: data}
+	}
+
+	for attempt := 0; ; attempt++ {
+		r, err := u.conn.SendToMediaDC(ctx, 0, req)
+		if err == nil {
+			switch r := r.(type) {
+			case *mtproto.TLBoolTrue:
+				return nil
+			case *mtproto.TLBoolFalse:
+				err = fmt.Errorf("server did not save part %d of the file", part)
+			case *mtproto.TLRPCError:
+				return NewRPCError(r)
+			default:
+				return u.conn.HandleUnknownReply(r)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= maxUploadPartRetries {
+			return err
+		}
+
+		timer := time.NewTimer(transientErrorDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// finishPart counts an uploaded part and reports the progress, outside
+// u.mut so that a slow callback does not stall the workers fetching parts.
+func (u *upload) finishPart(n int) {
+	u.mut.Lock()
+	u.uploaded += int64(n)
+	uploaded := u.uploaded
+	u.mut.Unlock()
+
+	if u.progress == nil {
+		return
+	}
+	u.progressMut.Lock()
+	defer u.progressMut.Unlock()
+	if uploaded > u.reported {
+		u.reported = uploaded
+		u.progress(uploaded, u.size)
+	}
+}
+
+func (u *upload) fail(err error) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
@@ -0,0 +1,146 @@
+package telegramapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PROger4ever/telegramapi/mtproto"
+	"github.com/PROger4ever/telegramapi/mtproto/mtprototest"
+	"github.com/PROger4ever/telegramapi/tl"
+)
+
+// uploadServer keeps the parts of the files uploaded to it.
+type uploadServer struct {
+	mut     sync.Mutex
+	parts   map[int][]byte
+	total   int
+	calls   map[int]int
+	refuses map[int]bool
+}
+
+func newUploadServer(srv *mtprototest.Server) *uploadServer {
+	us := &uploadServer{parts: make(map[int][]byte), calls: make(map[int]int), refuses: make(map[int]bool)}
+	srv.Handle(mtproto.TagUploadSaveFilePart, us.handle)
+	srv.Handle(mtproto.TagUploadSaveBigFilePart, us.handle)
+	return us
+}
+
+func (us *uploadServer) handle(req *mtprototest.Request) tl.Object {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+
+	var part int
+	var data []byte
+	switch q := req.Query.(type) {
+	case *mtproto.TLUploadSaveFilePart:
+		part, data = q.FilePart, q.Bytes
+	case *mtproto.TLUploadSaveBigFilePart:
+		part, data, us.total = q.FilePart, q.Bytes, q.FileTotalParts
+	}
+	us.calls[part]++
+	if us.refuses[part] {
+		delete(us.refuses, part)
+		return &mtproto.TLBoolFalse{}
+	}
+	us.parts[part] = data
+	return &mtproto.TLBoolTrue{}
+}
+
+func (us *uploadServer) content() []byte {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	var content []byte
+	for i := 0; i < len(us.parts); i++ {
+		content = append(content, us.parts[i]...)
+	}
+	return content
+}
+
+func TestUploadFile(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	us := newUploadServer(srv)
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	content := make([]byte, 2*UploadPartSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	us.refuses[1] = true
+
+	var progress []int64
+	f, err := c.UploadFileWithProgress(ctx, bytes.NewReader(content), int64(len(content)), "a.bin", func(uploaded, size int64) {
+		progress = append(progress, uploaded)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := f.(*mtproto.TLInputFile)
+	if !ok {
+		t.Fatalf("UploadFile returned %T, expected *TLInputFile", f)
+	}
+	sum := md5.Sum(content)
+	if file.Parts != 3 || file.Name != "a.bin" || file.Md5Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("UploadFile returned %v", file)
+	}
+	if !bytes.Equal(us.content(), content) {
+		t.Error("uploaded parts do not match the file")
+	}
+	if us.calls[1] != 2 {
+		t.Errorf("refused part sent %d times, expected 2", us.calls[1])
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("progress went from %d to %d", progress[i-1], progress[i])
+		}
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != int64(len(content)) {
+		t.Errorf("progress reported as %v", progress)
+	}
+}
+
+func TestUploadBigFile(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	us := newUploadServer(srv)
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	content := make([]byte, bigFileThreshold+1)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	f, err := c.UploadFile(ctx, bytes.NewReader(content), int64(len(content)), "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := f.(*mtproto.TLInputFileBig)
+	if !ok {
+		t.Fatalf("UploadFile returned %T, expected *TLInputFileBig", f)
+	}
+	if parts := bigFileThreshold/UploadPartSize + 1; file.Parts != parts || us.total != parts {
+		t.Errorf("file uploaded in %d parts (%d announced), expected %d", file.Parts, us.total, parts)
+	}
+	if !bytes.Equal(us.content(), content) {
+		t.Error("uploaded parts do not match the file")
+	}
+}
+
+func TestUploadFileShortReader(t *testing.T) {
+	srv := mtprototest.NewServer()
+	defer srv.Close()
+	newUploadServer(srv)
+	c := startTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := c.UploadFile(ctx, bytes.NewReader(make([]byte, 100)), 200, "short.bin"); err == nil {
+		t.Error("upload of a file shorter than its size succeeded")
+	}
+}